@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+// chatScreen is the full-screen mode enabled with NEXUSLINK_UI=screen, nil otherwise
+var chatScreen *log_prompt.Screen
+
+const screenRefreshInterval = time.Second
+
+// setupChatScreen enables the full-screen mode: the rooms, the topics and the DMs of the
+// connected nodes are listed in the sidebar, and the connection state is shown in the status bar
+func setupChatScreen(ctx context.Context, lp *log_prompt.LogPrompt) error {
+	screen, err := lp.EnableScreen()
+	if err != nil {
+		return err
+	}
+	chatScreen = screen
+	go func() {
+		ticker := time.NewTicker(screenRefreshInterval)
+		defer ticker.Stop()
+		for {
+			refreshChatScreen()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func refreshChatScreen() {
+	chats := []string{}
+	for _, room := range chatRooms.Rooms() {
+		chats = append(chats, room.Name)
+	}
+	for _, topic := range chatTopics.Topics() {
+		chats = append(chats, "#"+topic)
+	}
+	for _, peer := range appNode.Peers() {
+		if nodeID := peer.NodeID(); nodeID != "" {
+			chats = append(chats, dmChat(nodeID))
+		}
+	}
+	chatScreen.SetChats(chats)
+	chatScreen.SetStatus(fmt.Sprintf(
+		" node %s | peers: %d | Alt+Up/Down: chats, PgUp/PgDn: scroll, /<command> in chats",
+		shortNodeID(appNode.ID), len(appNode.Peers()),
+	))
+}
+
+// showChatMessage shows the message in its chat of the full-screen mode, or logs it
+func showChatMessage(chatLogger logs.Logger, chat string, from string, text string) {
+	if chatScreen != nil {
+		chatScreen.AddMessage(chat, fmt.Sprintf("%s: %s", from, text))
+		return
+	}
+	chatLogger.Log(fmt.Sprintf("[%s] %s: %s", chat, from, text))
+}
+
+// handleChatInput sends the input to the chat selected in the full-screen mode,
+// the input starting with "/" is a command. It returns false if no chat is selected.
+func handleChatInput(lp *log_prompt.LogPrompt, input string) bool {
+	if chatScreen == nil {
+		return false
+	}
+	chat := chatScreen.Selected()
+	if chat == log_prompt.LogChat {
+		return false
+	}
+	if command, ok := strings.CutPrefix(input, "/"); ok {
+		HandlePrompt(lp, command)
+		return true
+	}
+	if strings.TrimSpace(input) == "" {
+		return true
+	}
+	var err error
+	if topic, ok := strings.CutPrefix(chat, "#"); ok {
+		err = sayToTopic(topic, input)
+	} else if nodeID, ok := strings.CutPrefix(chat, "@"); ok {
+		err = sendDirectMessage(lp.NewLogger("chat"), nodeID, input)
+	} else {
+		err = chatRooms.Say(chat, input)
+	}
+	if err != nil {
+		lp.NewLogger("chat").Error("Failed to send message", "chat", chat, "error", err)
+	}
+	return true
+}
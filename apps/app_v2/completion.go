@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var commands = []string{
+	"listen", "server", "connect", "peers", "conns", "disconnect", "autoconnect", "dht", "ygg", "name",
+	"room", "topic", "say", "msg", "send", "accept", "share", "fetch", "transfers", "log", "help", "exit",
+}
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+var subcommands = map[string][]string{
+	"autoconnect": {"on", "off"},
+	"conns":       {"queue"},
+	"dht":         {"bootstrap", "status"},
+	"log":         {"level"},
+	"ygg":         {"connect", "status"},
+	"name":        {"register", "resolve"},
+	"room":        {"create", "join", "leave", "list"},
+	"topic":       {"join", "leave", "say", "list"},
+}
+
+// completePrompt completes the commands and their arguments: peers, rooms, topics,
+// file offers and paths, see log_prompt.Completer
+func completePrompt(line string) (int, []string) {
+	fields := strings.Split(line, " ")
+	word := fields[len(fields)-1]
+	start := len(line) - len(word)
+	args := fields[:len(fields)-1]
+	if len(args) == 0 {
+		return start, withPrefix(commands, word, " ")
+	}
+
+	var options []string
+	switch command, argIdx := args[0], len(args); {
+	case argIdx == 1 && subcommands[command] != nil:
+		options = subcommands[command]
+	case command == "share" && argIdx == 1, command == "send" && argIdx == 2:
+		return start, completePath(word)
+	case command == "send" && argIdx == 1, command == "disconnect" && argIdx == 1, command == "msg" && argIdx == 1,
+		command == "room" && argIdx == 2 && args[1] == "join":
+		options = connectedPeers()
+	case command == "connect" && argIdx == 1:
+		for _, peer := range lanDiscovery.Peers() {
+			options = append(options, peer.NodeID)
+		}
+	case command == "say" && argIdx == 1, command == "room" && argIdx == 2 && args[1] == "leave":
+		for _, room := range chatRooms.Rooms() {
+			options = append(options, room.Name)
+		}
+	case command == "topic" && argIdx == 2 && (args[1] == "leave" || args[1] == "say"):
+		options = chatTopics.Topics()
+	case command == "log" && argIdx >= 2:
+		options = logLevels
+	case command == "accept" && argIdx == 1:
+		for _, offer := range fileShare.Offers() {
+			options = append(options, offer.Manifest.Root)
+		}
+	}
+	return start, withPrefix(options, word, " ")
+}
+
+func connectedPeers() []string {
+	peers := []string{}
+	for _, peer := range appNode.Peers() {
+		peers = append(peers, peer.ID)
+	}
+	return peers
+}
+
+func withPrefix(options []string, prefix string, suffix string) []string {
+	candidates := []string{}
+	for _, option := range options {
+		if strings.HasPrefix(option, prefix) {
+			candidates = append(candidates, option+suffix)
+		}
+	}
+	return candidates
+}
+
+// completePath lists the files starting with the path's last element, directories end with "/"
+func completePath(path string) []string {
+	dir, base := filepath.Split(path)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+	candidates := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if entry.IsDir() {
+			name += string(filepath.Separator)
+		}
+		candidates = append(candidates, dir+name)
+	}
+	return candidates
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+)
+
+func handleConnsCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("conns_cmd_handler")
+
+	if len(params) > 0 {
+		handleConnsQueueCommand(lp, params)
+		return
+	}
+	conns := appNode.Conns()
+	if len(conns) == 0 {
+		logger.Log("No connections")
+		return
+	}
+	for _, conn := range conns {
+		rtt := "-"
+		if conn.RTT > 0 {
+			rtt = conn.RTT.Round(time.Microsecond).String()
+		}
+		compression := "off"
+		if conn.Compression.Algorithm != "" {
+			compression = fmt.Sprintf("%s %.1fx", conn.Compression.Algorithm, conn.Compression.Ratio())
+		}
+		logger.Log(fmt.Sprintf("  %s %s %s state: %s rtt: %s up: %s queue: %d/%d (max %d, dropped %d) compression: %s",
+			conn.PeerID, shortNodeID(conn.NodeID), conn.Direction, conn.State, rtt,
+			time.Since(conn.Since).Round(time.Second), conn.Queue.Depth, conn.Queue.Size,
+			conn.Queue.MaxDepth, conn.Queue.Dropped, compression))
+	}
+}
+
+// handleConnsQueueCommand sets the size and the policy of the connections' send queues
+func handleConnsQueueCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("conns_cmd_handler")
+
+	if len(params) != 3 || params[0] != "queue" {
+		logger.Log("usage: conns queue <size> <block|drop-oldest|disconnect>")
+		return
+	}
+	size, err := strconv.Atoi(params[1])
+	if err != nil || size <= 0 {
+		logger.Error("Invalid queue size", "size", params[1])
+		return
+	}
+	policy, err := tcp_conn.ParseQueuePolicy(params[2])
+	if err != nil {
+		logger.Error("Invalid queue policy", "error", err)
+		return
+	}
+	appNode.SetQueueOptions(tcp_conn.QueueOptions{Size: size, Policy: policy})
+	logger.Log(fmt.Sprintf("Send queue: %d messages, policy: %s", size, policy))
+}
+
+// handleDisconnectCommand closes the connection by the peer id or the node id prefix
+func handleDisconnectCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("disconnect_cmd_handler")
+
+	if len(params) != 1 || params[0] == "" {
+		logger.Log("disconnect: wrong number of arguments")
+		logger.Log("usage: disconnect <peer|node-id>")
+		return
+	}
+	matches := []string{}
+	for _, conn := range appNode.Conns() {
+		if conn.PeerID == params[0] {
+			matches = []string{conn.PeerID}
+			break
+		}
+		if conn.NodeID != "" && strings.HasPrefix(conn.NodeID, params[0]) {
+			matches = append(matches, conn.PeerID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		logger.Error("Peer not found", "peer", params[0])
+	case 1:
+		if err := appNode.Disconnect(matches[0]); err != nil {
+			logger.Error("Failed to disconnect", "error", err)
+		}
+	default:
+		logger.Error("Node id prefix matches several peers, use a longer one", "prefix", params[0], "peers", strings.Join(matches, ", "))
+	}
+}
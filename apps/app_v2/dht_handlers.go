@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/dht"
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/names"
+)
+
+const dhtTimeout = 30 * time.Second
+
+var appDHT *dht.DHT
+
+func setupDHT(lp *log_prompt.LogPrompt) error {
+	transport := dht.NewNodeTransport(appNode)
+	d, err := dht.New(lp.NewLogger("dht"), appNode.ID, transport, names.NewValidator())
+	if err != nil {
+		return err
+	}
+	transport.Serve(d)
+	appDHT = d
+	return nil
+}
+
+// resolveDHTNode looks up the node's current address by its full node id
+func resolveDHTNode(nodeID string) (dht.Contact, error) {
+	if _, err := dht.ParseID(nodeID); err != nil {
+		return dht.Contact{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+	return appDHT.Lookup(ctx, nodeID)
+}
+
+// resolveName finds the name's record in the DHT and returns the owner's address
+// and node id: the current address from the DHT, or the first address from the record
+func resolveName(name string) (string, string, error) {
+	record, err := lookupName(name)
+	if err != nil {
+		return "", "", err
+	}
+	if contact, err := resolveDHTNode(record.NodeID()); err == nil {
+		return contact.Addr, record.NodeID(), nil
+	}
+	if len(record.Addrs) == 0 {
+		return "", "", fmt.Errorf("no known addresses of %q", name)
+	}
+	return record.Addrs[0], record.NodeID(), nil
+}
+
+func handleDHTCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("dht_cmd_handler")
+
+	switch {
+	case len(params) >= 2 && params[0] == "bootstrap":
+		seeds := params[1:]
+		// Bootstrap dials the seeds, don't block the prompt handler
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+			defer cancel()
+			if err := appDHT.Bootstrap(ctx, seeds); err != nil {
+				logger.Error("DHT bootstrap failed", "error", err)
+			}
+		}()
+	case len(params) == 1 && params[0] == "status":
+		self := appDHT.Self()
+		logger.Log(fmt.Sprintf("Node id: %s, advertised address: %q, known nodes: %d", self.ID, self.Addr, appDHT.Size()))
+	default:
+		logger.Log("usage: dht bootstrap <host:port>... | dht status")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ulshv/nexuslink/pkg/discovery"
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+var (
+	lanDiscovery *discovery.Discovery
+	autoConnect  atomic.Bool
+)
+
+func setupDiscovery(lp *log_prompt.LogPrompt) {
+	logger := lp.NewLogger("discovery")
+	lanDiscovery = discovery.NewDiscovery(logger, appNode.ID, discovery.Options{})
+	lanDiscovery.OnPeer(func(peer discovery.DiscoveredPeer) {
+		if autoConnect.Load() {
+			autoConnectPeer(logger, peer)
+		}
+	})
+}
+
+// autoConnectPeer dials the discovered peer in the background,
+// so a slow peer doesn't stall the discovery
+func autoConnectPeer(logger logs.Logger, peer discovery.DiscoveredPeer) {
+	// if both sides dial, the node keeps one of the connections
+	if _, ok := appNode.PeerByNodeID(peer.NodeID); ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		if _, err := appNode.DialContext(ctx, peer.Addr); err != nil {
+			logger.Warn("Failed to auto-connect to the discovered peer", "addr", peer.Addr, "error", err)
+		}
+	}()
+}
+
+// startDiscovery announces the node in the LAN once it's listening
+func startDiscovery(ctx context.Context, lp *log_prompt.LogPrompt, port int) {
+	if err := lanDiscovery.Start(ctx, port); err != nil {
+		lp.NewLogger("discovery").Warn("LAN discovery is disabled", "error", err)
+	}
+}
+
+// resolveDiscoveredPeer returns the discovered peer by a node id prefix,
+// the prefix matching several peers is an error
+func resolveDiscoveredPeer(nodeIDPrefix string) (discovery.DiscoveredPeer, bool, error) {
+	matches := []discovery.DiscoveredPeer{}
+	for _, peer := range lanDiscovery.Peers() {
+		if strings.HasPrefix(peer.NodeID, nodeIDPrefix) {
+			matches = append(matches, peer)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return discovery.DiscoveredPeer{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	return discovery.DiscoveredPeer{}, false, fmt.Errorf("node id prefix %q matches %d discovered peers", nodeIDPrefix, len(matches))
+}
+
+func handlePeersCommand(lp *log_prompt.LogPrompt) {
+	logger := lp.NewLogger("peers_cmd_handler")
+
+	peers := lanDiscovery.Peers()
+	if len(peers) == 0 {
+		logger.Log("No peers discovered in the local network")
+		return
+	}
+	for _, peer := range peers {
+		status := ""
+		if _, ok := appNode.PeerByNodeID(peer.NodeID); ok {
+			status = " (connected)"
+		}
+		logger.Log(fmt.Sprintf("  %s %s%s", shortNodeID(peer.NodeID), peer.Addr, status))
+	}
+}
+
+func handleAutoConnectCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("autoconnect_cmd_handler")
+
+	if len(params) != 1 || (params[0] != "on" && params[0] != "off") {
+		logger.Log("usage: autoconnect on|off")
+		return
+	}
+	autoConnect.Store(params[0] == "on")
+	logger.Log(fmt.Sprintf("Auto-connect to the discovered peers is %s", params[0]))
+	if params[0] == "on" {
+		// the peers discovered before aren't announced by OnPeer again
+		discoveryLogger := lp.NewLogger("discovery")
+		for _, peer := range lanDiscovery.Peers() {
+			autoConnectPeer(discoveryLogger, peer)
+		}
+	}
+}
+
+func shortNodeID(nodeID string) string {
+	if len(nodeID) > 12 {
+		return nodeID[:12]
+	}
+	return nodeID
+}
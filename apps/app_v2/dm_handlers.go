@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/node"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// msgTypeDirect is the direct message to a connected node, it's shown in the DM chat of the sender
+const msgTypeDirect = "direct_message"
+
+type directMsg struct {
+	Text string `json:"text"`
+}
+
+// setupDirectMessages handles the direct messages of the connected nodes
+func setupDirectMessages(lp *log_prompt.LogPrompt) {
+	chatLogger := lp.NewLogger("chat")
+	appNode.Handle(msgTypeDirect, func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+		msg := directMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			lp.NewLogger("dm").Error("Invalid direct message", "peer", peer.ID, "error", err)
+			return
+		}
+		showChatMessage(chatLogger, dmChat(peer.NodeID()), shortNodeID(peer.NodeID()), msg.Text)
+	})
+}
+
+// dmChat is the name of the chat with the direct messages of the node
+func dmChat(nodeID string) string {
+	return "@" + shortNodeID(nodeID)
+}
+
+// dmPeer finds the connected peer by its peer id or a node id prefix,
+// the prefix matching several peers is an error
+func dmPeer(target string) (*node.Peer, error) {
+	matches := []*node.Peer{}
+	for _, peer := range appNode.Peers() {
+		if peer.ID == target {
+			return peer, nil
+		}
+		if nodeID := peer.NodeID(); nodeID != "" && strings.HasPrefix(nodeID, target) {
+			matches = append(matches, peer)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("peer %q is not connected", target)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("node id prefix %q matches %d connected peers", target, len(matches))
+}
+
+// sendDirectMessage sends the message to the connected peer and shows it in the peer's DM chat
+func sendDirectMessage(chatLogger logs.Logger, target string, text string) error {
+	peer, err := dmPeer(target)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(directMsg{Text: text})
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(&pb.TCPMessagePayload{Type: msgTypeDirect, Data: data}); err != nil {
+		return fmt.Errorf("failed to send the direct message: %w", err)
+	}
+	showChatMessage(chatLogger, dmChat(peer.NodeID()), "me", text)
+	return nil
+}
+
+func handleMsgCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("msg_cmd_handler")
+
+	if len(params) < 2 {
+		logger.Log("msg: wrong number of arguments")
+		logger.Log("usage: msg <peer|node-id> <message>")
+		return
+	}
+	if err := sendDirectMessage(lp.NewLogger("chat"), params[0], strings.Join(params[1:], " ")); err != nil {
+		logger.Error("Failed to send the direct message", "error", err)
+	}
+}
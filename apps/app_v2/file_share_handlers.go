@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ulshv/nexuslink/pkg/file_share"
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+)
+
+const downloadsDir = "downloads"
+
+var fileShare *file_share.Service
+
+func handleSendCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("send_cmd_handler")
+
+	if len(params) != 2 {
+		logger.Log("send: wrong number of arguments")
+		logger.Log("usage: send <peer> <path>")
+		return
+	}
+
+	peerID, path := params[0], params[1]
+	m, err := fileShare.SendFile(peerID, path)
+	if err != nil {
+		logger.Error("Failed to send file", "error", err)
+		return
+	}
+	logger.Log(fmt.Sprintf("Offered %q (%d bytes, %d chunks) to %s, id: %s",
+		m.Name, m.Size, m.NumChunks(), peerID, file_share.ShortID(m.Root)))
+}
+
+func handleAcceptCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("accept_cmd_handler")
+
+	if len(params) > 1 {
+		logger.Log("accept: wrong number of arguments")
+		logger.Log("usage: accept [id]")
+		return
+	}
+
+	id := ""
+	if len(params) == 1 {
+		id = params[0]
+	}
+	info, err := fileShare.Accept(id)
+	if err != nil {
+		logger.Error("Failed to accept file", "error", err)
+		return
+	}
+	logger.Log(fmt.Sprintf("Downloading %q from %s into %s", info.Name, strings.Join(info.Peers, ","), downloadsDir))
+}
+
+func handleShareCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("share_cmd_handler")
+
+	if len(params) != 1 {
+		logger.Log("share: wrong number of arguments")
+		logger.Log("usage: share <path>")
+		return
+	}
+
+	m, err := fileShare.Share(params[0])
+	if err != nil {
+		logger.Error("Failed to share file", "error", err)
+		return
+	}
+	logger.Log(fmt.Sprintf("Sharing %q (%d bytes), peers can download it with `fetch %s`", m.Name, m.Size, m.Root))
+}
+
+func handleFetchCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("fetch_cmd_handler")
+
+	if len(params) != 1 {
+		logger.Log("fetch: wrong number of arguments")
+		logger.Log("usage: fetch <root>")
+		return
+	}
+
+	if err := fileShare.Fetch(params[0]); err != nil {
+		logger.Error("Failed to fetch file", "error", err)
+		return
+	}
+	logger.Log("Looking for the file on the connected peers...")
+}
+
+func handleTransfersCommand(lp *log_prompt.LogPrompt) {
+	logger := lp.NewLogger("transfers_cmd_handler")
+
+	offers := fileShare.Offers()
+	transfers := fileShare.Transfers()
+	if len(offers) == 0 && len(transfers) == 0 {
+		logger.Log("No transfers")
+		return
+	}
+	for _, offer := range offers {
+		logger.Log(fmt.Sprintf("  offer    %s %q %d bytes from %s",
+			file_share.ShortID(offer.Manifest.Root), offer.Manifest.Name, offer.Manifest.Size, offer.PeerID))
+	}
+	for _, t := range transfers {
+		pct := 100
+		if t.Total > 0 {
+			pct = t.Chunks * 100 / t.Total
+		}
+		logger.Log(fmt.Sprintf("  %-8s %s %q %d%% (%d/%d chunks) %s peers=%s",
+			t.Direction, file_share.ShortID(t.Root), t.Name, pct, t.Chunks, t.Total, t.Status, strings.Join(t.Peers, ",")))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+// handleLogCommand changes the verbosity of the services at runtime, i.e.
+// `log level node debug` shows the debug logs of the node only
+func handleLogCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("log_cmd_handler")
+
+	if len(params) == 0 || params[0] != "level" || len(params) > 3 {
+		logger.Log("usage: log level [[<service>] <debug|info|warn|error>]")
+		return
+	}
+	switch len(params) {
+	case 1:
+		level, levels := lp.Levels()
+		logger.Log(fmt.Sprintf("  default: %s", level))
+		services := []string{}
+		for svcName := range levels {
+			services = append(services, svcName)
+		}
+		slices.Sort(services)
+		for _, svcName := range services {
+			logger.Log(fmt.Sprintf("  %s: %s", svcName, levels[svcName]))
+		}
+	case 2:
+		level, err := logs.ParseLevel(params[1])
+		if err != nil {
+			logger.Error("Failed to set the log level", "error", err)
+			return
+		}
+		lp.SetLevel(level)
+		logger.Log(fmt.Sprintf("Log level is %s", level))
+	case 3:
+		level, err := logs.ParseLevel(params[2])
+		if err != nil {
+			logger.Error("Failed to set the log level", "error", err)
+			return
+		}
+		lp.SetServiceLevel(params[1], level)
+		logger.Log(fmt.Sprintf("Log level of %s is %s", params[1], level))
+	}
+}
@@ -2,20 +2,45 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"sync"
 
 	"github.com/ulshv/nexuslink/pkg/log_prompt"
 )
 
+// defaultHistoryPath keeps the entered commands between the runs, see NEXUSLINK_HISTORY
+const defaultHistoryPath = ".nexuslink/history"
+
 func main() {
 	appCtx := context.Background()
 	lp := log_prompt.NewLogPrompt(appCtx, "> ")
+	historyPath := os.Getenv("NEXUSLINK_HISTORY")
+	if historyPath == "" {
+		historyPath = defaultHistoryPath
+	}
+	if err := lp.SetHistoryFile(historyPath, 0); err != nil {
+		fmt.Println("Failed to load the history:", err)
+	}
+	lp.SetCompleter(completePrompt)
+	if err := setupNode(appCtx, lp); err != nil {
+		fmt.Println("Failed to start the node:", err)
+		os.Exit(1)
+	}
+	// NEXUSLINK_UI=screen shows the chats in the full-screen mode
+	if os.Getenv("NEXUSLINK_UI") == "screen" {
+		if err := setupChatScreen(appCtx, lp); err != nil {
+			fmt.Println("Failed to enable the full-screen mode:", err)
+		}
+	}
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		lp.Start()
+		if err := lp.Start(); err != nil {
+			fmt.Println("Failed to read the input:", err)
+		}
 	}()
 
 	wg.Add(1)
@@ -25,8 +50,13 @@ func main() {
 			select {
 			case <-appCtx.Done():
 				return
-			case prompt := <-lp.Prompts():
-				HandlePrompt(lp, prompt)
+			case prompt, ok := <-lp.Prompts():
+				if !ok {
+					return
+				}
+				if !handleChatInput(lp, prompt) {
+					HandlePrompt(lp, prompt)
+				}
 			}
 		}
 	}()
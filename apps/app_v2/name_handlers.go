@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/names"
+)
+
+func lookupName(name string) (*names.Record, error) {
+	if err := names.ValidateName(name); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+	value, err := appDHT.FindValue(ctx, names.Key(name))
+	if err != nil {
+		return nil, err
+	}
+	return names.Unmarshal(value)
+}
+
+func handleNameCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("name_cmd_handler")
+
+	switch {
+	case len(params) >= 2 && params[0] == "register":
+		name, addrs := params[1], params[2:]
+		if err := names.ValidateName(name); err != nil {
+			logger.Error("Failed to create the name record", "error", err)
+			return
+		}
+		go func() {
+			// the current time as the sequence number, so the latest registration wins
+			seq := uint64(time.Now().UnixMilli())
+			record, err := names.NewRecord(appNode.Identity, name, addrs, names.DefaultTTL, seq)
+			// the refresh of our own record keeps its registration time, so the name stays ours
+			if prev, lookupErr := lookupName(name); lookupErr == nil && bytes.Equal(prev.PublicKey, appNode.Identity.PublicKey) {
+				record, err = names.RenewRecord(appNode.Identity, prev, addrs, names.DefaultTTL, seq)
+			}
+			if err != nil {
+				logger.Error("Failed to create the name record", "error", err)
+				return
+			}
+			value, err := record.Marshal()
+			if err != nil {
+				logger.Error("Failed to encode the name record", "error", err)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+			defer cancel()
+			stored, err := appDHT.Store(ctx, names.Key(name), value)
+			if err != nil {
+				logger.Error("Failed to register the name", "name", name, "error", err)
+				return
+			}
+			logger.Log(fmt.Sprintf("Name %q registered, the record is stored on %d nodes, expires at %s",
+				name, stored, record.ExpiresAt().Format(time.DateTime)))
+		}()
+	case len(params) == 2 && params[0] == "resolve":
+		name := params[1]
+		go func() {
+			record, err := lookupName(name)
+			if err != nil {
+				logger.Error("Failed to resolve the name", "name", name, "error", err)
+				return
+			}
+			logger.Log(fmt.Sprintf("%s -> node id: %s, addresses: [%s], expires at %s",
+				record.Name, record.NodeID(), strings.Join(record.Addrs, ", "), record.ExpiresAt().Format(time.DateTime)))
+		}()
+	default:
+		logger.Log("usage: name register <name> [host:port]... | name resolve <name>")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/ulshv/nexuslink/pkg/file_share"
+	"github.com/ulshv/nexuslink/pkg/gossip"
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/node"
+	"github.com/ulshv/nexuslink/pkg/rooms"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+const defaultIdentityPath = ".nexuslink/identity"
+
+var appNode *node.Node
+
+// setupNode creates the node and plugs the app services into it.
+// Node's identity is kept in the file from the NEXUSLINK_IDENTITY env var
+// (or defaultIdentityPath), so the node id stays the same between the runs.
+func setupNode(ctx context.Context, lp *log_prompt.LogPrompt) error {
+	identityPath := os.Getenv("NEXUSLINK_IDENTITY")
+	if identityPath == "" {
+		identityPath = defaultIdentityPath
+	}
+	ident, err := identity.LoadOrGenerate(identityPath)
+	if err != nil {
+		return err
+	}
+	appNode = node.NewNode(ctx, lp.NewLogger("node"), ident)
+	if err := setupDHT(lp); err != nil {
+		return err
+	}
+	fileShare = file_share.NewService(lp.NewLogger("file_share"), downloadsDir)
+	chatLogger := lp.NewLogger("chat")
+	chatRooms = rooms.NewService(lp.NewLogger("rooms"), func(msg rooms.Message) {
+		showChatMessage(chatLogger, msg.Room, msg.From, msg.Text)
+	})
+
+	fileShareHandler := func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+		if err := fileShare.HandleMessage(peer.ID, payload); err != nil {
+			lp.NewLogger("file_share").Error("Failed to handle file sharing message", "peer", peer.ID, "type", payload.Type, "error", err)
+		}
+	}
+	for _, msgType := range file_share.MessageTypes {
+		appNode.Handle(msgType, fileShareHandler)
+	}
+	// file chunks must not delay the pings and the chat messages on the same connection
+	appNode.SetPriority(file_share.MsgTypeChunk, tcp_conn.PriorityBulk)
+
+	roomsHandler := func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+		if err := chatRooms.HandleMessage(peer.ID, payload); err != nil {
+			lp.NewLogger("rooms").Error("Failed to handle room message", "peer", peer.ID, "type", payload.Type, "error", err)
+		}
+	}
+	for _, msgType := range rooms.MessageTypes {
+		appNode.Handle(msgType, roomsHandler)
+	}
+
+	chatTopics = gossip.NewService(lp.NewLogger("gossip"), appNode.Identity, gossip.Options{})
+	chatTopics.Start(ctx)
+	gossipHandler := func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+		if err := chatTopics.HandleMessage(peer.ID, payload); err != nil {
+			lp.NewLogger("gossip").Error("Failed to handle gossip message", "peer", peer.ID, "type", payload.Type, "error", err)
+		}
+	}
+	for _, msgType := range gossip.MessageTypes {
+		appNode.Handle(msgType, gossipHandler)
+	}
+
+	setupDirectMessages(lp)
+	setupDiscovery(lp)
+	setupYggdrasil(lp)
+
+	appNode.OnPeer(
+		func(peer *node.Peer) {
+			fileShare.AddPeer(peer.ID, peer)
+			chatRooms.AddPeer(peer.ID, peer)
+			chatTopics.AddPeer(peer.ID, peer)
+		},
+		func(peer *node.Peer) {
+			fileShare.RemovePeer(peer.ID)
+			chatRooms.RemovePeer(peer.ID)
+			chatTopics.RemovePeer(peer.ID)
+		},
+	)
+	return nil
+}
@@ -4,13 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ulshv/nexuslink/pkg/log_prompt"
-	"github.com/ulshv/nexuslink/pkg/tcp_message"
-	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"github.com/ulshv/nexuslink/pkg/logs"
 )
 
 // `prompt` usually have the following look:
@@ -23,125 +22,161 @@ func HandlePrompt(lp *log_prompt.LogPrompt, prompt string) {
 	params := parts[1:]
 
 	switch command {
-	case "server":
-		handleServerCommand(lp, params)
+	case "listen", "server":
+		handleListenCommand(lp, params)
 	case "connect":
 		handleConnectCommand(lp, params)
+	case "peers":
+		handlePeersCommand(lp)
+	case "conns":
+		handleConnsCommand(lp, params)
+	case "disconnect":
+		handleDisconnectCommand(lp, params)
+	case "autoconnect":
+		handleAutoConnectCommand(lp, params)
+	case "dht":
+		handleDHTCommand(lp, params)
+	case "ygg":
+		handleYggCommand(lp, params)
+	case "name":
+		handleNameCommand(lp, params)
+	case "room":
+		handleRoomCommand(lp, params)
+	case "topic":
+		handleTopicCommand(lp, params)
+	case "say":
+		handleSayCommand(lp, params)
+	case "msg":
+		handleMsgCommand(lp, params)
+	case "send":
+		handleSendCommand(lp, params)
+	case "accept":
+		handleAcceptCommand(lp, params)
+	case "share":
+		handleShareCommand(lp, params)
+	case "fetch":
+		handleFetchCommand(lp, params)
+	case "transfers":
+		handleTransfersCommand(lp)
+	case "log":
+		handleLogCommand(lp, params)
 	case "help":
 		logger.Log("Welcome to the NexusLink. Available commands:")
-		logger.Log("	server <port> - start the server")
-		logger.Log("  connect <host:port> - connect to the server")
+		logger.Log("	listen <port|host:port|unix:path|ws:host:port|udp:host:port> - accept connections from other nodes (alias: server)")
+		logger.Log("	connect <host:port|node-id|name> - connect to another node")
+		logger.Log("	peers - list the nodes discovered in the local network")
+		logger.Log("	conns [queue <size> <policy>] - list the connections with their state, RTT and send queue, or set the queue")
+		logger.Log("	disconnect <peer|node-id> - close the connection to the peer")
+		logger.Log("	autoconnect on|off - connect to the discovered nodes automatically")
+		logger.Log("	dht bootstrap <host:port>... | dht status - join the DHT to find nodes by their ids")
+		logger.Log("	ygg connect [admin-endpoint] | ygg status - use the Yggdrasil overlay network")
+		logger.Log("	name register <name> [host:port]... | name resolve <name> - publish or find a signed name record")
+		logger.Log("	room create|join|leave|list - host a room or join a room of another node")
+		logger.Log("	say <room> <message> - send a message to the room")
+		logger.Log("	topic join|leave|say|list - hostless rooms gossiped among the connected peers")
+		logger.Log("	msg <peer|node-id> <message> - send a direct message to the connected node")
+		logger.Log("	send <peer> <path> - offer a file to the connected peer")
+		logger.Log("	accept [id] - download the offered file")
+		logger.Log("	share <path> - share a file with the swarm")
+		logger.Log("	fetch <root> - download a shared file from all the connected peers")
+		logger.Log("	transfers - list file offers and transfers")
+		logger.Log("	log level [[<service>] <level>] - show or change the log level of all the services or of one")
 		logger.Log("	help - show this message")
 		logger.Log("	exit - exit the program")
 	case "exit":
 		logger.Log("Exiting...")
-		os.Exit(0)
+		lp.Stop()
 	default:
 		logger.Log(fmt.Sprintf("Unknown command: %s", command))
 	}
 }
 
-func handleServerCommand(lp *log_prompt.LogPrompt, params []string) {
-	logger := lp.NewLogger("server_cmd_handler")
+func handleListenCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("listen_cmd_handler")
 
 	if len(params) != 1 {
-		logger.Log("server: wrong number of arguments")
-		logger.Log("usage: server <port>")
+		logger.Log("listen: wrong number of arguments")
+		logger.Log("usage: listen <port|host:port|unix:path|ws:host:port|udp:host:port>")
 		return
 	}
 
-	port := params[0]
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
-
+	listenAddr := params[0]
+	if _, err := strconv.Atoi(listenAddr); err == nil {
+		listenAddr = ":" + listenAddr
+	}
+	addr, err := appNode.Listen(listenAddr)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to start server on port %s: %s", port, err))
+		logger.Error(fmt.Sprintf("Failed to listen on %s: %s", listenAddr, err))
 		return
 	}
 
-	logger.Log(fmt.Sprintf("Server started on port %s", port))
-
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				logger.Error("Failed to accept connection", "error", err)
-				continue
-			}
-			logger.Info("Accepted connection", "remote_addr", conn.RemoteAddr())
-			handleConnection(lp, conn)
-		}
-	}()
+	logger.Log(fmt.Sprintf("Listening on %s, node id: %s", addr, appNode.ID))
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		appDHT.SetAddr(advertisedAddr(tcpAddr.Port))
+		startDiscovery(context.Background(), lp, tcpAddr.Port)
+	}
 }
 
-func handleConnection(lp *log_prompt.LogPrompt, conn net.Conn) {
-	ctx := context.Background()
-	logger := lp.NewLogger("server_conn_handler")
-	msgCh := make(chan *pb.TCPMessagePayload)
-
-	go func() {
-		// defer conn.Close()
-		go tcp_message.ReadTCPMessagesLoop(ctx, logger, msgCh, conn)
-	}()
-
-	go func() {
-		for {
-			select {
-			case msg := <-msgCh:
-				logger.Info("Received message", "type", msg.Type, "data", string(msg.Data))
-			case <-time.After(1 * time.Second):
-				payload := &pb.TCPMessagePayload{
-					Type: "ping",
-					Data: []byte("ping from the server"),
-				}
-				msg, _ := tcp_message.NewTCPMessage(lp.NewLogger("client"), payload)
-				conn.Write(msg)
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-}
+// dialTimeout limits the connect command's dial, including the handshake
+const dialTimeout = 30 * time.Second
 
 func handleConnectCommand(lp *log_prompt.LogPrompt, params []string) {
 	logger := lp.NewLogger("connect_cmd_handler")
 
 	if len(params) != 1 {
 		logger.Log("connect: wrong number of arguments")
-		logger.Log("usage: connect <host:port>")
+		logger.Log("usage: connect <host:port|port|unix:path|node-id|name>")
 		return
 	}
 
-	port := params[0]
-	conn, err := net.Dial("tcp", fmt.Sprintf(":%s", port))
+	// the dial and the DHT lookups take time, don't block the prompt handler
+	go connectNode(logger, params[0])
+}
+
+// connectNode resolves the target and dials it, explicit addresses go first,
+// so a port is never taken for a node id prefix
+func connectNode(logger logs.Logger, addr string) {
+	if _, err := strconv.Atoi(addr); err == nil {
+		dialNode(logger, ":"+addr, "")
+		return
+	}
+	if strings.Contains(addr, ":") {
+		dialNode(logger, addr, "")
+		return
+	}
+	discovered, ok, err := resolveDiscoveredPeer(addr)
 	if err != nil {
-		logger.Error("Failed to connect to server", "error", err)
+		logger.Error("Failed to resolve the node id", "node_id", addr, "error", err)
 		return
 	}
-
-	payload := &pb.TCPMessagePayload{
-		Type: "hello",
-		Data: []byte("hello, world! what's up?"),
+	if ok {
+		dialNode(logger, discovered.Addr, discovered.NodeID)
+		return
 	}
-	msg, _ := tcp_message.NewTCPMessage(lp.NewLogger("client"), payload)
-	conn.Write(msg)
-
-	ctx := context.Background()
-	msgCh := make(chan *pb.TCPMessagePayload)
-
-	go func() {
-		// defer conn.Close()
-		go tcp_message.ReadTCPMessagesLoop(ctx, logger, msgCh, conn)
-	}()
+	if contact, err := resolveDHTNode(addr); err == nil {
+		dialNode(logger, contact.Addr, contact.ID)
+		return
+	}
+	nameAddr, nodeID, err := resolveName(addr)
+	if err != nil {
+		logger.Error("Failed to resolve the name", "name", addr, "error", err)
+		return
+	}
+	dialNode(logger, nameAddr, nodeID)
+}
 
-	go func() {
-		for msg := range msgCh {
-			logger.Info("Received on the client", "type", msg.Type, "data", string(msg.Data))
-			payload := &pb.TCPMessagePayload{
-				Type: "pong",
-				Data: []byte("pong from the client"),
-			}
-			msg, _ := tcp_message.NewTCPMessage(lp.NewLogger("client"), payload)
-			conn.Write(msg)
-		}
-	}()
+// dialNode connects to the address, the node must have the expected node id, if it's not empty:
+// the address resolved by the node id or the name may be of another node
+func dialNode(logger logs.Logger, addr string, nodeID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	peer, err := appNode.DialContext(ctx, addr)
+	if err != nil {
+		logger.Error("Failed to connect to the node", "error", err)
+		return
+	}
+	if nodeID != "" && peer.NodeID() != nodeID {
+		appNode.Disconnect(peer.ID)
+		logger.Error("Connected to another node, disconnected", "addr", addr, "expected", nodeID, "node_id", peer.NodeID())
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/rooms"
+)
+
+var chatRooms *rooms.Service
+
+func handleRoomCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("room_cmd_handler")
+
+	usage := func() {
+		logger.Log("usage: room create <name> | room join <peer> <name> | room leave <name> | room list")
+	}
+	if len(params) == 0 {
+		logger.Log("room: wrong number of arguments")
+		usage()
+		return
+	}
+
+	var err error
+	switch {
+	case params[0] == "create" && len(params) == 2:
+		if err = chatRooms.Create(params[1]); err == nil {
+			logger.Log(fmt.Sprintf("Room %q created, other peers can join it with `room join <your address> %s`", params[1], params[1]))
+		}
+	case params[0] == "join" && len(params) == 3:
+		err = chatRooms.Join(params[1], params[2])
+	case params[0] == "leave" && len(params) == 2:
+		if err = chatRooms.Leave(params[1]); err == nil {
+			logger.Log(fmt.Sprintf("Left room %q", params[1]))
+		}
+	case params[0] == "list" && len(params) == 1:
+		list := chatRooms.Rooms()
+		if len(list) == 0 {
+			logger.Log("No rooms")
+		}
+		for _, room := range list {
+			if room.Host == "" {
+				logger.Log(fmt.Sprintf("  %s (hosted here) members: %s", room.Name, strings.Join(room.Members, ", ")))
+			} else {
+				logger.Log(fmt.Sprintf("  %s host: %s", room.Name, room.Host))
+			}
+		}
+	default:
+		logger.Log("room: wrong arguments")
+		usage()
+		return
+	}
+	if err != nil {
+		logger.Error("Room command failed", "error", err)
+	}
+}
+
+func handleSayCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("say_cmd_handler")
+
+	if len(params) < 2 {
+		logger.Log("say: wrong number of arguments")
+		logger.Log("usage: say <room> <message>")
+		return
+	}
+
+	if err := chatRooms.Say(params[0], strings.Join(params[1:], " ")); err != nil {
+		logger.Error("Failed to send message", "error", err)
+	}
+}
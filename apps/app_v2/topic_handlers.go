@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ulshv/nexuslink/pkg/gossip"
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+)
+
+var chatTopics *gossip.Service
+
+// sayToTopic publishes the message to the topic, it's shown in the topic's chat
+// by the subscription handler only if it's sent, so an error means nobody got it
+func sayToTopic(topic string, text string) error {
+	if _, err := chatTopics.Publish(topic, []byte(text)); err != nil {
+		return fmt.Errorf("message to #%s is not sent: %w", topic, err)
+	}
+	return nil
+}
+
+// handleTopicCommand manages the hostless rooms, their messages are gossiped
+// among all the connected peers subscribed to the topic
+func handleTopicCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("topic_cmd_handler")
+	chatLogger := lp.NewLogger("chat")
+
+	var err error
+	switch {
+	case len(params) == 2 && params[0] == "join":
+		topic := params[1]
+		err = chatTopics.Subscribe(topic, func(msg gossip.Message) {
+			showChatMessage(chatLogger, "#"+msg.Topic, shortNodeID(msg.From), string(msg.Data))
+		})
+		if err == nil {
+			logger.Log(fmt.Sprintf("Joined topic %q, %d connected peers are subscribed to it", topic, len(chatTopics.TopicPeers(topic))))
+		}
+	case len(params) == 2 && params[0] == "leave":
+		err = chatTopics.Unsubscribe(params[1])
+	case len(params) >= 3 && params[0] == "say":
+		err = sayToTopic(params[1], strings.Join(params[2:], " "))
+	case len(params) == 1 && params[0] == "list":
+		topics := chatTopics.Topics()
+		if len(topics) == 0 {
+			logger.Log("No topics")
+		}
+		for _, topic := range topics {
+			logger.Log(fmt.Sprintf("  #%s peers: %d", topic, len(chatTopics.TopicPeers(topic))))
+		}
+	default:
+		logger.Log("usage: topic join <name> | topic leave <name> | topic say <name> <message> | topic list")
+		return
+	}
+	if err != nil {
+		logger.Error("Topic command failed", "error", err)
+	}
+}
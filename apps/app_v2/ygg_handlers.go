@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/log_prompt"
+	"github.com/ulshv/nexuslink/pkg/yggdrasil"
+)
+
+var (
+	yggMu   sync.Mutex
+	yggSelf *yggdrasil.Self
+)
+
+// setupYggdrasil connects to the admin socket from the NEXUSLINK_YGGDRASIL_ADMIN env var, if it's set
+func setupYggdrasil(lp *log_prompt.LogPrompt) {
+	if endpoint := os.Getenv("NEXUSLINK_YGGDRASIL_ADMIN"); endpoint != "" {
+		if _, err := connectYggdrasil(lp, endpoint); err != nil {
+			lp.NewLogger("yggdrasil").Warn("Yggdrasil is not available", "error", err)
+		}
+	}
+}
+
+// connectYggdrasil learns the node's overlay address, enables the `ygg:` transport
+// and advertises the overlay address in the DHT
+func connectYggdrasil(lp *log_prompt.LogPrompt, endpoint string) (yggdrasil.Self, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	self, err := yggdrasil.NewAdmin(endpoint).GetSelf(ctx)
+	if err != nil {
+		return self, err
+	}
+	yggMu.Lock()
+	yggSelf = &self
+	yggMu.Unlock()
+	appNode.AddTransport(yggdrasil.Scheme, yggdrasil.NewTransport(lp.NewLogger("yggdrasil"), self.Address))
+	for _, addr := range appNode.ListenAddrs() {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+			appDHT.SetAddr(advertisedAddr(tcpAddr.Port))
+			break
+		}
+	}
+	return self, nil
+}
+
+// advertisedAddr is the address the other nodes can reach the listening port at:
+// the overlay address if Yggdrasil is connected, otherwise the receiving side
+// fills the host with the IP the request came from
+func advertisedAddr(port int) string {
+	yggMu.Lock()
+	defer yggMu.Unlock()
+	if yggSelf != nil {
+		return net.JoinHostPort(yggSelf.Address.String(), fmt.Sprint(port))
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+func handleYggCommand(lp *log_prompt.LogPrompt, params []string) {
+	logger := lp.NewLogger("ygg_cmd_handler")
+
+	switch {
+	case len(params) >= 1 && len(params) <= 2 && params[0] == "connect":
+		endpoint := yggdrasil.DefaultAdminEndpoint
+		if len(params) == 2 {
+			endpoint = params[1]
+		}
+		self, err := connectYggdrasil(lp, endpoint)
+		if err != nil {
+			logger.Error("Failed to connect to Yggdrasil", "endpoint", endpoint, "error", err)
+			return
+		}
+		logger.Log(fmt.Sprintf("Yggdrasil address: %s, peers can connect with `connect ygg:[%s]:<port>`",
+			self.Address, self.Address))
+	case len(params) == 1 && params[0] == "status":
+		yggMu.Lock()
+		self := yggSelf
+		yggMu.Unlock()
+		if self == nil {
+			logger.Log("Yggdrasil is not connected, use `ygg connect [unix:///path/to/admin.sock|tcp://host:port]`")
+			return
+		}
+		logger.Log(fmt.Sprintf("Yggdrasil address: %s, subnet: %s, build: %s", self.Address, self.Subnet, self.Build))
+	default:
+		logger.Log("usage: ygg connect [unix:///path/to/admin.sock|tcp://host:port] | ygg status")
+	}
+}
@@ -0,0 +1,389 @@
+// dht is a Kademlia-style distributed hash table, it's used to find nodes
+// by their ids (sha256 of the public keys) without a central server,
+// and to store small values (i.e. name records) on the nodes closest to the value's key.
+//
+// The RPCs (PING, FIND_NODE, STORE, FIND_VALUE) are JSON-encoded Message's,
+// carried by a Transport: NodeTransport sends them as TCPMessages over the node's connections,
+// tests use an in-memory transport to run dozens of nodes in a single process.
+//
+// Simplifications (KISS): stored values are not republished and don't expire
+// in the DHT itself, the validator of the values is responsible for the expiry.
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+const (
+	K              = 20 // bucket size and the number of the closest nodes to store values on
+	Alpha          = 3  // parallel requests during the lookups
+	requestTimeout = 5 * time.Second
+)
+
+const (
+	MethodPing      = "PING"
+	MethodFindNode  = "FIND_NODE"
+	MethodStore     = "STORE"
+	MethodFindValue = "FIND_VALUE"
+)
+
+// Message is both the request and the response of the RPCs,
+// the response has the same RPCID and Method as the request
+type Message struct {
+	RPCID    string    `json:"rpc_id"`
+	Method   string    `json:"method"`
+	Sender   Contact   `json:"sender"`
+	Target   string    `json:"target,omitempty"` // node id or value's key
+	Value    []byte    `json:"value,omitempty"`
+	Contacts []Contact `json:"contacts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type Transport interface {
+	// Call sends the request to the node and waits for the response.
+	// to.ID can be empty when only the address is known (i.e. bootstrap seeds).
+	Call(ctx context.Context, to Contact, req Message) (Message, error)
+}
+
+// Validator checks the values before they are stored or returned by FindValue
+type Validator interface {
+	Validate(key ID, value []byte) error
+	// Select returns the index of the best value, i.e. the latest version of a record.
+	// The value this node has stored, if any, comes first.
+	Select(key ID, values [][]byte) int
+}
+
+// acceptAllValidator accepts any value, the latest stored value wins
+type acceptAllValidator struct{}
+
+func (acceptAllValidator) Validate(key ID, value []byte) error { return nil }
+
+func (acceptAllValidator) Select(key ID, values [][]byte) int { return len(values) - 1 }
+
+type DHT struct {
+	logger    logs.Logger
+	selfID    ID
+	transport Transport
+	table     *routingTable
+	validator Validator
+	mu        sync.Mutex
+	selfAddr  string
+	values    map[ID][]byte
+}
+
+// New creates the DHT node, selfID is the node's id (hex-encoded).
+// A nil validator accepts any value.
+func New(logger logs.Logger, selfID string, transport Transport, validator Validator) (*DHT, error) {
+	id, err := ParseID(selfID)
+	if err != nil {
+		return nil, err
+	}
+	if validator == nil {
+		validator = acceptAllValidator{}
+	}
+	return &DHT{
+		logger:    logger,
+		selfID:    id,
+		transport: transport,
+		table:     newRoutingTable(id, K),
+		validator: validator,
+		values:    map[ID][]byte{},
+	}, nil
+}
+
+// SetAddr sets the address advertised to the other nodes. Host can be empty (i.e. ":5000"),
+// the receiving side fills it with the IP the request came from.
+// Nodes without an address aren't added to the routing tables of the other nodes.
+func (d *DHT) SetAddr(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.selfAddr = addr
+}
+
+func (d *DHT) Self() Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Contact{ID: d.selfID.String(), Addr: d.selfAddr}
+}
+
+// Size returns the number of contacts in the routing table
+func (d *DHT) Size() int {
+	return d.table.size()
+}
+
+// HandleRequest processes the RPC from another node and returns the response
+func (d *DHT) HandleRequest(req Message) Message {
+	d.seen(req.Sender)
+	resp := Message{RPCID: req.RPCID, Method: req.Method, Sender: d.Self()}
+	switch req.Method {
+	case MethodPing:
+	case MethodFindNode:
+		target, err := ParseID(req.Target)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Contacts = d.table.closest(target, K)
+	case MethodStore:
+		key, err := ParseID(req.Target)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		if err := d.storeLocal(key, req.Value); err != nil {
+			resp.Error = err.Error()
+		}
+	case MethodFindValue:
+		key, err := ParseID(req.Target)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		d.mu.Lock()
+		value, ok := d.values[key]
+		d.mu.Unlock()
+		if ok {
+			resp.Value = value
+		} else {
+			resp.Contacts = d.table.closest(key, K)
+		}
+	default:
+		resp.Error = fmt.Sprintf("unknown method %q", req.Method)
+	}
+	return resp
+}
+
+// Bootstrap joins the network through the seed nodes (host:port)
+// and fills the routing table by looking up the own id
+func (d *DHT) Bootstrap(ctx context.Context, seeds []string) error {
+	ok := 0
+	for _, seed := range seeds {
+		if _, err := d.call(ctx, Contact{Addr: seed}, Message{Method: MethodPing}); err != nil {
+			d.logger.Warn("Bootstrap seed is not available", "seed", seed, "error", err)
+			continue
+		}
+		ok++
+	}
+	if ok == 0 {
+		return fmt.Errorf("none of the %d seeds responded", len(seeds))
+	}
+	d.FindNode(ctx, d.selfID)
+	d.logger.Info("DHT bootstrapped", "contacts", d.Size())
+	return nil
+}
+
+// FindNode returns up to K nodes closest to the target which responded during the lookup
+func (d *DHT) FindNode(ctx context.Context, target ID) []Contact {
+	contacts, _ := d.lookup(ctx, target, MethodFindNode)
+	return contacts
+}
+
+// Lookup resolves the node id to the node's current address
+func (d *DHT) Lookup(ctx context.Context, nodeID string) (Contact, error) {
+	id, err := ParseID(nodeID)
+	if err != nil {
+		return Contact{}, err
+	}
+	for _, contact := range d.FindNode(ctx, id) {
+		if contact.ID == id.String() {
+			return contact, nil
+		}
+	}
+	return Contact{}, fmt.Errorf("node %s not found", nodeID)
+}
+
+// Store saves the value on the K nodes closest to the key (and locally)
+// and returns the number of the remote nodes which accepted it
+func (d *DHT) Store(ctx context.Context, key ID, value []byte) (int, error) {
+	if err := d.storeLocal(key, value); err != nil {
+		return 0, err
+	}
+	contacts := d.FindNode(ctx, key)
+	stored := 0
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, contact := range contacts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := d.call(ctx, contact, Message{Method: MethodStore, Target: key.String(), Value: value})
+			if err != nil || resp.Error != "" {
+				d.logger.Debug("STORE failed", "node", contact.ID, "error", err, "resp_error", resp.Error)
+				return
+			}
+			mu.Lock()
+			stored++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return stored, nil
+}
+
+// FindValue looks up the value by the key. Values returned by the nodes
+// are validated and the best one is selected by the Validator.
+func (d *DHT) FindValue(ctx context.Context, key ID) ([]byte, error) {
+	_, found := d.lookup(ctx, key, MethodFindValue)
+	values := [][]byte{}
+	d.mu.Lock()
+	if local, ok := d.values[key]; ok {
+		values = append(values, local)
+	}
+	d.mu.Unlock()
+	valid := [][]byte{}
+	for _, value := range append(values, found...) {
+		if d.validator.Validate(key, value) == nil {
+			valid = append(valid, value)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("value %s not found", key)
+	}
+	return valid[d.validator.Select(key, valid)], nil
+}
+
+func (d *DHT) storeLocal(key ID, value []byte) error {
+	if err := d.validator.Validate(key, value); err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if existing, ok := d.values[key]; ok && d.validator.Select(key, [][]byte{existing, value}) == 0 {
+		return fmt.Errorf("newer value is already stored")
+	}
+	d.values[key] = value
+	return nil
+}
+
+type lookupResult struct {
+	contact Contact
+	resp    Message
+	err     error
+}
+
+// lookup is the iterative Kademlia lookup: Alpha closest not yet queried contacts
+// are queried in parallel, the contacts they return are added to the shortlist,
+// until all the K closest contacts have been queried. For FIND_VALUE the lookup
+// stops after the round in which any values were found.
+func (d *DHT) lookup(ctx context.Context, target ID, method string) ([]Contact, [][]byte) {
+	type candidate struct {
+		contact Contact
+		dist    ID
+	}
+	shortlist := []candidate{}
+	known := map[string]bool{d.selfID.String(): true}
+	addCandidates := func(contacts []Contact) {
+		for _, contact := range contacts {
+			id, err := ParseID(contact.ID)
+			if err != nil || known[contact.ID] || contact.Addr == "" {
+				continue
+			}
+			known[contact.ID] = true
+			shortlist = append(shortlist, candidate{contact: contact, dist: id.Distance(target)})
+		}
+		sort.Slice(shortlist, func(i, j int) bool {
+			return shortlist[i].dist.Less(shortlist[j].dist)
+		})
+	}
+	addCandidates(d.table.closest(target, K))
+
+	queried := map[string]bool{}
+	responded := map[string]bool{}
+	values := [][]byte{}
+	for {
+		batch := []Contact{}
+		for i := 0; i < len(shortlist) && i < K && len(batch) < Alpha; i++ {
+			if !queried[shortlist[i].contact.ID] {
+				batch = append(batch, shortlist[i].contact)
+				queried[shortlist[i].contact.ID] = true
+			}
+		}
+		if len(batch) == 0 || ctx.Err() != nil {
+			break
+		}
+		results := make(chan lookupResult, len(batch))
+		for _, contact := range batch {
+			go func() {
+				resp, err := d.call(ctx, contact, Message{Method: method, Target: target.String()})
+				results <- lookupResult{contact: contact, resp: resp, err: err}
+			}()
+		}
+		for range batch {
+			result := <-results
+			if result.err != nil || result.resp.Error != "" {
+				continue
+			}
+			responded[result.contact.ID] = true
+			if result.resp.Value != nil {
+				values = append(values, result.resp.Value)
+			}
+			addCandidates(result.resp.Contacts)
+		}
+		if len(values) > 0 {
+			break
+		}
+	}
+
+	closest := []Contact{}
+	for _, c := range shortlist {
+		if responded[c.contact.ID] && len(closest) < K {
+			closest = append(closest, c.contact)
+		}
+	}
+	return closest, values
+}
+
+// call fills the request's RPCID and Sender, and updates the routing table
+// with the result: responding nodes are (re)added, silent ones are removed
+func (d *DHT) call(ctx context.Context, to Contact, req Message) (Message, error) {
+	rpcID := make([]byte, 8)
+	rand.Read(rpcID)
+	req.RPCID = hex.EncodeToString(rpcID)
+	req.Sender = d.Self()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := d.transport.Call(ctx, to, req)
+	if err != nil {
+		if to.ID != "" {
+			d.table.remove(to.ID)
+		}
+		return resp, err
+	}
+	if resp.RPCID != req.RPCID {
+		return resp, fmt.Errorf("unexpected rpc id in the response")
+	}
+	if to.ID != "" && resp.Sender.ID != to.ID {
+		d.table.remove(to.ID)
+		return resp, fmt.Errorf("node %s responded instead of %s", resp.Sender.ID, to.ID)
+	}
+	// the node is reachable at the address we've just used
+	resp.Sender.Addr = to.Addr
+	d.seen(resp.Sender)
+	return resp, nil
+}
+
+// seen adds the contact to the routing table. If its bucket is full,
+// the least recently seen contact is pinged and replaced if it doesn't respond.
+func (d *DHT) seen(contact Contact) {
+	id, err := ParseID(contact.ID)
+	if err != nil {
+		return
+	}
+	stale, isFull := d.table.update(contact, id)
+	if !isFull {
+		return
+	}
+	go func() {
+		if _, err := d.call(context.Background(), stale, Message{Method: MethodPing}); err != nil {
+			d.table.replace(stale, contact, id)
+		}
+	}()
+}
@@ -0,0 +1,147 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+// memNetwork delivers the RPCs to the in-process DHT nodes by their addresses
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*DHT
+	down  map[string]bool
+}
+
+type memTransport struct {
+	network *memNetwork
+}
+
+func (t memTransport) Call(ctx context.Context, to Contact, req Message) (Message, error) {
+	t.network.mu.Lock()
+	d, ok := t.network.nodes[to.Addr]
+	isDown := t.network.down[to.Addr]
+	t.network.mu.Unlock()
+	if !ok || isDown {
+		return Message{}, fmt.Errorf("node %s is not reachable", to.Addr)
+	}
+	return d.HandleRequest(req), nil
+}
+
+func randomID() string {
+	id := make([]byte, IDLength)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newMemNetwork(t *testing.T, size int) (*memNetwork, []*DHT) {
+	logger := logs.NewSlogLogger("dht_test")
+	network := &memNetwork{nodes: map[string]*DHT{}, down: map[string]bool{}}
+	nodes := []*DHT{}
+	for i := 0; i < size; i++ {
+		d, err := New(logger, randomID(), memTransport{network}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := fmt.Sprintf("node-%d:5000", i)
+		d.SetAddr(addr)
+		network.nodes[addr] = d
+		nodes = append(nodes, d)
+	}
+	// every node bootstraps from the first one
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap(context.Background(), []string{"node-0:5000"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return network, nodes
+}
+
+func TestID(t *testing.T) {
+	t.Run("xor distance and bucket index", func(t *testing.T) {
+		a := ID{}
+		b := ID{}
+		b[0] = 0x10 // 4 leading bits are shared
+		if a.commonPrefixLen(b) != 3 {
+			t.Errorf("Expected common prefix of 3 bits, got %d", a.commonPrefixLen(b))
+		}
+		c := ID{}
+		c[31] = 1
+		if !a.Distance(c).Less(a.Distance(b)) {
+			t.Error("Expected c to be closer to a than b")
+		}
+		if _, err := ParseID("abc"); err == nil {
+			t.Error("Expected the invalid id error")
+		}
+	})
+}
+
+func TestDHT(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("every node is found by its id", func(t *testing.T) {
+		_, nodes := newMemNetwork(t, 50)
+		for i, d := range nodes {
+			target := nodes[(i*7+3)%len(nodes)]
+			if target == d {
+				continue
+			}
+			contact, err := d.Lookup(ctx, target.Self().ID)
+			if err != nil {
+				t.Fatalf("node %d: %s", i, err)
+			}
+			if contact.Addr != target.Self().Addr {
+				t.Errorf("Expected %s but got %s", target.Self().Addr, contact.Addr)
+			}
+		}
+	})
+
+	t.Run("values are stored on the closest nodes and found by any node", func(t *testing.T) {
+		network, nodes := newMemNetwork(t, 40)
+		key := KeyFor([]byte("name:alice"))
+		stored, err := nodes[5].Store(ctx, key, []byte("alice's record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored < K/2 {
+			t.Errorf("Expected the value to be stored on at least %d nodes, got %d", K/2, stored)
+		}
+		// the storing node goes offline, the value must still be available
+		network.mu.Lock()
+		network.down[nodes[5].Self().Addr] = true
+		network.mu.Unlock()
+		for _, d := range []*DHT{nodes[0], nodes[17], nodes[39]} {
+			value, err := d.FindValue(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != "alice's record" {
+				t.Errorf("Unexpected value %q", value)
+			}
+		}
+		if _, err := nodes[1].FindValue(ctx, KeyFor([]byte("name:nobody"))); err == nil {
+			t.Error("Expected the not found error")
+		}
+	})
+
+	t.Run("unreachable nodes are removed from the routing tables", func(t *testing.T) {
+		network, nodes := newMemNetwork(t, 20)
+		gone := nodes[10]
+		network.mu.Lock()
+		network.down[gone.Self().Addr] = true
+		network.mu.Unlock()
+		if _, err := nodes[3].Lookup(ctx, gone.Self().ID); err == nil {
+			t.Error("Expected the offline node not to be found")
+		}
+		for _, contact := range nodes[3].table.closest(KeyFor(nil), len(nodes)) {
+			if contact.ID == gone.Self().ID {
+				t.Error("Expected the offline node to be removed from the routing table")
+			}
+		}
+	})
+}
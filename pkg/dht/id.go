@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+const IDLength = 32 // 256-bit ids, same as the node ids (sha256 of the public keys)
+
+// ID is a node id or a key of a stored value, both live in the same 256-bit space
+type ID [IDLength]byte
+
+func ParseID(s string) (ID, error) {
+	id := ID{}
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != IDLength {
+		return id, fmt.Errorf("invalid id %q, expected %d hex-encoded bytes", s, IDLength)
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// KeyFor returns the key of the value in the DHT, i.e. KeyFor([]byte("name:alice"))
+func KeyFor(data []byte) ID {
+	return ID(sha256.Sum256(data))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance is the XOR metric of the Kademlia
+func (id ID) Distance(other ID) ID {
+	d := ID{}
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Less compares the distances
+func (id ID) Less(other ID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits shared by the ids,
+// it's the index of the k-bucket for the other id
+func (id ID) commonPrefixLen(other ID) int {
+	d := id.Distance(other)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDLength * 8
+}
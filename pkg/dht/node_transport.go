@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/node"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// TCPMessagePayload.type's of the DHT RPCs, TCPMessagePayload.data is a JSON-encoded Message
+const (
+	MsgTypeRequest  = "dht_request"
+	MsgTypeResponse = "dht_response"
+)
+
+// NodeTransport carries the DHT RPCs over the node's connections.
+// Nodes which aren't connected yet are dialed on the first request.
+// The sender's id of the messages is the node id proven in the connection's handshake,
+// the id the sender puts into the message is ignored.
+type NodeTransport struct {
+	node    *node.Node
+	mu      sync.Mutex
+	dht     *DHT
+	pending map[string]pendingCall // rpc id -> the call waiting for the response
+}
+
+// pendingCall accepts the response only from the connection the request was sent to
+type pendingCall struct {
+	peerID string
+	ch     chan Message
+}
+
+// NewNodeTransport registers the DHT message handlers on the node,
+// call Serve() once the DHT is created to start answering the requests
+func NewNodeTransport(n *node.Node) *NodeTransport {
+	t := &NodeTransport{node: n, pending: map[string]pendingCall{}}
+	n.Handle(MsgTypeRequest, t.handleRequest)
+	n.Handle(MsgTypeResponse, t.handleResponse)
+	return t
+}
+
+func (t *NodeTransport) Serve(d *DHT) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dht = d
+}
+
+func (t *NodeTransport) Call(ctx context.Context, to Contact, req Message) (Message, error) {
+	peer, err := t.peerFor(ctx, to)
+	if err != nil {
+		return Message{}, err
+	}
+	if to.ID != "" && peer.NodeID() != to.ID {
+		return Message{}, fmt.Errorf("node %s is at %s instead of %s", peer.NodeID(), to.Addr, to.ID)
+	}
+	ch := make(chan Message, 1)
+	t.mu.Lock()
+	t.pending[req.RPCID] = pendingCall{peerID: peer.ID, ch: ch}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.RPCID)
+		t.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := peer.Send(&pb.TCPMessagePayload{Type: MsgTypeRequest, Data: data}); err != nil {
+		return Message{}, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-peer.Conn.Done():
+		return Message{}, fmt.Errorf("connection to %s is closed", peer.ID)
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("%s request to %s: %w", req.Method, to.Addr, ctx.Err())
+	}
+}
+
+// peerFor reuses the connection to the node if there's one, or dials its address
+func (t *NodeTransport) peerFor(ctx context.Context, to Contact) (*node.Peer, error) {
+	if to.ID != "" {
+		if peer, ok := t.node.PeerByNodeID(to.ID); ok {
+			return peer, nil
+		}
+	}
+	if peer, ok := t.node.Peer(to.Addr); ok {
+		return peer, nil
+	}
+	if to.Addr == "" {
+		return nil, fmt.Errorf("no address for node %s", to.ID)
+	}
+	return t.node.DialContext(ctx, to.Addr)
+}
+
+func (t *NodeTransport) handleRequest(peer *node.Peer, payload *pb.TCPMessagePayload) {
+	t.mu.Lock()
+	d := t.dht
+	t.mu.Unlock()
+	req := Message{}
+	if d == nil || peer.NodeID() == "" || json.Unmarshal(payload.Data, &req) != nil {
+		return
+	}
+	req.Sender.ID = peer.NodeID()
+	req.Sender.Addr = fillHost(req.Sender.Addr, peer.ID)
+	// Handle the requests concurrently, HandleRequest can ping the stale contacts
+	go func() {
+		data, err := json.Marshal(d.HandleRequest(req))
+		if err != nil {
+			return
+		}
+		peer.Send(&pb.TCPMessagePayload{Type: MsgTypeResponse, Data: data})
+	}()
+}
+
+func (t *NodeTransport) handleResponse(peer *node.Peer, payload *pb.TCPMessagePayload) {
+	resp := Message{}
+	if json.Unmarshal(payload.Data, &resp) != nil {
+		return
+	}
+	resp.Sender.ID = peer.NodeID()
+	t.mu.Lock()
+	call, ok := t.pending[resp.RPCID]
+	t.mu.Unlock()
+	if !ok || call.peerID != peer.ID {
+		return
+	}
+	// a duplicate response must not block the peer's messages
+	select {
+	case call.ch <- resp:
+	default:
+	}
+}
+
+// fillHost replaces the empty or unspecified host of the advertised address (i.e. ":5000")
+// with the host of the connection's remote address
+func fillHost(advertised string, remoteAddr string) string {
+	if advertised == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return advertised
+	}
+	remoteHost, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
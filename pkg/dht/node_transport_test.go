@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/node"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"github.com/ulshv/nexuslink/pkg/transport"
+)
+
+func TestNodeTransport(t *testing.T) {
+	memory := transport.NewMemory(logs.NewSlogLogger("dht_test/mem"))
+	newNode := func(name string) *node.Node {
+		ident, err := identity.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := node.NewNode(context.Background(), logs.NewSlogLogger("dht_test/"+name), ident)
+		n.AddTransport(transport.SchemeMem, memory)
+		t.Cleanup(n.Close)
+		return n
+	}
+	send := func(peer *node.Peer, msgType string, msg Message) {
+		data, _ := json.Marshal(msg)
+		peer.Send(&pb.TCPMessagePayload{Type: msgType, Data: data})
+	}
+
+	t.Run("responses are accepted only from the asked peer", func(t *testing.T) {
+		a, b, c := newNode("a"), newNode("b"), newNode("c")
+		at := NewNodeTransport(a)
+		probed := make(chan struct{})
+		a.Handle("probe", func(peer *node.Peer, payload *pb.TCPMessagePayload) { close(probed) })
+		if _, err := a.Listen("mem:a"); err != nil {
+			t.Fatal(err)
+		}
+		// b answers twice, once c's spoofed responses are handled by a
+		b.Handle(MsgTypeRequest, func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+			req := Message{}
+			json.Unmarshal(payload.Data, &req)
+			<-probed
+			send(peer, MsgTypeResponse, Message{RPCID: req.RPCID, Method: "from b"})
+			send(peer, MsgTypeResponse, Message{RPCID: req.RPCID, Method: "from b"})
+		})
+		if _, err := b.Dial("mem:a"); err != nil {
+			t.Fatal(err)
+		}
+		cPeer, err := c.Dial("mem:a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); len(a.Peers()) < 2; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected b and c connected")
+			}
+		}
+
+		result := make(chan Message, 1)
+		go func() {
+			resp, err := at.Call(context.Background(), Contact{ID: b.ID}, Message{RPCID: "rpc-1", Method: MethodPing})
+			if err != nil {
+				t.Error(err)
+			}
+			result <- resp
+		}()
+		time.Sleep(50 * time.Millisecond)
+		send(cPeer, MsgTypeResponse, Message{RPCID: "rpc-1", Method: "from c"})
+		send(cPeer, MsgTypeResponse, Message{RPCID: "rpc-1", Method: "from c"})
+		cPeer.Send(&pb.TCPMessagePayload{Type: "probe"})
+
+		select {
+		case resp := <-result:
+			if resp.Method != "from b" {
+				t.Errorf("Expected the response of b, got %q", resp.Method)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the response, the messages of c must not be blocked")
+		}
+	})
+
+	t.Run("sender's id is the node id proven in the handshake", func(t *testing.T) {
+		a, b, c := newNode("a"), newNode("b"), newNode("c")
+		at := NewNodeTransport(a)
+		d, err := New(logs.NewSlogLogger("dht_test/a"), a.ID, at, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at.Serve(d)
+		if _, err := a.Listen("mem:a2"); err != nil {
+			t.Fatal(err)
+		}
+		responses := make(chan Message, 1)
+		c.Handle(MsgTypeResponse, func(peer *node.Peer, payload *pb.TCPMessagePayload) {
+			resp := Message{}
+			json.Unmarshal(payload.Data, &resp)
+			responses <- resp
+		})
+		cPeer, err := c.Dial("mem:a2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// c claims to be b
+		send(cPeer, MsgTypeRequest, Message{RPCID: "rpc-3", Method: MethodPing, Sender: Contact{ID: b.ID, Addr: "mem:c"}})
+		select {
+		case <-responses:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the response")
+		}
+		bID, _ := ParseID(b.ID)
+		for _, contact := range d.table.closest(bID, K) {
+			if contact.ID == b.ID {
+				t.Error("Expected the claimed node id not to get into the routing table")
+			}
+		}
+		if d.Size() != 1 {
+			t.Errorf("Expected c in the routing table, got %d contacts", d.Size())
+		}
+
+		// calling b at c's address fails
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := at.Call(ctx, Contact{ID: b.ID, Addr: a.Peers()[0].ID}, Message{RPCID: "rpc-4", Method: MethodPing}); err == nil {
+			t.Error("Expected the call to b at c's address to fail")
+		}
+	})
+
+	t.Run("cancelled call doesn't wait for the dial", func(t *testing.T) {
+		a := newNode("a")
+		at := NewNodeTransport(a)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		// the blackhole address never answers
+		if _, err := at.Call(ctx, Contact{Addr: "192.0.2.1:5000"}, Message{RPCID: "rpc-2", Method: MethodPing}); err == nil {
+			t.Fatal("Expected the cancelled call to fail")
+		}
+	})
+}
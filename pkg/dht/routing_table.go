@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Contact is a node known to the DHT, Addr is the host:port to dial
+type Contact struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type bucketEntry struct {
+	contact  Contact
+	id       ID
+	lastSeen time.Time
+}
+
+// routingTable keeps up to K contacts in each of the 256 k-buckets,
+// bucket i has the contacts which share exactly i leading bits with the own id.
+// Contacts in a bucket are ordered from the least to the most recently seen.
+type routingTable struct {
+	self    ID
+	k       int
+	mu      sync.Mutex
+	buckets [IDLength*8 + 1][]bucketEntry
+}
+
+func newRoutingTable(self ID, k int) *routingTable {
+	return &routingTable{self: self, k: k}
+}
+
+// update moves the contact to the tail of its bucket. If the bucket is full,
+// the least recently seen contact is returned, so the caller can ping it
+// and call replace() if it doesn't respond (Kademlia prefers long-living nodes).
+func (rt *routingTable) update(contact Contact, id ID) (Contact, bool) {
+	if id == rt.self || contact.Addr == "" {
+		return Contact{}, false
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	idx := rt.self.commonPrefixLen(id)
+	bucket := rt.buckets[idx]
+	for i, entry := range bucket {
+		if entry.id == id {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			rt.buckets[idx] = append(bucket, bucketEntry{contact: contact, id: id, lastSeen: time.Now()})
+			return Contact{}, false
+		}
+	}
+	if len(bucket) < rt.k {
+		rt.buckets[idx] = append(bucket, bucketEntry{contact: contact, id: id, lastSeen: time.Now()})
+		return Contact{}, false
+	}
+	return bucket[0].contact, true
+}
+
+// replace evicts the stale contact in favor of the new one
+func (rt *routingTable) replace(stale Contact, contact Contact, id ID) {
+	rt.remove(stale.ID)
+	rt.update(contact, id)
+}
+
+func (rt *routingTable) remove(contactID string) {
+	id, err := ParseID(contactID)
+	if err != nil {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	idx := rt.self.commonPrefixLen(id)
+	bucket := rt.buckets[idx]
+	for i, entry := range bucket {
+		if entry.id == id {
+			rt.buckets[idx] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to n contacts closest to the target
+func (rt *routingTable) closest(target ID, n int) []Contact {
+	rt.mu.Lock()
+	entries := []bucketEntry{}
+	for _, bucket := range rt.buckets {
+		entries = append(entries, bucket...)
+	}
+	rt.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id.Distance(target).Less(entries[j].id.Distance(target))
+	})
+	contacts := []Contact{}
+	for i := 0; i < len(entries) && i < n; i++ {
+		contacts = append(contacts, entries[i].contact)
+	}
+	return contacts
+}
+
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	size := 0
+	for _, bucket := range rt.buckets {
+		size += len(bucket)
+	}
+	return size
+}
@@ -0,0 +1,225 @@
+// discovery finds other NexusLink nodes in the local network.
+//
+// Every node periodically announces its node id and listening port
+// to the UDP multicast group. Nodes which hear the announcements keep them
+// in the table of discovered peers, the address of the peer is the source IP
+// of the announcement plus the announced port. Peers which stop announcing
+// are removed from the table after the TTL.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+const (
+	DefaultGroupAddr = "239.255.77.77:7777"
+	DefaultInterval  = 5 * time.Second
+	DefaultTTL       = 3 * DefaultInterval
+	announcementType = "nexuslink_announce"
+	maxPacketSize    = 1024
+)
+
+type Options struct {
+	GroupAddr string        // UDP multicast group, DefaultGroupAddr if empty
+	Interval  time.Duration // how often the node announces itself, DefaultInterval if zero
+	TTL       time.Duration // how long a discovered peer is kept without announcements, DefaultTTL if zero
+}
+
+type announcement struct {
+	Type   string `json:"type"`
+	NodeID string `json:"node_id"`
+	Port   int    `json:"port"`
+}
+
+type DiscoveredPeer struct {
+	NodeID   string
+	Addr     string // host:port to dial
+	LastSeen time.Time
+}
+
+type Discovery struct {
+	logger   logs.Logger
+	nodeID   string
+	opts     Options
+	mu       sync.Mutex
+	peers    map[string]*DiscoveredPeer // node id -> peer
+	onPeer   []func(peer DiscoveredPeer)
+	nowFunc  func() time.Time
+	isActive bool
+}
+
+func NewDiscovery(logger logs.Logger, nodeID string, opts Options) *Discovery {
+	if opts.GroupAddr == "" {
+		opts.GroupAddr = DefaultGroupAddr
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+	return &Discovery{
+		logger:  logger,
+		nodeID:  nodeID,
+		opts:    opts,
+		peers:   map[string]*DiscoveredPeer{},
+		nowFunc: time.Now,
+	}
+}
+
+// OnPeer registers the hook called when a new peer is discovered
+// (or rediscovered after it has expired), i.e. to auto-connect to it
+func (d *Discovery) OnPeer(hook func(peer DiscoveredPeer)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onPeer = append(d.onPeer, hook)
+}
+
+// Start announces the node's listening port and listens for the announcements
+// of the other nodes until ctx is cancelled
+func (d *Discovery) Start(ctx context.Context, port int) error {
+	group, err := net.ResolveUDPAddr("udp4", d.opts.GroupAddr)
+	if err != nil {
+		return fmt.Errorf("invalid multicast group %s: %w", d.opts.GroupAddr, err)
+	}
+	d.mu.Lock()
+	if d.isActive {
+		d.mu.Unlock()
+		return fmt.Errorf("discovery is already started")
+	}
+	d.isActive = true
+	d.mu.Unlock()
+
+	listenConn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		d.setInactive()
+		return fmt.Errorf("failed to join multicast group %s: %w", group, err)
+	}
+	sendConn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		listenConn.Close()
+		d.setInactive()
+		return fmt.Errorf("failed to open multicast socket: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listenConn.Close()
+		sendConn.Close()
+		d.setInactive()
+	}()
+	go d.announceLoop(ctx, sendConn, port)
+	go d.listenLoop(listenConn)
+	return nil
+}
+
+// Peers returns the discovered peers which haven't expired yet
+func (d *Discovery) Peers() []DiscoveredPeer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire()
+	peers := []DiscoveredPeer{}
+	for _, peer := range d.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].NodeID < peers[j].NodeID
+	})
+	return peers
+}
+
+// Lookup returns the discovered peer by its node id
+func (d *Discovery) Lookup(nodeID string) (DiscoveredPeer, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire()
+	peer, ok := d.peers[nodeID]
+	if !ok {
+		return DiscoveredPeer{}, false
+	}
+	return *peer, true
+}
+
+func (d *Discovery) setInactive() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.isActive = false
+}
+
+func (d *Discovery) announceLoop(ctx context.Context, conn *net.UDPConn, port int) {
+	data, _ := json.Marshal(announcement{Type: announcementType, NodeID: d.nodeID, Port: port})
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.Write(data); err != nil && ctx.Err() == nil {
+			d.logger.Warn("Failed to send discovery announcement", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Discovery) listenLoop(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // connection is closed on ctx cancellation
+		}
+		d.handleAnnouncement(buf[:n], src.IP)
+	}
+}
+
+// handleAnnouncement adds (or refreshes) the peer in the table,
+// own announcements and garbage are ignored
+func (d *Discovery) handleAnnouncement(data []byte, srcIP net.IP) {
+	msg := announcement{}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != announcementType {
+		return
+	}
+	if msg.NodeID == "" || msg.NodeID == d.nodeID || msg.Port <= 0 || msg.Port > 65535 {
+		return
+	}
+	addr := net.JoinHostPort(srcIP.String(), fmt.Sprint(msg.Port))
+	d.mu.Lock()
+	d.expire()
+	peer, ok := d.peers[msg.NodeID]
+	isNew := !ok || peer.Addr != addr
+	if !ok {
+		peer = &DiscoveredPeer{NodeID: msg.NodeID}
+		d.peers[msg.NodeID] = peer
+	}
+	peer.Addr = addr
+	peer.LastSeen = d.nowFunc()
+	discovered := *peer
+	hooks := append([]func(DiscoveredPeer){}, d.onPeer...)
+	d.mu.Unlock()
+
+	if isNew {
+		d.logger.Info("Discovered peer", "node_id", discovered.NodeID, "addr", discovered.Addr)
+		for _, hook := range hooks {
+			hook(discovered)
+		}
+	}
+}
+
+// expire must be called with d.mu locked
+func (d *Discovery) expire() {
+	now := d.nowFunc()
+	for nodeID, peer := range d.peers {
+		if now.Sub(peer.LastSeen) > d.opts.TTL {
+			delete(d.peers, nodeID)
+		}
+	}
+}
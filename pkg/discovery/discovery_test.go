@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+func announce(nodeID string, port int) []byte {
+	data, _ := json.Marshal(announcement{Type: announcementType, NodeID: nodeID, Port: port})
+	return data
+}
+
+func TestDiscoveryTable(t *testing.T) {
+	logger := logs.NewSlogLogger("discovery_test")
+
+	t.Run("peers are added, refreshed and expired", func(t *testing.T) {
+		now := time.Now()
+		d := NewDiscovery(logger, "self", Options{TTL: 10 * time.Second})
+		d.nowFunc = func() time.Time { return now }
+		discovered := []DiscoveredPeer{}
+		d.OnPeer(func(peer DiscoveredPeer) {
+			discovered = append(discovered, peer)
+		})
+
+		d.handleAnnouncement(announce("a", 5000), net.ParseIP("192.168.1.10"))
+		d.handleAnnouncement(announce("self", 5000), net.ParseIP("192.168.1.11"))
+		d.handleAnnouncement([]byte("garbage"), net.ParseIP("192.168.1.12"))
+		if peers := d.Peers(); len(peers) != 1 || peers[0].Addr != "192.168.1.10:5000" {
+			t.Fatalf("Expected only peer `a` to be discovered, got %+v", peers)
+		}
+
+		now = now.Add(8 * time.Second)
+		d.handleAnnouncement(announce("a", 5000), net.ParseIP("192.168.1.10"))
+		d.handleAnnouncement(announce("b", 6000), net.ParseIP("192.168.1.13"))
+		now = now.Add(8 * time.Second)
+		if _, ok := d.Lookup("a"); !ok {
+			t.Error("Expected the refreshed peer to be kept")
+		}
+
+		now = now.Add(8 * time.Second)
+		if peers := d.Peers(); len(peers) != 0 {
+			t.Errorf("Expected all the peers to expire, got %+v", peers)
+		}
+		if len(discovered) != 2 {
+			t.Errorf("Expected the hook to be called once per new peer, got %+v", discovered)
+		}
+	})
+}
+
+func TestDiscoveryMulticast(t *testing.T) {
+	logger := logs.NewSlogLogger("discovery_test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := Options{GroupAddr: "239.255.77.78:7778", Interval: 50 * time.Millisecond}
+	a := NewDiscovery(logger, "node-a", opts)
+	b := NewDiscovery(logger, "node-b", opts)
+	if err := a.Start(ctx, 5001); err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+	if err := b.Start(ctx, 5002); err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := a.Lookup("node-b"); ok {
+			if _, ok := b.Lookup("node-a"); ok {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Sandboxes and some CI runners don't route multicast even on loopback
+	t.Skip("multicast announcements were not delivered")
+}
@@ -0,0 +1,729 @@
+// file_share implements p2p file transfers on top of the TCPMessage connections.
+//
+// The protocol:
+// - sender advertises the file with a `file_offer` message containing the Manifest
+// - receiver accepts the offer and requests the chunks with `file_chunk_request`,
+// keeping up to maxInflightChunks requests in flight per peer
+// - sender replies with `file_chunk` (or `file_chunk_missing`)
+// - receiver verifies every chunk against its hash from the Manifest, writes it
+// to the temp file and remembers it as verified, so after a disconnect
+// the transfer continues from the last verified chunk
+//
+// Files are content-addressed by the Manifest's Root, so any peer which has
+// (some of) the chunks can serve them. Downloader asks all the connected peers
+// with `file_have_query`, peers reply with `file_have` containing the chunks they have,
+// and the chunks are fetched from all of them in parallel (swarm download).
+// Peers which are downloading the file themselves send `file_have` updates
+// to the peers which asked about it, when they get more chunks.
+package file_share
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+const (
+	maxInflightChunks = 8 // per peer
+	haveUpdateEvery   = 8 // send `file_have` update after this many new chunks
+	shortIDLength     = 12
+)
+
+// Peer is a connection to the remote node, i.e. *tcp_conn.TCPConn
+type Peer interface {
+	Send(payload *pb.TCPMessagePayload) error
+}
+
+type Offer struct {
+	PeerID   string
+	Manifest *Manifest
+}
+
+type sharedFile struct {
+	manifest *Manifest
+	path     string
+}
+
+type upload struct {
+	manifest *Manifest
+	peerID   string
+	served   map[int]bool
+}
+
+type Service struct {
+	logger     logs.Logger
+	dir        string
+	mu         sync.Mutex
+	peers      map[string]Peer
+	shared     map[string]*sharedFile     // manifest root -> complete local file
+	uploads    map[string]*upload         // peerID + "/" + manifest root -> upload
+	offers     map[string]*Offer          // manifest root -> the latest offer
+	downloads  map[string]*download       // manifest root -> download
+	fetches    map[string]bool            // manifest roots requested by Fetch, waiting for the manifest
+	interested map[string]map[string]bool // root of the unfinished download -> peers which asked about it
+}
+
+// outgoing is a message to be sent after the Service's mutex is released,
+// so a slow peer can't block the handling of the other peers
+type outgoing struct {
+	peerID  string
+	msgType string
+	msg     any
+}
+
+// NewService creates the file sharing service which saves downloaded files into dir
+func NewService(logger logs.Logger, dir string) *Service {
+	return &Service{
+		logger:     logger,
+		dir:        dir,
+		peers:      map[string]Peer{},
+		shared:     map[string]*sharedFile{},
+		uploads:    map[string]*upload{},
+		offers:     map[string]*Offer{},
+		downloads:  map[string]*download{},
+		fetches:    map[string]bool{},
+		interested: map[string]map[string]bool{},
+	}
+}
+
+func ShortID(root string) string {
+	if len(root) > shortIDLength {
+		return root[:shortIDLength]
+	}
+	return root
+}
+
+// AddPeer registers the connected peer and asks it about the unfinished downloads,
+// so it becomes one more source if it has the chunks
+func (s *Service) AddPeer(peerID string, peer Peer) {
+	s.mu.Lock()
+	s.peers[peerID] = peer
+	out := []outgoing{}
+	for root, d := range s.downloads {
+		if d.status == StatusActive || d.status == StatusPaused {
+			out = append(out, outgoing{peerID, MsgTypeHaveQuery, haveQueryMsg{Root: root}})
+		}
+	}
+	for root := range s.fetches {
+		out = append(out, outgoing{peerID, MsgTypeHaveQuery, haveQueryMsg{Root: root}})
+	}
+	s.mu.Unlock()
+	s.sendAll(out)
+}
+
+// RemovePeer moves the peer's chunks in flight to the other sources.
+// Downloads without sources are paused, they are resumed
+// when a peer which has the file is connected or offers it again.
+func (s *Service) RemovePeer(peerID string) {
+	s.mu.Lock()
+	delete(s.peers, peerID)
+	for root, offer := range s.offers {
+		if offer.PeerID == peerID {
+			delete(s.offers, root)
+		}
+	}
+	for root, peers := range s.interested {
+		delete(peers, peerID)
+		if len(peers) == 0 {
+			delete(s.interested, root)
+		}
+	}
+	out := []outgoing{}
+	for _, d := range s.downloads {
+		if _, ok := d.sources[peerID]; !ok {
+			continue
+		}
+		d.removeSource(peerID)
+		if d.status != StatusActive {
+			continue
+		}
+		out = append(out, s.requestChunks(d)...)
+		if len(d.inflight) == 0 {
+			d.status = StatusPaused
+			s.logger.Warn("Download paused, no peers have the missing chunks",
+				"name", d.manifest.Name, "id", ShortID(d.manifest.Root), "chunks", fmt.Sprintf("%d/%d", d.haveCount, len(d.have)))
+		}
+	}
+	s.mu.Unlock()
+	s.sendAll(out)
+}
+
+// Share makes the local file available to the peers which Fetch it by the manifest root
+func (s *Service) Share(path string) (*Manifest, error) {
+	m, err := NewManifest(path, DefaultChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared[m.Root] = &sharedFile{manifest: m, path: absPath}
+	return m, nil
+}
+
+// SendFile offers the local file to the peer
+func (s *Service) SendFile(peerID string, path string) (*Manifest, error) {
+	s.mu.Lock()
+	_, ok := s.peers[peerID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	m, err := s.Share(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if _, ok := s.uploads[peerID+"/"+m.Root]; !ok {
+		s.uploads[peerID+"/"+m.Root] = &upload{manifest: m, peerID: peerID, served: map[int]bool{}}
+	}
+	s.mu.Unlock()
+
+	if err := s.send(outgoing{peerID, MsgTypeOffer, offerMsg{Manifest: m}}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Accept starts (or resumes) the download of the offered file.
+// id is a prefix of the manifest root, an empty id accepts the only pending offer.
+// Besides the peer which offered the file, all the other connected peers
+// are asked if they have its chunks.
+func (s *Service) Accept(id string) (TransferInfo, error) {
+	s.mu.Lock()
+	offer, err := s.findOffer(id)
+	if err != nil {
+		s.mu.Unlock()
+		return TransferInfo{}, err
+	}
+	d, err := s.startDownload(offer.Manifest)
+	if err != nil {
+		s.mu.Unlock()
+		return TransferInfo{}, err
+	}
+	delete(s.offers, offer.Manifest.Root)
+	out := s.addSource(d, offer.PeerID, fullBitfield(d.manifest))
+	out = append(out, s.queryPeers(d.manifest.Root, offer.PeerID)...)
+	info := d.info()
+	s.mu.Unlock()
+	s.sendAll(out)
+	return info, nil
+}
+
+// Fetch downloads the file by its manifest root from the connected peers (swarm download).
+// The manifest is taken from the first peer which has the file.
+func (s *Service) Fetch(root string) error {
+	root = strings.ToLower(root)
+	if len(root) != 64 {
+		return fmt.Errorf("full manifest root (64 hex chars) is required")
+	}
+	s.mu.Lock()
+	d, ok := s.downloads[root]
+	if ok && (d.status == StatusActive || d.status == StatusDone) {
+		s.mu.Unlock()
+		return fmt.Errorf("%q is already %s", d.manifest.Name, d.status)
+	}
+	if len(s.peers) == 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("no connected peers")
+	}
+	if !ok || d.status == StatusFailed {
+		s.fetches[root] = true
+	}
+	out := s.queryPeers(root, "")
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+func (s *Service) Offers() []Offer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offers := []Offer{}
+	for _, offer := range s.offers {
+		offers = append(offers, *offer)
+	}
+	sort.Slice(offers, func(i, j int) bool {
+		return offers[i].Manifest.Name < offers[j].Manifest.Name
+	})
+	return offers
+}
+
+func (s *Service) Transfers() []TransferInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := []TransferInfo{}
+	for _, d := range s.downloads {
+		infos = append(infos, d.info())
+	}
+	for _, u := range s.uploads {
+		status := StatusActive
+		if len(u.served) == u.manifest.NumChunks() {
+			status = StatusDone
+		} else if _, ok := s.peers[u.peerID]; !ok {
+			status = StatusPaused
+		}
+		path := ""
+		if f, ok := s.shared[u.manifest.Root]; ok {
+			path = f.path
+		}
+		infos = append(infos, TransferInfo{
+			Direction: DirectionUpload,
+			Name:      u.manifest.Name,
+			Root:      u.manifest.Root,
+			Peers:     []string{u.peerID},
+			Status:    status,
+			Chunks:    len(u.served),
+			Total:     u.manifest.NumChunks(),
+			Size:      u.manifest.Size,
+			Path:      path,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Direction != infos[j].Direction {
+			return infos[i].Direction < infos[j].Direction
+		}
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return strings.Join(infos[i].Peers, ",") < strings.Join(infos[j].Peers, ",")
+	})
+	return infos
+}
+
+// HandleMessage processes a file sharing message received from the peer,
+// see MessageTypes for the list of the supported payload types
+func (s *Service) HandleMessage(peerID string, payload *pb.TCPMessagePayload) error {
+	switch payload.Type {
+	case MsgTypeOffer:
+		msg := offerMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleOffer(peerID, msg)
+	case MsgTypeChunkRequest:
+		msg := chunkRequestMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleChunkRequest(peerID, msg)
+	case MsgTypeChunk:
+		msg := chunkMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleChunk(peerID, msg)
+	case MsgTypeChunkMissing:
+		msg := chunkRequestMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleChunkMissing(peerID, msg)
+	case MsgTypeHaveQuery:
+		msg := haveQueryMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleHaveQuery(peerID, msg)
+	case MsgTypeHave:
+		msg := haveMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		return s.handleHave(peerID, msg)
+	}
+	return fmt.Errorf("unknown file sharing message type: %s", payload.Type)
+}
+
+func (s *Service) handleOffer(peerID string, msg offerMsg) error {
+	if msg.Manifest == nil {
+		return fmt.Errorf("offer without manifest")
+	}
+	if err := msg.Manifest.Validate(); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	m := msg.Manifest
+	s.mu.Lock()
+	d, ok := s.downloads[m.Root]
+	if ok && (d.status == StatusActive || d.status == StatusPaused) {
+		// The file is offered again (i.e. after a reconnect), use the peer as a source
+		if d.status == StatusPaused {
+			s.logger.Info("Resuming download", "name", m.Name, "id", ShortID(m.Root), "peer", peerID)
+		}
+		out := s.addSource(d, peerID, fullBitfield(m))
+		s.mu.Unlock()
+		s.sendAll(out)
+		return nil
+	}
+	s.offers[m.Root] = &Offer{PeerID: peerID, Manifest: m}
+	s.mu.Unlock()
+	s.logger.Info(fmt.Sprintf("Incoming file %q (%d bytes) from %s, type `accept %s` to download it",
+		m.Name, m.Size, peerID, ShortID(m.Root)))
+	return nil
+}
+
+func (s *Service) handleHaveQuery(peerID string, msg haveQueryMsg) error {
+	s.mu.Lock()
+	// Only the unfinished downloads get new chunks to notify about, so the interest
+	// in the other files isn't kept and the peers can't grow the map with any roots
+	if s.isDownloading(msg.Root) {
+		if s.interested[msg.Root] == nil {
+			s.interested[msg.Root] = map[string]bool{}
+		}
+		s.interested[msg.Root][peerID] = true
+	}
+	reply, ok := s.haveMsg(msg.Root)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.send(outgoing{peerID, MsgTypeHave, reply})
+}
+
+func (s *Service) handleHave(peerID string, msg haveMsg) error {
+	if msg.Manifest == nil {
+		return fmt.Errorf("%s without manifest", MsgTypeHave)
+	}
+	root := msg.Manifest.Root
+	s.mu.Lock()
+	d, ok := s.downloads[root]
+	if !ok && !s.fetches[root] {
+		s.mu.Unlock()
+		return nil // not interested in the file (anymore)
+	}
+	if !ok {
+		// The first reply to Fetch brings the manifest
+		if err := msg.Manifest.Validate(); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("invalid manifest: %w", err)
+		}
+		var err error
+		d, err = s.startDownload(msg.Manifest)
+		delete(s.fetches, root)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.logger.Info(fmt.Sprintf("Downloading %q (%d bytes) from the swarm", d.manifest.Name, d.manifest.Size))
+	}
+	out := s.addSource(d, peerID, unpackBitfield(msg.Chunks, d.manifest.NumChunks()))
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+func (s *Service) handleChunkRequest(peerID string, msg chunkRequestMsg) error {
+	s.mu.Lock()
+	m, path := s.localChunk(msg.Root, msg.Index)
+	if m == nil {
+		s.mu.Unlock()
+		return s.send(outgoing{peerID, MsgTypeChunkMissing, msg})
+	}
+	u, ok := s.uploads[peerID+"/"+msg.Root]
+	if !ok {
+		u = &upload{manifest: m, peerID: peerID, served: map[int]bool{}}
+		s.uploads[peerID+"/"+msg.Root] = u
+	}
+	s.mu.Unlock()
+	data, err := readChunk(path, m, msg.Index)
+	if err != nil {
+		s.logger.Error("Failed to read chunk", "name", m.Name, "index", msg.Index, "error", err)
+		return s.send(outgoing{peerID, MsgTypeChunkMissing, msg})
+	}
+	if err := s.send(outgoing{peerID, MsgTypeChunk, chunkMsg{Root: msg.Root, Index: msg.Index, Data: data}}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	u.served[msg.Index] = true
+	isDone := len(u.served) == m.NumChunks()
+	s.mu.Unlock()
+	if isDone {
+		s.logger.Info("Upload finished", "name", m.Name, "peer", peerID)
+	}
+	return nil
+}
+
+func (s *Service) handleChunk(peerID string, msg chunkMsg) error {
+	s.mu.Lock()
+	d, ok := s.downloads[msg.Root]
+	if !ok || d.status != StatusActive || d.inflight[msg.Index] != peerID {
+		s.mu.Unlock()
+		return nil // stale chunk, i.e. from the previous connection
+	}
+	if !d.manifest.VerifyChunk(msg.Index, msg.Data) {
+		// Don't trust the peer anymore, request its chunks from the other sources
+		d.removeSource(peerID)
+		out := s.requestChunks(d)
+		s.mu.Unlock()
+		s.sendAll(out)
+		return fmt.Errorf("chunk %d of %q from %s failed verification", msg.Index, d.manifest.Name, peerID)
+	}
+	if err := d.writeChunk(msg.Index, msg.Data); err != nil {
+		d.status = StatusFailed
+		s.mu.Unlock()
+		return err
+	}
+	s.logProgress(d)
+	out := []outgoing{}
+	if d.haveCount%haveUpdateEvery == 0 || d.isComplete() {
+		out = append(out, s.haveUpdates(d.manifest.Root)...)
+	}
+	if d.isComplete() {
+		err := s.finishDownload(d)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		s.logger.Info("Download finished", "name", d.manifest.Name, "path", d.finalPath)
+		s.sendAll(out)
+		return nil
+	}
+	out = append(out, s.requestChunks(d)...)
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+func (s *Service) handleChunkMissing(peerID string, msg chunkRequestMsg) error {
+	s.mu.Lock()
+	d, ok := s.downloads[msg.Root]
+	if !ok || d.status != StatusActive || d.inflight[msg.Index] != peerID {
+		s.mu.Unlock()
+		return nil
+	}
+	// The peer doesn't have the chunk anymore, request it from the other sources
+	delete(d.inflight, msg.Index)
+	if has, ok := d.sources[peerID]; ok && msg.Index >= 0 && msg.Index < len(has) {
+		has[msg.Index] = false
+	}
+	out := s.requestChunks(d)
+	if len(d.inflight) == 0 {
+		d.status = StatusPaused
+		s.logger.Warn("Download paused, no peers have the missing chunks", "name", d.manifest.Name)
+	}
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+// findOffer must be called with s.mu locked
+func (s *Service) findOffer(id string) (*Offer, error) {
+	matches := []*Offer{}
+	for root, offer := range s.offers {
+		if strings.HasPrefix(root, id) {
+			matches = append(matches, offer)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no file offers matching %q", id)
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%d file offers match %q, specify a longer id", len(matches), id)
+	}
+	return matches[0], nil
+}
+
+// startDownload opens (or reuses) the download of the file, the chunks are requested
+// when the sources are added, must be called with s.mu locked
+func (s *Service) startDownload(m *Manifest) (*download, error) {
+	d, ok := s.downloads[m.Root]
+	if ok && (d.status == StatusActive || d.status == StatusDone) {
+		return nil, fmt.Errorf("%q is already %s", m.Name, d.status)
+	}
+	if !ok || d.status == StatusFailed {
+		if ok {
+			// the failed download is opened again, its file can still be open
+			d.file.Close()
+		}
+		var err error
+		d, err = openDownload(s.dir, m)
+		if err != nil {
+			return nil, err
+		}
+		s.downloads[m.Root] = d
+	}
+	d.status = StatusActive
+	d.inflight = map[int]string{}
+	if d.isComplete() {
+		// everything was verified before the app was restarted
+		return d, s.finishDownload(d)
+	}
+	return d, nil
+}
+
+// isDownloading reports whether the file is fetched or downloaded and not finished yet,
+// must be called with s.mu locked
+func (s *Service) isDownloading(root string) bool {
+	if d, ok := s.downloads[root]; ok {
+		return d.status == StatusActive || d.status == StatusPaused
+	}
+	return s.fetches[root]
+}
+
+// addSource adds (or updates) the peer's chunks and requests the missing ones,
+// must be called with s.mu locked
+func (s *Service) addSource(d *download, peerID string, has []bool) []outgoing {
+	if d.status != StatusActive && d.status != StatusPaused {
+		return nil
+	}
+	d.sources[peerID] = has
+	if d.status == StatusPaused {
+		d.status = StatusActive
+	}
+	out := s.requestChunks(d)
+	if len(d.inflight) == 0 {
+		d.status = StatusPaused
+	}
+	return out
+}
+
+// finishDownload must be called with s.mu locked
+func (s *Service) finishDownload(d *download) error {
+	if err := d.finish(); err != nil {
+		d.status = StatusFailed
+		return err
+	}
+	d.status = StatusDone
+	// the complete file gets no updates, the peers get it all from the `file_have` reply
+	delete(s.interested, d.manifest.Root)
+	// Seed the downloaded file to the other peers
+	s.shared[d.manifest.Root] = &sharedFile{manifest: d.manifest, path: d.finalPath}
+	return nil
+}
+
+// queryPeers asks all the connected peers (except the given one) which chunks
+// of the file they have, must be called with s.mu locked
+func (s *Service) queryPeers(root string, exceptPeerID string) []outgoing {
+	out := []outgoing{}
+	for peerID := range s.peers {
+		if peerID != exceptPeerID {
+			out = append(out, outgoing{peerID, MsgTypeHaveQuery, haveQueryMsg{Root: root}})
+		}
+	}
+	return out
+}
+
+// haveMsg returns the chunks of the file available locally, must be called with s.mu locked
+func (s *Service) haveMsg(root string) (haveMsg, bool) {
+	if f, ok := s.shared[root]; ok {
+		return haveMsg{Manifest: f.manifest, Chunks: packBitfield(fullBitfield(f.manifest))}, true
+	}
+	if d, ok := s.downloads[root]; ok && d.haveCount > 0 && d.status != StatusFailed {
+		return haveMsg{Manifest: d.manifest, Chunks: packBitfield(d.have)}, true
+	}
+	return haveMsg{}, false
+}
+
+// haveUpdates notifies the interested peers about the new chunks, must be called with s.mu locked
+func (s *Service) haveUpdates(root string) []outgoing {
+	msg, ok := s.haveMsg(root)
+	if !ok {
+		return nil
+	}
+	out := []outgoing{}
+	for peerID := range s.interested[root] {
+		out = append(out, outgoing{peerID, MsgTypeHave, msg})
+	}
+	return out
+}
+
+// localChunk returns the manifest and the path of the local file
+// which has the verified chunk, must be called with s.mu locked
+func (s *Service) localChunk(root string, idx int) (*Manifest, string) {
+	if f, ok := s.shared[root]; ok {
+		if idx < 0 || idx >= f.manifest.NumChunks() {
+			return nil, ""
+		}
+		return f.manifest, f.path
+	}
+	if d, ok := s.downloads[root]; ok && d.status != StatusDone && d.status != StatusFailed {
+		if idx < 0 || idx >= len(d.have) || !d.have[idx] {
+			return nil, ""
+		}
+		return d.manifest, d.partPath
+	}
+	return nil, ""
+}
+
+// requestChunks must be called with s.mu locked
+func (s *Service) requestChunks(d *download) []outgoing {
+	out := []outgoing{}
+	for _, a := range d.nextChunks(maxInflightChunks) {
+		out = append(out, outgoing{a.peerID, MsgTypeChunkRequest, chunkRequestMsg{Root: d.manifest.Root, Index: a.idx}})
+	}
+	return out
+}
+
+// logProgress logs every 10% of the download, must be called with s.mu locked
+func (s *Service) logProgress(d *download) {
+	pct := 100
+	if len(d.have) > 0 {
+		pct = d.haveCount * 100 / len(d.have)
+	}
+	if pct/10 > d.lastPct/10 {
+		d.lastPct = pct
+		s.logger.Info(fmt.Sprintf("Downloading %q: %d%%", d.manifest.Name, pct),
+			"chunks", fmt.Sprintf("%d/%d", d.haveCount, len(d.have)), "peers", len(d.sources))
+	}
+}
+
+func (s *Service) send(o outgoing) error {
+	s.mu.Lock()
+	peer, ok := s.peers[o.peerID]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s is not connected", o.peerID)
+	}
+	payload, err := newPayload(o.msgType, o.msg)
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(payload); err != nil {
+		return fmt.Errorf("failed to send %s to %s: %w", o.msgType, o.peerID, err)
+	}
+	return nil
+}
+
+func (s *Service) sendAll(out []outgoing) {
+	for _, o := range out {
+		if err := s.send(o); err != nil {
+			s.logger.Error("Failed to send file sharing message", "error", err)
+		}
+	}
+}
+
+func fullBitfield(m *Manifest) []bool {
+	have := make([]bool, m.NumChunks())
+	for idx := range have {
+		have[idx] = true
+	}
+	return have
+}
+
+func readChunk(path string, m *Manifest, idx int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset, size := m.ChunkRange(idx)
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !m.VerifyChunk(idx, data) {
+		return nil, fmt.Errorf("file has changed since it was shared")
+	}
+	return data, nil
+}
@@ -0,0 +1,389 @@
+package file_share
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// memPeer delivers payloads to the remote Service in order, in a separate goroutine,
+// like the real connection does. Delivery can be cut to emulate a disconnect.
+type memPeer struct {
+	mu       sync.Mutex
+	ch       chan *pb.TCPMessagePayload
+	cut      bool
+	maxChunk int // stop delivering after this many file_chunk messages, 0 = unlimited
+	chunks   int
+}
+
+func newMemPeer(remote *Service, remoteID string) *memPeer {
+	p := &memPeer{ch: make(chan *pb.TCPMessagePayload, 128)}
+	go func() {
+		for payload := range p.ch {
+			remote.HandleMessage(remoteID, payload)
+		}
+	}()
+	return p
+}
+
+func (p *memPeer) Send(payload *pb.TCPMessagePayload) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cut {
+		return nil
+	}
+	if payload.Type == MsgTypeChunk && p.maxChunk > 0 {
+		p.chunks++
+		if p.chunks > p.maxChunk {
+			p.cut = true
+			return nil
+		}
+	}
+	p.ch <- payload
+	return nil
+}
+
+func connectServices(a, b *Service, aID, bID string) (*memPeer, *memPeer) {
+	toB := newMemPeer(b, aID)
+	toA := newMemPeer(a, bID)
+	a.AddPeer(bID, toB)
+	b.AddPeer(aID, toA)
+	return toB, toA
+}
+
+func writeRandomFile(t *testing.T, dir string, size int) string {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, "random.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func mustPayload(t *testing.T, msgType string, msg any) *pb.TCPMessagePayload {
+	payload, err := newPayload(msgType, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func downloadInfo(s *Service) TransferInfo {
+	for _, info := range s.Transfers() {
+		if info.Direction == DirectionDownload {
+			return info
+		}
+	}
+	return TransferInfo{}
+}
+
+func TestManifest(t *testing.T) {
+	t.Run("manifest of a file is valid and verifies its chunks", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 1000)
+		m, err := NewManifest(path, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.NumChunks() != 4 {
+			t.Errorf("Expected 4 chunks but got %d", m.NumChunks())
+		}
+		if err := m.Validate(); err != nil {
+			t.Error(err)
+		}
+		data, _ := os.ReadFile(path)
+		if !m.VerifyChunk(3, data[900:]) {
+			t.Error("Expected the last chunk to be verified")
+		}
+		if m.VerifyChunk(0, data[1:301]) {
+			t.Error("Expected the shifted chunk to fail verification")
+		}
+	})
+
+	t.Run("tampered manifests are rejected", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 1000)
+		m, _ := NewManifest(path, 300)
+		tampered := *m
+		tampered.ChunkHashes = append([]string{}, m.ChunkHashes...)
+		tampered.ChunkHashes[1] = m.ChunkHashes[2]
+		if tampered.Validate() == nil {
+			t.Error("Expected the merkle root mismatch")
+		}
+		tampered = *m
+		tampered.Name = "../../etc/passwd"
+		if tampered.Validate() == nil {
+			t.Error("Expected the invalid name error")
+		}
+		tampered = *m
+		tampered.Size = 950
+		if tampered.Validate() == nil {
+			t.Error("Expected the root to commit to the size")
+		}
+	})
+
+	t.Run("inner node can't be passed off as a chunk", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 600)
+		m, _ := NewManifest(path, 300)
+		// the concatenated leaves hash to the inner node when the tree isn't domain-separated
+		forgedChunk, leaves := []byte{}, [][]byte{}
+		for _, h := range m.ChunkHashes {
+			b, _ := hex.DecodeString(h)
+			forgedChunk = append(forgedChunk, b...)
+			leaves = append(leaves, b)
+		}
+		if bytes.Equal(chunkHash(forgedChunk), MerkleRoot(leaves)) {
+			t.Error("Expected the leaf and the inner node hashes to differ")
+		}
+		forged := &Manifest{
+			Name:        m.Name,
+			Size:        int64(len(forgedChunk)),
+			ChunkSize:   int64(len(forgedChunk)),
+			ChunkHashes: []string{hex.EncodeToString(chunkHash(forgedChunk))},
+			Root:        m.Root,
+		}
+		if forged.Validate() == nil {
+			t.Error("Expected the forged manifest with the same root to be rejected")
+		}
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	logger := logs.NewSlogLogger("file_share_test")
+
+	t.Run("file is transferred and verified", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 5*DefaultChunkSize+123)
+		sender := NewService(logger, t.TempDir())
+		receiverDir := t.TempDir()
+		receiver := NewService(logger, receiverDir)
+		connectServices(sender, receiver, "sender", "receiver")
+
+		m, err := sender.SendFile("receiver", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(receiver.Offers()) == 1 })
+		if _, err := receiver.Accept(ShortID(m.Root)); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return downloadInfo(receiver).Status == StatusDone })
+
+		expected, _ := os.ReadFile(path)
+		actual, err := os.ReadFile(filepath.Join(receiverDir, m.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Error("Expected the downloaded file to be equal to the original one")
+		}
+	})
+
+	t.Run("download is resumed after reconnect", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 20*DefaultChunkSize)
+		sender := NewService(logger, t.TempDir())
+		receiverDir := t.TempDir()
+		receiver := NewService(logger, receiverDir)
+		toReceiver, _ := connectServices(sender, receiver, "sender", "receiver")
+		toReceiver.maxChunk = 7
+
+		m, _ := sender.SendFile("receiver", path)
+		waitFor(t, func() bool { return len(receiver.Offers()) == 1 })
+		receiver.Accept("")
+		waitFor(t, func() bool { return downloadInfo(receiver).Chunks == 7 })
+
+		// disconnect and connect again with the new peer ids
+		sender.RemovePeer("receiver")
+		receiver.RemovePeer("sender")
+		if status := downloadInfo(receiver).Status; status != StatusPaused {
+			t.Fatalf("Expected paused download but got %s", status)
+		}
+		connectServices(sender, receiver, "sender2", "receiver2")
+		if _, err := sender.SendFile("receiver2", path); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return downloadInfo(receiver).Status == StatusDone })
+
+		for _, info := range sender.Transfers() {
+			if info.Peers[0] == "receiver2" && info.Chunks != m.NumChunks()-7 {
+				t.Errorf("Expected only %d missing chunks to be served, got %d", m.NumChunks()-7, info.Chunks)
+			}
+		}
+		expected, _ := os.ReadFile(path)
+		actual, _ := os.ReadFile(filepath.Join(receiverDir, m.Name))
+		if !bytes.Equal(expected, actual) {
+			t.Error("Expected the resumed file to be equal to the original one")
+		}
+	})
+
+	t.Run("failed download is reopened with the chunks verified again", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 1000)
+		m, _ := NewManifest(path, 300)
+		data, _ := os.ReadFile(path)
+		s := NewService(logger, t.TempDir())
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		d, err := s.startDownload(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.writeChunk(0, data[:300])
+		d.writeChunk(1, data[300:600])
+		d.status = StatusFailed
+		// the chunk is changed on disk, its index is still in the state file
+		os.WriteFile(d.partPath, make([]byte, 600), 0o644)
+		d.file.WriteAt(data[:300], 0)
+
+		reopened, err := s.startDownload(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.file.Close()
+		if d.file.Close() == nil {
+			t.Error("Expected the file of the failed download to be closed")
+		}
+		if !reopened.have[0] || reopened.have[1] || reopened.haveCount != 1 {
+			t.Errorf("Expected only the intact chunk to be resumed, got %v", reopened.have)
+		}
+	})
+
+	t.Run("files with the same name don't share the temp files or overwrite each other", func(t *testing.T) {
+		dir := t.TempDir()
+		first, _ := NewManifest(writeRandomFile(t, t.TempDir(), 1000), 300)
+		second, _ := NewManifest(writeRandomFile(t, t.TempDir(), 1000), 300)
+		existing := []byte("existing file")
+		os.WriteFile(filepath.Join(dir, first.Name), existing, 0o644)
+
+		d1, err := openDownload(dir, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d2, err := openDownload(dir, second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d1.partPath == d2.partPath || d1.statePath == d2.statePath {
+			t.Fatalf("Expected separate temp files, got %s and %s", d1.partPath, d2.partPath)
+		}
+		if err := d1.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d2.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if d1.finalPath == d2.finalPath || d1.finalPath == filepath.Join(dir, first.Name) {
+			t.Errorf("Expected new final paths, got %s and %s", d1.finalPath, d2.finalPath)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, first.Name)); !bytes.Equal(data, existing) {
+			t.Error("Expected the existing file to be kept")
+		}
+	})
+}
+
+func TestSwarm(t *testing.T) {
+	logger := logs.NewSlogLogger("file_share_test")
+
+	t.Run("chunks are selected rarest-first from the least loaded sources", func(t *testing.T) {
+		d := &download{
+			have: make([]bool, 4),
+			sources: map[string][]bool{
+				"a": {true, true, true, false},
+				"b": {true, true, false, true},
+			},
+			inflight: map[int]string{},
+		}
+		assignments := d.nextChunks(1)
+		// chunks 2 and 3 are rare (one source each), so they go first
+		if len(assignments) != 2 || assignments[0] != (chunkAssignment{2, "a"}) || assignments[1] != (chunkAssignment{3, "b"}) {
+			t.Errorf("Unexpected assignments: %+v", assignments)
+		}
+		d.inflight = map[int]string{}
+		assignments = d.nextChunks(2)
+		if len(assignments) != 4 || assignments[2].peerID == assignments[3].peerID {
+			t.Errorf("Expected the common chunks to be balanced between the sources: %+v", assignments)
+		}
+	})
+
+	t.Run("interest is kept only in the unfinished downloads", func(t *testing.T) {
+		s := NewService(logger, t.TempDir())
+		other := NewService(logger, t.TempDir())
+		connectServices(s, other, "s", "other")
+		for i := 0; i < 100; i++ {
+			s.HandleMessage("other", mustPayload(t, MsgTypeHaveQuery, haveQueryMsg{Root: fmt.Sprintf("%064d", i)}))
+		}
+		root := fmt.Sprintf("%064x", 1)
+		if err := s.Fetch(root); err != nil {
+			t.Fatal(err)
+		}
+		s.HandleMessage("other", mustPayload(t, MsgTypeHaveQuery, haveQueryMsg{Root: root}))
+		s.mu.Lock()
+		if len(s.interested) != 1 || !s.interested[root]["other"] {
+			t.Errorf("Expected only the interest in the fetched file, got %d roots", len(s.interested))
+		}
+		s.mu.Unlock()
+		s.RemovePeer("other")
+		s.mu.Lock()
+		if len(s.interested) != 0 {
+			t.Errorf("Expected the interest to be removed with the peer, got %d roots", len(s.interested))
+		}
+		s.mu.Unlock()
+	})
+
+	t.Run("file is fetched from several peers and rebalanced on disconnect", func(t *testing.T) {
+		path := writeRandomFile(t, t.TempDir(), 40*DefaultChunkSize+1)
+		m, _ := NewManifest(path, DefaultChunkSize)
+		downloaderDir := t.TempDir()
+		downloader := NewService(logger, downloaderDir)
+		seeders := []*Service{}
+		for i := 0; i < 3; i++ {
+			seeder := NewService(logger, t.TempDir())
+			seeder.shared[m.Root] = &sharedFile{manifest: m, path: path}
+			seeders = append(seeders, seeder)
+		}
+		// the first seeder stops serving after a few chunks and disconnects
+		toDownloader, _ := connectServices(seeders[0], downloader, "seeder0", "downloader")
+		toDownloader.maxChunk = 3
+		connectServices(seeders[1], downloader, "seeder1", "downloader")
+		connectServices(seeders[2], downloader, "seeder2", "downloader")
+
+		if err := downloader.Fetch(m.Root); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return downloadInfo(downloader).Chunks > 10 })
+		downloader.RemovePeer("seeder0")
+		waitFor(t, func() bool { return downloadInfo(downloader).Status == StatusDone })
+
+		for i, seeder := range seeders[1:] {
+			served := 0
+			for _, info := range seeder.Transfers() {
+				served += info.Chunks
+			}
+			if served == 0 {
+				t.Errorf("Expected seeder%d to serve some chunks", i+1)
+			}
+		}
+		expected, _ := os.ReadFile(path)
+		actual, _ := os.ReadFile(filepath.Join(downloaderDir, m.Name))
+		if !bytes.Equal(expected, actual) {
+			t.Error("Expected the downloaded file to be equal to the original one")
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package file_share
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultChunkSize = 256 * 1024 // 256KB, must fit into the TCPMessage's maxPayloadSize
+
+// the prefixes of the hashed leaves and inner nodes of the Merkle tree,
+// so a chunk can't be passed off as an inner node (the second preimage)
+const (
+	leafPrefix  = 0x00
+	innerPrefix = 0x01
+)
+
+// Manifest describes a shared file. The file is split into chunks of ChunkSize bytes
+// (the last one can be smaller), every chunk is hashed with sha256
+// and the chunk hashes are combined into a Merkle tree.
+// Root commits to the tree, Size and ChunkSize and identifies the file's content,
+// so the same file has the same Root no matter who shares it and how it's named.
+type Manifest struct {
+	Name        string   `json:"name"`
+	Size        int64    `json:"size"`
+	ChunkSize   int64    `json:"chunk_size"`
+	ChunkHashes []string `json:"chunk_hashes"` // hex-encoded sha256 of every chunk
+	Root        string   `json:"root"`         // hex-encoded sha256 of Size, ChunkSize and the Merkle root
+}
+
+func NewManifest(path string, chunkSize int64) (*Manifest, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if stat.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	m := &Manifest{
+		Name:      filepath.Base(path),
+		Size:      stat.Size(),
+		ChunkSize: chunkSize,
+	}
+	hashes := [][]byte{}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := chunkHash(buf[:n])
+			hashes = append(hashes, sum)
+			m.ChunkHashes = append(m.ChunkHashes, hex.EncodeToString(sum))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+	m.Root = hex.EncodeToString(m.rootOf(hashes))
+	return m, nil
+}
+
+func (m *Manifest) NumChunks() int {
+	return len(m.ChunkHashes)
+}
+
+// ChunkRange returns the offset and the size of the chunk in the file
+func (m *Manifest) ChunkRange(idx int) (int64, int64) {
+	offset := int64(idx) * m.ChunkSize
+	size := m.ChunkSize
+	if offset+size > m.Size {
+		size = m.Size - offset
+	}
+	return offset, size
+}
+
+// VerifyChunk checks the chunk's data against its hash from the manifest
+func (m *Manifest) VerifyChunk(idx int, data []byte) bool {
+	if idx < 0 || idx >= m.NumChunks() {
+		return false
+	}
+	_, size := m.ChunkRange(idx)
+	if int64(len(data)) != size {
+		return false
+	}
+	return hex.EncodeToString(chunkHash(data)) == m.ChunkHashes[idx]
+}
+
+// Validate checks a manifest received from a peer before anything is written to disk
+func (m *Manifest) Validate() error {
+	if m.Name == "" || m.Name == "." || m.Name == ".." ||
+		m.Name != filepath.Base(m.Name) || strings.ContainsAny(m.Name, `/\`) {
+		return fmt.Errorf("invalid file name: %q", m.Name)
+	}
+	if m.Size < 0 || m.ChunkSize <= 0 || m.ChunkSize > DefaultChunkSize {
+		return fmt.Errorf("invalid size or chunk size: %d/%d", m.Size, m.ChunkSize)
+	}
+	expectedChunks := (m.Size + m.ChunkSize - 1) / m.ChunkSize
+	if int64(m.NumChunks()) != expectedChunks {
+		return fmt.Errorf("expected %d chunk hashes, got %d", expectedChunks, m.NumChunks())
+	}
+	hashes := make([][]byte, 0, m.NumChunks())
+	for _, h := range m.ChunkHashes {
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid chunk hash: %q", h)
+		}
+		hashes = append(hashes, b)
+	}
+	if hex.EncodeToString(m.rootOf(hashes)) != m.Root {
+		return fmt.Errorf("merkle root mismatch")
+	}
+	return nil
+}
+
+// chunkHash is the leaf hash of the chunk: sha256(0x00 || chunk)
+func chunkHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// rootOf returns the manifest's Root: sha256(size || chunk size || Merkle root),
+// the sizes are big-endian uint64
+func (m *Manifest) rootOf(hashes [][]byte) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint64(m.Size))
+	binary.Write(h, binary.BigEndian, uint64(m.ChunkSize))
+	h.Write(MerkleRoot(hashes))
+	return h.Sum(nil)
+}
+
+// MerkleRoot builds a binary Merkle tree from the leaf hashes:
+// every parent is sha256(0x01 || left || right), a node without a pair is moved up as is.
+// Root of an empty file is sha256 of empty input.
+func MerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	level := hashes
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			sum := sha256.Sum256(append(append([]byte{innerPrefix}, level[i]...), level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -0,0 +1,78 @@
+package file_share
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// TCPMessagePayload.type's used by the file sharing protocol.
+// TCPMessagePayload.data is a JSON-encoded message from below.
+const (
+	MsgTypeOffer        = "file_offer"         // sender -> receiver: offerMsg
+	MsgTypeChunkRequest = "file_chunk_request" // receiver -> sender: chunkRequestMsg
+	MsgTypeChunk        = "file_chunk"         // sender -> receiver: chunkMsg
+	MsgTypeChunkMissing = "file_chunk_missing" // sender -> receiver: chunkRequestMsg
+	MsgTypeHaveQuery    = "file_have_query"    // downloader -> any peer: haveQueryMsg
+	MsgTypeHave         = "file_have"          // any peer -> downloader: haveMsg, as a reply or an update
+)
+
+type offerMsg struct {
+	Manifest *Manifest `json:"manifest"`
+}
+
+type haveQueryMsg struct {
+	Root string `json:"root"`
+}
+
+// haveMsg tells which chunks of the file the peer has and can serve
+type haveMsg struct {
+	Manifest *Manifest `json:"manifest"`
+	Chunks   []byte    `json:"chunks"` // bitfield, see packBitfield
+}
+
+type chunkRequestMsg struct {
+	Root  string `json:"root"`
+	Index int    `json:"index"`
+}
+
+type chunkMsg struct {
+	Root  string `json:"root"`
+	Index int    `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+// MessageTypes are the payload types which should be passed to Service.HandleMessage
+var MessageTypes = []string{
+	MsgTypeOffer, MsgTypeChunkRequest, MsgTypeChunk, MsgTypeChunkMissing, MsgTypeHaveQuery, MsgTypeHave,
+}
+
+func newPayload(msgType string, msg any) (*pb.TCPMessagePayload, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", msgType, err)
+	}
+	return &pb.TCPMessagePayload{Type: msgType, Data: data}, nil
+}
+
+// packBitfield packs the chunks into bits, chunk 0 is the highest bit of the first byte
+func packBitfield(have []bool) []byte {
+	bits := make([]byte, (len(have)+7)/8)
+	for idx, ok := range have {
+		if ok {
+			bits[idx/8] |= 0x80 >> (idx % 8)
+		}
+	}
+	return bits
+}
+
+func unpackBitfield(bits []byte, n int) []bool {
+	have := make([]bool, n)
+	for idx := range have {
+		if idx/8 < len(bits) {
+			have[idx] = bits[idx/8]&(0x80>>(idx%8)) != 0
+		}
+	}
+	return have
+}
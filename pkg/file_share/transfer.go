@@ -0,0 +1,271 @@
+package file_share
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type TransferStatus string
+
+const (
+	StatusActive TransferStatus = "active"
+	StatusPaused TransferStatus = "paused" // no connected peers have the missing chunks, can be resumed
+	StatusDone   TransferStatus = "done"
+	StatusFailed TransferStatus = "failed"
+)
+
+type TransferDirection string
+
+const (
+	DirectionDownload TransferDirection = "download"
+	DirectionUpload   TransferDirection = "upload"
+)
+
+// TransferInfo is a snapshot of a transfer's progress, i.e. for the `transfers` command
+type TransferInfo struct {
+	Direction TransferDirection
+	Name      string
+	Root      string
+	Peers     []string // sources of the download or the receiver of the upload
+	Status    TransferStatus
+	Chunks    int // verified chunks for downloads, served chunks for uploads
+	Total     int
+	Size      int64
+	Path      string
+}
+
+// download writes verified chunks to the `<name>.<short root>.part` file and keeps
+// the list of verified chunks in the `<name>.<short root>.part.json` state file,
+// so the download can be resumed after the app restart or peer reconnect.
+// The root in the names keeps the downloads of different files with the same name apart.
+//
+// Chunks are fetched from all the peers which have them (sources), see nextChunks.
+type download struct {
+	manifest  *Manifest
+	status    TransferStatus
+	have      []bool
+	haveCount int
+	sources   map[string][]bool // peer id -> chunks the peer has
+	inflight  map[int]string    // chunk idx -> peer id the chunk is requested from
+	file      *os.File
+	partPath  string
+	statePath string
+	finalPath string
+	lastPct   int
+}
+
+type downloadState struct {
+	Manifest *Manifest `json:"manifest"`
+	Have     []int     `json:"have"`
+}
+
+func openDownload(dir string, m *Manifest) (*download, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create downloads dir: %w", err)
+	}
+	tempName := fmt.Sprintf("%s.%s", m.Name, ShortID(m.Root))
+	d := &download{
+		manifest:  m,
+		status:    StatusPaused,
+		have:      make([]bool, m.NumChunks()),
+		sources:   map[string][]bool{},
+		inflight:  map[int]string{},
+		partPath:  filepath.Join(dir, tempName+".part"),
+		statePath: filepath.Join(dir, tempName+".part.json"),
+		finalPath: filepath.Join(dir, m.Name),
+	}
+	// Resume from the chunks of the previous attempt if the state belongs
+	// to the same file content, the chunks are verified again as the temp file
+	// could be changed or cut since then
+	resumed := []int{}
+	if raw, err := os.ReadFile(d.statePath); err == nil {
+		state := downloadState{}
+		if json.Unmarshal(raw, &state) == nil && state.Manifest != nil && state.Manifest.Root == m.Root {
+			resumed = state.Have
+		}
+	}
+	if len(resumed) == 0 {
+		os.Remove(d.partPath)
+	}
+	f, err := os.OpenFile(d.partPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open temp file: %w", err)
+	}
+	if err := f.Truncate(m.Size); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to allocate temp file: %w", err)
+	}
+	d.file = f
+	for _, idx := range resumed {
+		if idx < 0 || idx >= len(d.have) || d.have[idx] {
+			continue
+		}
+		offset, size := m.ChunkRange(idx)
+		data := make([]byte, size)
+		if _, err := f.ReadAt(data, offset); err == nil && m.VerifyChunk(idx, data) {
+			d.have[idx] = true
+			d.haveCount++
+		}
+	}
+	return d, d.saveState()
+}
+
+func (d *download) isComplete() bool {
+	return d.haveCount == len(d.have)
+}
+
+type chunkAssignment struct {
+	idx    int
+	peerID string
+}
+
+// nextChunks assigns the missing chunks to the sources, so every source
+// has at most `window` chunks in flight. Chunks are selected rarest-first:
+// the chunks which only a few sources have are requested before the common ones,
+// so they aren't lost if those sources disconnect. Chunks of the same rarity are
+// requested in order, which makes the download continue from the last verified chunk.
+// Every chunk goes to the least loaded source which has it.
+func (d *download) nextChunks(window int) []chunkAssignment {
+	load := map[string]int{}
+	for _, peerID := range d.inflight {
+		load[peerID]++
+	}
+	rarity := map[int]int{}
+	candidates := []int{}
+	for idx, ok := range d.have {
+		if _, isInflight := d.inflight[idx]; ok || isInflight {
+			continue
+		}
+		for _, has := range d.sources {
+			if has[idx] {
+				rarity[idx]++
+			}
+		}
+		if rarity[idx] > 0 {
+			candidates = append(candidates, idx)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rarity[candidates[i]] < rarity[candidates[j]]
+	})
+	assignments := []chunkAssignment{}
+	for _, idx := range candidates {
+		best := ""
+		for peerID, has := range d.sources {
+			if !has[idx] || load[peerID] >= window {
+				continue
+			}
+			if best == "" || load[peerID] < load[best] || (load[peerID] == load[best] && peerID < best) {
+				best = peerID
+			}
+		}
+		if best == "" {
+			continue
+		}
+		load[best]++
+		d.inflight[idx] = best
+		assignments = append(assignments, chunkAssignment{idx: idx, peerID: best})
+	}
+	return assignments
+}
+
+// removeSource forgets the peer and its chunks in flight,
+// so they can be requested from the other sources
+func (d *download) removeSource(peerID string) {
+	delete(d.sources, peerID)
+	for idx, p := range d.inflight {
+		if p == peerID {
+			delete(d.inflight, idx)
+		}
+	}
+}
+
+func (d *download) sourceIDs() []string {
+	ids := []string{}
+	for peerID := range d.sources {
+		ids = append(ids, peerID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (d *download) writeChunk(idx int, data []byte) error {
+	delete(d.inflight, idx)
+	if d.have[idx] {
+		return nil
+	}
+	offset, _ := d.manifest.ChunkRange(idx)
+	if _, err := d.file.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("failed to write chunk %d: %w", idx, err)
+	}
+	d.have[idx] = true
+	d.haveCount++
+	return d.saveState()
+}
+
+func (d *download) saveState() error {
+	state := downloadState{Manifest: d.manifest, Have: []int{}}
+	for idx, ok := range d.have {
+		if ok {
+			state.Have = append(state.Have, idx)
+		}
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(d.statePath, raw, 0o644); err != nil {
+		return fmt.Errorf("failed to save download state: %w", err)
+	}
+	return nil
+}
+
+// finish moves the completed temp file to its final place.
+// If a file with the same name already exists, a numeric suffix is added:
+// the final path is reserved by creating it exclusively, so an existing file
+// is never overwritten.
+func (d *download) finish() error {
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	finalPath := d.finalPath
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(finalPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create downloaded file: %w", err)
+		}
+		finalPath = fmt.Sprintf("%s.%d", d.finalPath, i)
+	}
+	if err := os.Rename(d.partPath, finalPath); err != nil {
+		os.Remove(finalPath)
+		return fmt.Errorf("failed to move downloaded file: %w", err)
+	}
+	d.finalPath = finalPath
+	os.Remove(d.statePath)
+	return nil
+}
+
+func (d *download) info() TransferInfo {
+	return TransferInfo{
+		Direction: DirectionDownload,
+		Name:      d.manifest.Name,
+		Root:      d.manifest.Root,
+		Peers:     d.sourceIDs(),
+		Status:    d.status,
+		Chunks:    d.haveCount,
+		Total:     len(d.have),
+		Size:      d.manifest.Size,
+		Path:      d.finalPath,
+	}
+}
@@ -0,0 +1,396 @@
+// gossip is a publish/subscribe layer over the node's connections,
+// it lets a chat room (a topic) exist among the connected peers without a host.
+//
+// Every node tells its peers which topics it's subscribed to (`gossip_subscribe`,
+// `gossip_unsubscribe`). A published message is sent to up to Fanout random peers
+// subscribed to the topic, each of them delivers it to the local user and forwards it
+// the same way while the message's TTL (number of hops) lasts. Message ids are
+// remembered for SeenTTL, so the duplicates arriving by the other paths are dropped
+// and the message is delivered (and forwarded) only once. Start expires them.
+//
+// Only the subscribers relay the topic's messages, so the subscribers of a topic
+// have to be connected with each other (directly or through the other subscribers).
+//
+// Messages are signed by the publisher's identity (everything but the TTL, which
+// the relays decrement), the relays and the subscribers verify the signature against
+// the `from` node id, so a message can't be forged or altered on the way.
+package gossip
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// TCPMessagePayload.type's used by the gossip protocol,
+// TCPMessagePayload.data is a JSON-encoded topicsMsg or Message.
+const (
+	MsgTypeSubscribe   = "gossip_subscribe"
+	MsgTypeUnsubscribe = "gossip_unsubscribe"
+	MsgTypePublish     = "gossip_publish"
+)
+
+const (
+	DefaultFanout  = 6
+	DefaultTTL     = 6
+	DefaultSeenTTL = 2 * time.Minute
+	maxTopicLen    = 128
+)
+
+type Options struct {
+	Fanout  int           // max number of peers a message is sent to by every node, DefaultFanout if zero
+	TTL     int           // max number of hops of a published message, DefaultTTL if zero
+	SeenTTL time.Duration // how long the ids of the seen messages are kept, DefaultSeenTTL if zero
+}
+
+// Peer is a connection to the remote node, i.e. *node.Peer
+type Peer interface {
+	Send(payload *pb.TCPMessagePayload) error
+}
+
+type Message struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"`
+	From      string `json:"from"`       // node id of the publisher
+	PublicKey []byte `json:"public_key"` // publisher's public key, From is its node id
+	Data      []byte `json:"data"`
+	TTL       int    `json:"ttl"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// signedData is the JSON of the message without the signature and the TTL,
+// the order of the fields is fixed by the struct
+func (m Message) signedData() []byte {
+	m.TTL = 0
+	m.Signature = nil
+	data, _ := json.Marshal(m)
+	return data
+}
+
+// Verify checks that the message is signed by the node From
+func (m Message) Verify() error {
+	if identity.NodeIDFromPublicKey(m.PublicKey) != m.From {
+		return fmt.Errorf("public key of the message %s doesn't match its sender %s", m.ID, m.From)
+	}
+	if !identity.Verify(ed25519.PublicKey(m.PublicKey), m.signedData(), m.Signature) {
+		return fmt.Errorf("invalid signature of the message %s", m.ID)
+	}
+	return nil
+}
+
+type topicsMsg struct {
+	Topics []string `json:"topics"`
+}
+
+type Handler func(msg Message)
+
+type outgoing struct {
+	peerID  string
+	peer    Peer
+	payload *pb.TCPMessagePayload
+}
+
+type Service struct {
+	logger     logs.Logger
+	ident      *identity.Identity
+	opts       Options
+	mu         sync.Mutex
+	peers      map[string]Peer
+	peerTopics map[string]map[string]bool // peer id -> topics
+	handlers   map[string]Handler         // subscribed topic -> handler
+	seen       map[string]time.Time       // message id -> when it was seen
+	nowFunc    func() time.Time
+	shuffle    func(n int, swap func(i, j int))
+}
+
+// NewService creates the gossip service, the messages published by this node
+// are signed by the identity and its node id is put into their `from`
+func NewService(logger logs.Logger, ident *identity.Identity, opts Options) *Service {
+	if opts.Fanout == 0 {
+		opts.Fanout = DefaultFanout
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.SeenTTL == 0 {
+		opts.SeenTTL = DefaultSeenTTL
+	}
+	return &Service{
+		logger:     logger,
+		ident:      ident,
+		opts:       opts,
+		peers:      map[string]Peer{},
+		peerTopics: map[string]map[string]bool{},
+		handlers:   map[string]Handler{},
+		seen:       map[string]time.Time{},
+		nowFunc:    time.Now,
+		shuffle:    mathrand.Shuffle,
+	}
+}
+
+// MessageTypes are the payload types which should be passed to Service.HandleMessage
+var MessageTypes = []string{MsgTypeSubscribe, MsgTypeUnsubscribe, MsgTypePublish}
+
+// Start expires the ids of the seen messages every SeenTTL until ctx is done
+func (s *Service) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.opts.SeenTTL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			s.mu.Lock()
+			s.expireSeen()
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// AddPeer tells the new peer about the topics this node is subscribed to
+func (s *Service) AddPeer(peerID string, peer Peer) {
+	s.mu.Lock()
+	s.peers[peerID] = peer
+	s.peerTopics[peerID] = map[string]bool{}
+	topics := s.topicsLocked()
+	s.mu.Unlock()
+	if len(topics) > 0 {
+		s.sendAll([]outgoing{{peerID, peer, newPayload(MsgTypeSubscribe, topicsMsg{Topics: topics})}})
+	}
+}
+
+func (s *Service) RemovePeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, peerID)
+	delete(s.peerTopics, peerID)
+}
+
+// Subscribe starts delivering the topic's messages to the handler
+// and announces the subscription to all the peers
+func (s *Service) Subscribe(topic string, handler Handler) error {
+	if topic == "" || len(topic) > maxTopicLen {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+	s.mu.Lock()
+	if _, ok := s.handlers[topic]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("already subscribed to %q", topic)
+	}
+	s.handlers[topic] = handler
+	out := s.toAllLocked(newPayload(MsgTypeSubscribe, topicsMsg{Topics: []string{topic}}))
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+func (s *Service) Unsubscribe(topic string) error {
+	s.mu.Lock()
+	if _, ok := s.handlers[topic]; !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("not subscribed to %q", topic)
+	}
+	delete(s.handlers, topic)
+	out := s.toAllLocked(newPayload(MsgTypeUnsubscribe, topicsMsg{Topics: []string{topic}}))
+	s.mu.Unlock()
+	s.sendAll(out)
+	return nil
+}
+
+// Topics returns the topics this node is subscribed to
+func (s *Service) Topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topicsLocked()
+}
+
+// TopicPeers returns the connected peers subscribed to the topic
+func (s *Service) TopicPeers(topic string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := []string{}
+	for peerID, topics := range s.peerTopics {
+		if topics[topic] {
+			peers = append(peers, peerID)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Publish sends the message to the topic's subscribers. The message is delivered
+// to the local handler too if this node is subscribed to the topic, only after
+// it's sent to at least one peer: on error the message isn't published anywhere.
+func (s *Service) Publish(topic string, data []byte) (Message, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	msg := Message{
+		ID:        hex.EncodeToString(id),
+		Topic:     topic,
+		From:      s.ident.NodeID(),
+		PublicKey: s.ident.PublicKey,
+		Data:      data,
+		TTL:       s.opts.TTL,
+	}
+	msg.Signature = s.ident.Sign(msg.signedData())
+	s.mu.Lock()
+	handler := s.handlers[topic]
+	out := s.forwardLocked(msg, "")
+	// the copies coming back may arrive while the message is being sent,
+	// the id is forgotten if none of the sends succeeded
+	if len(out) > 0 {
+		s.seen[msg.ID] = s.nowFunc()
+	}
+	s.mu.Unlock()
+	if len(out) == 0 {
+		return msg, fmt.Errorf("no connected peers are subscribed to %q", topic)
+	}
+	if s.sendAll(out) == 0 {
+		s.mu.Lock()
+		delete(s.seen, msg.ID)
+		s.mu.Unlock()
+		return msg, fmt.Errorf("failed to send the message to the peers subscribed to %q", topic)
+	}
+	if handler != nil {
+		handler(msg)
+	}
+	return msg, nil
+}
+
+func (s *Service) HandleMessage(peerID string, payload *pb.TCPMessagePayload) error {
+	switch payload.Type {
+	case MsgTypeSubscribe, MsgTypeUnsubscribe:
+		msg := topicsMsg{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		topics, ok := s.peerTopics[peerID]
+		if !ok {
+			return fmt.Errorf("unknown peer %s", peerID)
+		}
+		for _, topic := range msg.Topics {
+			if payload.Type == MsgTypeSubscribe && len(topic) <= maxTopicLen {
+				topics[topic] = true
+			} else {
+				delete(topics, topic)
+			}
+		}
+	case MsgTypePublish:
+		msg := Message{}
+		if err := json.Unmarshal(payload.Data, &msg); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		if msg.ID == "" || msg.TTL <= 0 {
+			return fmt.Errorf("invalid %s message: empty id or ttl", payload.Type)
+		}
+		// the forged messages are neither delivered nor forwarded,
+		// and their ids aren't remembered, so they can't shadow the genuine ones
+		if err := msg.Verify(); err != nil {
+			return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+		}
+		s.mu.Lock()
+		if _, ok := s.seen[msg.ID]; ok {
+			s.mu.Unlock()
+			return nil
+		}
+		s.seen[msg.ID] = s.nowFunc()
+		handler, isSubscribed := s.handlers[msg.Topic]
+		out := []outgoing{}
+		if isSubscribed && msg.TTL > 1 {
+			forwarded := msg
+			forwarded.TTL--
+			out = s.forwardLocked(forwarded, peerID)
+		}
+		s.mu.Unlock()
+		if isSubscribed {
+			handler(msg)
+		}
+		s.sendAll(out)
+	}
+	return nil
+}
+
+// forwardLocked picks up to Fanout random peers subscribed to the message's topic,
+// except the peer the message came from. Must be called with s.mu locked.
+func (s *Service) forwardLocked(msg Message, fromPeerID string) []outgoing {
+	candidates := []string{}
+	for peerID, topics := range s.peerTopics {
+		if peerID != fromPeerID && topics[msg.Topic] {
+			candidates = append(candidates, peerID)
+		}
+	}
+	sort.Strings(candidates)
+	s.shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > s.opts.Fanout {
+		candidates = candidates[:s.opts.Fanout]
+	}
+	out := []outgoing{}
+	payload := newPayload(MsgTypePublish, msg)
+	for _, peerID := range candidates {
+		out = append(out, outgoing{peerID, s.peers[peerID], payload})
+	}
+	return out
+}
+
+func (s *Service) toAllLocked(payload *pb.TCPMessagePayload) []outgoing {
+	out := []outgoing{}
+	for peerID, peer := range s.peers {
+		out = append(out, outgoing{peerID, peer, payload})
+	}
+	return out
+}
+
+func (s *Service) topicsLocked() []string {
+	topics := []string{}
+	for topic := range s.handlers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// expireSeen must be called with s.mu locked
+func (s *Service) expireSeen() {
+	now := s.nowFunc()
+	for id, seenAt := range s.seen {
+		if now.Sub(seenAt) > s.opts.SeenTTL {
+			delete(s.seen, id)
+		}
+	}
+}
+
+// sendAll sends the payloads after s.mu is unlocked, so the peers delivering
+// messages synchronously don't deadlock. It returns the number of the payloads sent.
+func (s *Service) sendAll(out []outgoing) int {
+	sent := 0
+	for _, o := range out {
+		if err := o.peer.Send(o.payload); err != nil {
+			s.logger.Debug("Failed to send gossip message", "peer", o.peerID, "type", o.payload.Type, "error", err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+func newPayload(msgType string, msg any) *pb.TCPMessagePayload {
+	data, _ := json.Marshal(msg)
+	return &pb.TCPMessagePayload{Type: msgType, Data: data}
+}
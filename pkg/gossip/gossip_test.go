@@ -0,0 +1,308 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+type delivery struct {
+	to      string
+	from    string
+	payload *pb.TCPMessagePayload
+}
+
+// simNetwork queues the messages sent over the in-memory links and delivers them
+// one by one in a single goroutine, links drop messages with the given probability
+type simNetwork struct {
+	nodes    map[string]*Service
+	queue    []delivery
+	loss     float64
+	rand     *rand.Rand
+	sent     int
+	received map[string]map[string]int // node -> message id -> times delivered to the handler
+}
+
+type simLink struct {
+	network *simNetwork
+	from    string
+	to      string
+}
+
+func (l simLink) Send(payload *pb.TCPMessagePayload) error {
+	l.network.sent++
+	if payload.Type == MsgTypePublish && l.network.rand.Float64() < l.network.loss {
+		return nil
+	}
+	l.network.queue = append(l.network.queue, delivery{to: l.to, from: l.from, payload: payload})
+	return nil
+}
+
+// brokenLink fails every send, like the closed connection
+type brokenLink struct{}
+
+func (brokenLink) Send(payload *pb.TCPMessagePayload) error {
+	return errors.New("connection closed")
+}
+
+func newSimNetwork(t *testing.T, size int, loss float64, opts Options) (*simNetwork, []string) {
+	logger := logs.NewSlogLogger("gossip_test")
+	network := &simNetwork{
+		nodes:    map[string]*Service{},
+		loss:     loss,
+		rand:     rand.New(rand.NewSource(42)),
+		received: map[string]map[string]int{},
+	}
+	ids := []string{}
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node-%02d", i)
+		ident, err := identity.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewService(logger, ident, opts)
+		s.shuffle = network.rand.Shuffle
+		network.nodes[id] = s
+		network.received[id] = map[string]int{}
+		ids = append(ids, id)
+	}
+	return network, ids
+}
+
+func (n *simNetwork) connect(a, b string) {
+	n.nodes[a].AddPeer(b, simLink{network: n, from: a, to: b})
+	n.nodes[b].AddPeer(a, simLink{network: n, from: b, to: a})
+}
+
+func (n *simNetwork) subscribe(t *testing.T, id string, topic string) {
+	err := n.nodes[id].Subscribe(topic, func(msg Message) {
+		n.received[id][msg.ID]++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (n *simNetwork) run(t *testing.T) {
+	for len(n.queue) > 0 {
+		d := n.queue[0]
+		n.queue = n.queue[1:]
+		if err := n.nodes[d.to].HandleMessage(d.from, d.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGossip(t *testing.T) {
+	t.Run("messages reach the subscribers over lossy links exactly once", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 40, 0.1, Options{Fanout: 4, TTL: 8})
+		// a ring (so the graph is connected) plus random chords
+		for i, id := range ids {
+			network.connect(id, ids[(i+1)%len(ids)])
+			network.connect(id, ids[network.rand.Intn(len(ids))])
+			network.connect(id, ids[network.rand.Intn(len(ids))])
+		}
+		for _, id := range ids {
+			network.subscribe(t, id, "room")
+		}
+		network.run(t)
+
+		const messages = 20
+		published := []string{}
+		for i := 0; i < messages; i++ {
+			msg, err := network.nodes[ids[(i*7)%len(ids)]].Publish("room", []byte(fmt.Sprint("hello ", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			published = append(published, msg.ID)
+		}
+		network.run(t)
+
+		delivered := 0
+		for _, id := range ids {
+			for _, msgID := range published {
+				switch network.received[id][msgID] {
+				case 0:
+				case 1:
+					delivered++
+				default:
+					t.Fatalf("Message %s is delivered to %s %d times", msgID, id, network.received[id][msgID])
+				}
+			}
+		}
+		if ratio := float64(delivered) / float64(messages*len(ids)); ratio < 0.95 {
+			t.Errorf("Expected at least 95%% of the messages to be delivered, got %.1f%%", ratio*100)
+		}
+	})
+
+	t.Run("messages are not delivered to the other topics", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 4, 0, Options{})
+		for i := 1; i < len(ids); i++ {
+			network.connect(ids[0], ids[i])
+		}
+		network.subscribe(t, ids[0], "room")
+		network.subscribe(t, ids[1], "room")
+		network.subscribe(t, ids[2], "other")
+		network.run(t)
+
+		msg, err := network.nodes[ids[1]].Publish("room", []byte("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.run(t)
+		if network.received[ids[0]][msg.ID] != 1 || network.received[ids[1]][msg.ID] != 1 {
+			t.Error("Expected the message to be delivered to the room's subscribers")
+		}
+		if network.received[ids[2]][msg.ID] != 0 || network.received[ids[3]][msg.ID] != 0 {
+			t.Error("Expected the message not to be delivered to the other nodes")
+		}
+		if _, err := network.nodes[ids[3]].Publish("nobody", []byte("hi")); err == nil {
+			t.Error("Expected the error when no peers are subscribed to the topic")
+		}
+	})
+
+	t.Run("ttl limits the number of hops", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 6, 0, Options{TTL: 3})
+		for i := 0; i+1 < len(ids); i++ {
+			network.connect(ids[i], ids[i+1])
+		}
+		for _, id := range ids {
+			network.subscribe(t, id, "line")
+		}
+		network.run(t)
+		msg, _ := network.nodes[ids[0]].Publish("line", nil)
+		network.run(t)
+		for i, id := range ids {
+			expected := 0
+			if i <= 3 {
+				expected = 1
+			}
+			if network.received[id][msg.ID] != expected {
+				t.Errorf("Expected node %d to receive the message %d times, got %d", i, expected, network.received[id][msg.ID])
+			}
+		}
+	})
+
+	t.Run("fanout limits the number of forwarded copies", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 10, 0, Options{Fanout: 3, TTL: 1})
+		for i := 1; i < len(ids); i++ {
+			network.connect(ids[0], ids[i])
+			network.subscribe(t, ids[i], "star")
+		}
+		network.run(t)
+		network.sent = 0
+		network.nodes[ids[0]].Publish("star", nil)
+		if network.sent != 3 {
+			t.Errorf("Expected 3 copies to be sent, got %d", network.sent)
+		}
+	})
+
+	t.Run("published message is delivered locally and remembered only if it's sent", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 2, 0, Options{})
+		network.subscribe(t, ids[0], "room")
+		s := network.nodes[ids[0]]
+		msg, err := s.Publish("room", []byte("alone"))
+		if err == nil {
+			t.Error("Expected the error when no peers are subscribed to the topic")
+		}
+		if network.received[ids[0]][msg.ID] != 0 {
+			t.Error("Expected the message not to be delivered locally without peers")
+		}
+
+		s.AddPeer(ids[1], brokenLink{})
+		s.HandleMessage(ids[1], newPayload(MsgTypeSubscribe, topicsMsg{Topics: []string{"room"}}))
+		msg, err = s.Publish("room", []byte("lost"))
+		if err == nil {
+			t.Error("Expected the error when the message isn't sent to any peer")
+		}
+		if _, ok := s.seen[msg.ID]; ok || network.received[ids[0]][msg.ID] != 0 {
+			t.Error("Expected the unsent message to be neither delivered locally nor remembered")
+		}
+
+		network.connect(ids[0], ids[1])
+		network.subscribe(t, ids[1], "room")
+		network.run(t)
+		msg, err = s.Publish("room", []byte("sent"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.seen[msg.ID]; !ok || network.received[ids[0]][msg.ID] != 1 {
+			t.Error("Expected the sent message to be delivered locally and remembered")
+		}
+	})
+
+	t.Run("forged and altered messages are neither delivered nor forwarded", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 3, 0, Options{})
+		network.connect(ids[0], ids[1])
+		network.connect(ids[1], ids[2])
+		for _, id := range ids {
+			network.subscribe(t, id, "room")
+		}
+		network.run(t)
+		mallory, _ := identity.Generate()
+		author := network.nodes[ids[0]].ident
+		relay := network.nodes[ids[1]]
+
+		forged := Message{ID: "forged", Topic: "room", From: author.NodeID(), PublicKey: mallory.PublicKey, Data: []byte("hi"), TTL: 3}
+		forged.Signature = mallory.Sign(forged.signedData())
+		impersonated := forged
+		impersonated.ID, impersonated.PublicKey = "impersonated", author.PublicKey
+		altered := Message{ID: "altered", Topic: "room", From: author.NodeID(), PublicKey: author.PublicKey, Data: []byte("hi"), TTL: 3}
+		altered.Signature = author.Sign(altered.signedData())
+		altered.Data = []byte("send me your keys")
+		for _, msg := range []Message{forged, impersonated, altered} {
+			if err := relay.HandleMessage(ids[0], newPayload(MsgTypePublish, msg)); err == nil {
+				t.Errorf("Expected the message %s to be rejected", msg.ID)
+			}
+			if _, ok := relay.seen[msg.ID]; ok || network.received[ids[1]][msg.ID] != 0 {
+				t.Errorf("Expected the message %s not to be delivered or remembered", msg.ID)
+			}
+		}
+		if len(network.queue) != 0 {
+			t.Error("Expected the rejected messages not to be forwarded")
+		}
+
+		msg, err := network.nodes[ids[0]].Publish("room", []byte("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.run(t)
+		if network.received[ids[2]][msg.ID] != 1 {
+			t.Error("Expected the signed message to be relayed with the decremented ttl")
+		}
+	})
+
+	t.Run("seen ids expire without new messages", func(t *testing.T) {
+		network, ids := newSimNetwork(t, 2, 0, Options{SeenTTL: 10 * time.Millisecond})
+		network.connect(ids[0], ids[1])
+		network.subscribe(t, ids[1], "room")
+		network.run(t)
+		s := network.nodes[ids[0]]
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s.Start(ctx)
+		if _, err := s.Publish("room", nil); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			s.mu.Lock()
+			seen := len(s.seen)
+			s.mu.Unlock()
+			if seen == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the seen ids to expire, %d left", seen)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
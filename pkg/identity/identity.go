@@ -0,0 +1,76 @@
+// identity is the node's ed25519 key pair.
+// The node id is sha256 of the public key, so the id can't be taken by another node
+// without its private key (i.e. signed records of the node can be verified by the id).
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func Generate() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	return &Identity{PublicKey: pub, privateKey: priv}, nil
+}
+
+// LoadOrGenerate reads the private key seed from the file,
+// or generates a new identity and saves it if the file doesn't exist
+func LoadOrGenerate(path string) (*Identity, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := Generate()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create identity dir: %w", err)
+		}
+		seed := hex.EncodeToString(id.privateKey.Seed())
+		if err := os.WriteFile(path, []byte(seed+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to save identity: %w", err)
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity file %s", path)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{PublicKey: priv.Public().(ed25519.PublicKey), privateKey: priv}, nil
+}
+
+// NodeID returns the hex-encoded sha256 of the public key
+func (id *Identity) NodeID() string {
+	return NodeIDFromPublicKey(id.PublicKey)
+}
+
+func (id *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(id.privateKey, data)
+}
+
+func NodeIDFromPublicKey(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:])
+}
+
+func Verify(pub ed25519.PublicKey, data []byte, sig []byte) bool {
+	return len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, data, sig)
+}
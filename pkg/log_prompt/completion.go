@@ -0,0 +1,79 @@
+package log_prompt
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Completer returns the candidates for the word at the cursor. line is the input
+// before the cursor, and every candidate replaces line[start:], so the completer
+// decides what the "word" is, i.e. a whole path or just its last element.
+type Completer func(line string) (start int, candidates []string)
+
+// completion is the state of the Tab completion in progress
+type completion struct {
+	start      int // rune index in the line where the completed word starts
+	candidates []string
+	index      int // the candidate in the line, -1 if it's the common prefix
+	tabs       int
+}
+
+// SetCompleter enables the Tab completion: Tab puts the next candidate into the line
+// (Shift+Tab the previous one), and the second Tab lists all the candidates above the prompt.
+// The completer is called with the LogPrompt locked, so it must not use the LogPrompt's loggers.
+func (lp *LogPrompt) SetCompleter(completer Completer) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.completer = completer
+}
+
+// handleTabLocked completes the word at the cursor, printing the candidates on the second Tab
+func (lp *LogPrompt) handleTabLocked(backwards bool) {
+	c := lp.completion
+	if c == nil {
+		if lp.completer == nil {
+			return
+		}
+		line := string(lp.line.buf[:lp.line.pos])
+		start, candidates := lp.completer(line)
+		if len(candidates) == 0 || start < 0 || start > len(line) {
+			return
+		}
+		c = &completion{start: utf8.RuneCountInString(line[:start]), candidates: candidates, index: -1}
+		lp.completion = c
+		if len(candidates) == 1 {
+			lp.line.replace(c.start, candidates[0])
+			lp.completion = nil
+			return
+		}
+		// complete the common part first, unless there's nothing to add
+		if prefix := commonPrefix(candidates); utf8.RuneCountInString(prefix) > lp.line.pos-c.start {
+			lp.line.replace(c.start, prefix)
+			c.tabs++
+			return
+		}
+	}
+	c.tabs++
+	if c.tabs == 2 {
+		lp.printAboveLocked(strings.Join(c.candidates, "  "))
+	}
+	if backwards && c.index < 0 {
+		c.index = len(c.candidates) - 1
+	} else if backwards {
+		c.index = (c.index - 1 + len(c.candidates)) % len(c.candidates)
+	} else {
+		c.index = (c.index + 1) % len(c.candidates)
+	}
+	lp.line.replace(c.start, c.candidates[c.index])
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
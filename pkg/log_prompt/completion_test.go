@@ -0,0 +1,57 @@
+package log_prompt
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompletion(t *testing.T) {
+	words := []string{"help", "listen", "list", "localhost"}
+	completer := func(line string) (int, []string) {
+		start := strings.LastIndex(line, " ") + 1
+		candidates := []string{}
+		for _, word := range words {
+			if strings.HasPrefix(word, line[start:]) {
+				candidates = append(candidates, word)
+			}
+		}
+		return start, candidates
+	}
+	newPrompt := func(input string) *LogPrompt {
+		lp := NewLogPrompt(context.Background(), "> ")
+		lp.SetCompleter(completer)
+		lp.line.set(input)
+		return lp
+	}
+
+	t.Run("single candidate is completed at once", func(t *testing.T) {
+		lp := newPrompt("say he")
+		lp.handleTabLocked(false)
+		if lp.line.String() != "say help" {
+			t.Errorf("Expected the completed word, got %q", lp.line.String())
+		}
+	})
+
+	t.Run("common prefix is completed before cycling", func(t *testing.T) {
+		lp := newPrompt("lis")
+		expected := []string{"list", "listen", "list", "listen"}
+		for i, backwards := range []bool{false, false, false, true} {
+			lp.handleTabLocked(backwards)
+			if lp.line.String() != expected[i] {
+				t.Fatalf("Tab %d: expected %q, got %q", i+1, expected[i], lp.line.String())
+			}
+		}
+	})
+
+	t.Run("tab cycles the candidates and keeps the text after the cursor", func(t *testing.T) {
+		lp := newPrompt("l world")
+		lp.line.pos = 1
+		for _, expected := range []string{"listen world", "list world", "localhost world", "listen world"} {
+			lp.handleTabLocked(false)
+			if lp.line.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, lp.line.String())
+			}
+		}
+	})
+}
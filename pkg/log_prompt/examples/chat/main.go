@@ -36,7 +36,7 @@ func main() {
 	go lp.Start()
 
 	logger := lp.NewLogger("chat")
-	wg.Add(2)
+	wg.Add(1)
 
 	go func() {
 		for {
@@ -47,6 +47,7 @@ func main() {
 	}()
 
 	go func() {
+		defer wg.Done()
 		currUser := "admin"
 
 		for msg := range lp.Prompts() {
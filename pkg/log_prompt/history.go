@@ -0,0 +1,150 @@
+package log_prompt
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultHistorySize = 1000
+
+// history of the entered lines, the oldest first. Repeated lines are kept once,
+// at the place of the last use.
+type history struct {
+	entries []string
+	maxSize int
+	file    string // entries are saved to the file after every change, if set
+	// navigation with up/down: pos is the shown entry,
+	// len(entries) is the line being edited, which is kept in draft
+	pos   int
+	draft string
+}
+
+func newHistory() *history {
+	return &history{maxSize: DefaultHistorySize}
+}
+
+// load reads the entries from the file, one per line, the line breaks of the multi-line
+// entries are escaped as "\n". Missing file is an empty history.
+func (h *history) load(path string, maxSize int) error {
+	h.file = path
+	if maxSize > 0 {
+		h.maxSize = maxSize
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.add(unescapeEntry(line))
+		}
+	}
+	h.reset()
+	return nil
+}
+
+func (h *history) save() error {
+	if h.file == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.file), 0o700); err != nil {
+		return fmt.Errorf("failed to create history dir: %w", err)
+	}
+	lines := make([]string, len(h.entries))
+	for i, entry := range h.entries {
+		lines[i] = escapeEntry(entry)
+	}
+	data := strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(h.file, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// add appends the line, moving its previous copy to the end
+func (h *history) add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	for i, entry := range h.entries {
+		if entry == line {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			break
+		}
+	}
+	h.entries = append(h.entries, line)
+	if len(h.entries) > h.maxSize {
+		h.entries = h.entries[len(h.entries)-h.maxSize:]
+	}
+	h.reset()
+}
+
+// reset stops the navigation, the next prev() starts from the newest entry
+func (h *history) reset() {
+	h.pos = len(h.entries)
+	h.draft = ""
+}
+
+// prev returns the older entry, current is the line being edited
+func (h *history) prev(current string) (string, bool) {
+	if h.pos == 0 {
+		return "", false
+	}
+	if h.pos == len(h.entries) {
+		h.draft = current
+	}
+	h.pos--
+	return h.entries[h.pos], true
+}
+
+// next returns the newer entry, or the draft after the newest one
+func (h *history) next() (string, bool) {
+	if h.pos >= len(h.entries) {
+		return "", false
+	}
+	h.pos++
+	if h.pos == len(h.entries) {
+		return h.draft, true
+	}
+	return h.entries[h.pos], true
+}
+
+// search returns the index of the newest entry containing query, starting at from and going back
+func (h *history) search(query string, from int) (int, bool) {
+	for i := min(from, len(h.entries)-1); i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// historySearch is the state of the Ctrl+R incremental reverse search
+type historySearch struct {
+	query    lineEditor
+	match    int // index of the matched entry, -1 if nothing matches
+	original string
+}
+
+const searchPrompt = "(reverse-i-search)`%s': "
+
+var (
+	entryEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	entryUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// escapeEntry keeps the entry on one line of the history file
+func escapeEntry(entry string) string {
+	return entryEscaper.Replace(entry)
+}
+
+func unescapeEntry(line string) string {
+	return entryUnescaper.Replace(line)
+}
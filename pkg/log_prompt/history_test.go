@@ -0,0 +1,121 @@
+package log_prompt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	t.Run("repeated lines are moved to the end", func(t *testing.T) {
+		h := newHistory()
+		for _, line := range []string{"peers", "connect localhost:5000", "peers", "  ", "help"} {
+			h.add(line)
+		}
+		expected := []string{"connect localhost:5000", "peers", "help"}
+		if !slices.Equal(h.entries, expected) {
+			t.Errorf("Expected %v, got %v", expected, h.entries)
+		}
+	})
+
+	t.Run("up and down navigate back to the edited line", func(t *testing.T) {
+		h := newHistory()
+		h.add("one")
+		h.add("two")
+		steps := []struct {
+			up       bool
+			expected string
+			ok       bool
+		}{
+			{true, "two", true}, {true, "one", true}, {true, "", false},
+			{false, "two", true}, {false, "draft", true}, {false, "", false},
+		}
+		for i, step := range steps {
+			var entry string
+			var ok bool
+			if step.up {
+				entry, ok = h.prev("draft")
+			} else {
+				entry, ok = h.next()
+			}
+			if entry != step.expected || ok != step.ok {
+				t.Fatalf("Step %d: expected %q %v, got %q %v", i, step.expected, step.ok, entry, ok)
+			}
+		}
+	})
+
+	t.Run("history is persisted and trimmed to the max size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dir", "history")
+		h := newHistory()
+		if err := h.load(path, 2); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"one", "two", "three"} {
+			h.add(line)
+			if err := h.save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		loaded := newHistory()
+		if err := loaded.load(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"two", "three"}; !slices.Equal(loaded.entries, expected) {
+			t.Errorf("Expected %v, got %v", expected, loaded.entries)
+		}
+	})
+
+	t.Run("multi-line entries are escaped in the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history")
+		h := newHistory()
+		if err := h.load(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		entries := []string{"say room one\ntwo", `path\to\n`}
+		for _, entry := range entries {
+			h.add(entry)
+		}
+		if err := h.save(); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != len(entries) {
+			t.Fatalf("Expected an entry per line, got %q", data)
+		}
+
+		loaded := newHistory()
+		if err := loaded.load(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(loaded.entries, entries) {
+			t.Errorf("Expected %q, got %q", entries, loaded.entries)
+		}
+	})
+
+	t.Run("ctrl+r finds the older entries incrementally", func(t *testing.T) {
+		lp := NewLogPrompt(context.Background(), "> ")
+		for _, line := range []string{"connect localhost:5000", "room join general", "connect localhost:6000", "peers"} {
+			lp.history.add(line)
+		}
+		lp.search = &historySearch{match: -1}
+		for _, k := range []key{{code: keyRune, r: 'c'}, {code: keyRune, r: 'o'}, {code: keyRune, r: 'n'}} {
+			lp.handleSearchKey(k)
+		}
+		if lp.search.match != 2 {
+			t.Fatalf("Expected the newest match, got %d", lp.search.match)
+		}
+		lp.handleSearchKey(key{code: keyRune, r: keyCtrlR})
+		if lp.search.match != 0 {
+			t.Fatalf("Expected the older match, got %d", lp.search.match)
+		}
+		if lp.handleSearchKey(key{code: keyEnter}) || lp.search != nil {
+			t.Fatal("Expected Enter to finish the search")
+		}
+		if lp.line.String() != "connect localhost:5000" {
+			t.Errorf("Expected the matched entry in the line, got %q", lp.line.String())
+		}
+	})
+}
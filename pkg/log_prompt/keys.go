@@ -0,0 +1,213 @@
+package log_prompt
+
+import (
+	"bufio"
+	"strings"
+	"unicode/utf8"
+)
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota // printable characters and the control ones like Ctrl+C
+	keyEnter
+	keyBackspace
+	keyDelete
+	keyLeft
+	keyRight
+	keyUp
+	keyDown
+	keyHome
+	keyEnd
+	keyWordLeft       // Alt/Ctrl+Left, Alt+B
+	keyWordRight      // Alt/Ctrl+Right, Alt+F
+	keyDeleteWordBack // Alt+Backspace
+	keyBackTab        // Shift+Tab
+	keyModUp          // Alt/Ctrl+Up
+	keyModDown        // Alt/Ctrl+Down
+	keyPageUp
+	keyPageDown
+	keyNewline    // Alt/Shift+Enter, a line break in the input
+	keyPaste      // bracketed paste, the pasted text is in key.text
+	keyPasteStart // ESC [ 200 ~, readKey returns the whole paste instead
+	keyPasteEnd   // ESC [ 201 ~, stray end of the paste
+	keyEscape
+	keyUnknown // unsupported escape sequence, ignored
+)
+
+type key struct {
+	code keyCode
+	r    rune   // for keyRune
+	text string // for keyPaste
+}
+
+// Bracketed paste mode, the terminal wraps the pasted text into ESC [ 200 ~ and ESC [ 201 ~,
+// so the line breaks in it aren't Enters
+const (
+	enableBracketedPaste  = "\x1b[?2004h"
+	disableBracketedPaste = "\x1b[?2004l"
+	pasteEnd              = "\x1b[201~"
+)
+
+// Control characters sent by the terminal in raw mode
+const (
+	keyCtrlA = 1
+	keyCtrlB = 2
+	keyCtrlC = 3
+	keyCtrlD = 4
+	keyCtrlE = 5
+	keyCtrlF = 6
+	keyCtrlG = 7
+	keyTab   = 9
+	keyCtrlK = 11
+	keyCtrlN = 14
+	keyCtrlP = 16
+	keyCtrlR = 18
+	keyCtrlU = 21
+	keyCtrlW = 23
+	keyEsc   = 27
+)
+
+func (k key) isCtrl(c rune) bool {
+	return k.code == keyRune && k.r == c
+}
+
+// readKey reads a single key stroke. Escape sequences of the special keys
+// are decoded, so they never get into the input as garbage.
+func readKey(r *bufio.Reader) (key, error) {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return key{}, err
+	}
+	switch c {
+	case '\r', '\n':
+		return key{code: keyEnter}, nil
+	case '\b', 127:
+		return key{code: keyBackspace}, nil
+	case utf8.RuneError:
+		return key{code: keyUnknown}, nil
+	case keyEsc:
+	default:
+		return key{code: keyRune, r: c}, nil
+	}
+	// a lone Esc: terminals write the whole escape sequence at once
+	if r.Buffered() == 0 {
+		return key{code: keyEscape}, nil
+	}
+	c, _, err = r.ReadRune()
+	if err != nil {
+		return key{}, err
+	}
+	switch c {
+	case '[':
+		k, err := readCSI(r)
+		if err == nil && k.code == keyPasteStart {
+			return readPaste(r)
+		}
+		return k, err
+	case '\r', '\n':
+		return key{code: keyNewline}, nil
+	case 'O':
+		final, err := r.ReadByte()
+		if err != nil {
+			return key{}, err
+		}
+		return csiKey("", final), nil
+	case 'b':
+		return key{code: keyWordLeft}, nil
+	case 'f':
+		return key{code: keyWordRight}, nil
+	case 127, '\b':
+		return key{code: keyDeleteWordBack}, nil
+	}
+	return key{code: keyUnknown}, nil
+}
+
+// readCSI reads the "ESC [ <params> <final>" sequence, the "ESC [" is already read
+func readCSI(r *bufio.Reader) (key, error) {
+	params := strings.Builder{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return key{}, err
+		}
+		if b >= 0x40 && b <= 0x7e {
+			return csiKey(params.String(), b), nil
+		}
+		params.WriteByte(b)
+	}
+}
+
+// readPaste reads the pasted text up to the end of the paste, the line breaks become "\n"
+func readPaste(r *bufio.Reader) (key, error) {
+	text := strings.Builder{}
+	for !strings.HasSuffix(text.String(), pasteEnd) {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return key{}, err
+		}
+		text.WriteRune(c)
+	}
+	pasted := strings.TrimSuffix(text.String(), pasteEnd)
+	pasted = strings.ReplaceAll(pasted, "\r\n", "\n")
+	return key{code: keyPaste, text: strings.ReplaceAll(pasted, "\r", "\n")}, nil
+}
+
+func csiKey(params string, final byte) key {
+	// "1;3" is Alt, "1;5" is Ctrl
+	modified := strings.HasSuffix(params, ";3") || strings.HasSuffix(params, ";5")
+	switch final {
+	case 'A':
+		if modified {
+			return key{code: keyModUp}
+		}
+		return key{code: keyUp}
+	case 'B':
+		if modified {
+			return key{code: keyModDown}
+		}
+		return key{code: keyDown}
+	case 'C':
+		if modified {
+			return key{code: keyWordRight}
+		}
+		return key{code: keyRight}
+	case 'D':
+		if modified {
+			return key{code: keyWordLeft}
+		}
+		return key{code: keyLeft}
+	case 'Z':
+		return key{code: keyBackTab}
+	case 'u':
+		// Shift+Enter of the terminals reporting the modified keys, "13" is Enter
+		if strings.HasPrefix(params, "13;") {
+			return key{code: keyNewline}
+		}
+	case 'H':
+		return key{code: keyHome}
+	case 'F':
+		return key{code: keyEnd}
+	case '~':
+		switch params {
+		case "1", "7":
+			return key{code: keyHome}
+		case "4", "8":
+			return key{code: keyEnd}
+		case "3":
+			return key{code: keyDelete}
+		case "5":
+			return key{code: keyPageUp}
+		case "6":
+			return key{code: keyPageDown}
+		case "27;2;13":
+			// xterm's modifyOtherKeys Shift+Enter
+			return key{code: keyNewline}
+		case "200":
+			return key{code: keyPasteStart}
+		case "201":
+			return key{code: keyPasteEnd}
+		}
+	}
+	return key{code: keyUnknown}
+}
@@ -0,0 +1,98 @@
+package log_prompt
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ANSI colors of the log levels and the service names
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorGray   = "\x1b[90m"
+)
+
+var levelColors = map[string]string{
+	"DEBUG": colorGray,
+	"INFO":  colorGreen,
+	"WARN":  colorYellow,
+	"ERROR": colorRed,
+}
+
+// serviceColors are picked by the hash of the service name, so a service keeps its color between the runs
+var serviceColors = []string{"\x1b[34m", "\x1b[35m", "\x1b[36m", "\x1b[94m", "\x1b[95m", "\x1b[96m"}
+
+// SetLevel sets the minimal level of the loggers without their own level, see SetServiceLevel.
+// It's logs.EnvLevel by default, so LOG_LEVEL=debug enables the debug logs.
+func (lp *LogPrompt) SetLevel(level slog.Level) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.level = level
+}
+
+// SetServiceLevel sets the minimal level of the loggers of the service, it takes effect
+// on the existing loggers too. Logger.Log output is never filtered.
+func (lp *LogPrompt) SetServiceLevel(svcName string, level slog.Level) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.levels[svcName] = level
+}
+
+// Levels returns the default level and the levels set for the services
+func (lp *LogPrompt) Levels() (slog.Level, map[string]slog.Level) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.level, maps.Clone(lp.levels)
+}
+
+// SetColors enables the ANSI colors of the levels and the service names. They're enabled
+// by default if the output is a terminal and the NO_COLOR env var isn't set.
+// The full-screen mode is never colored.
+func (lp *LogPrompt) SetColors(enabled bool) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.colors = enabled
+}
+
+// defaultColors checks the output of the terminal: the logs may be redirected while the input is typed.
+// Only the files can be checked apart, the other terminals are colored if they're interactive.
+func defaultColors(terminal Terminal) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if t, ok := terminal.(*fileTerminal); ok {
+		return term.IsTerminal(int(t.out.Fd()))
+	}
+	return terminal.IsTerminal()
+}
+
+func (l *logPromptLogger) enabled(level slog.Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	minLevel, ok := l.levels[l.svcName]
+	if !ok {
+		minLevel = l.level
+	}
+	return level >= minLevel
+}
+
+// colorizeLocked wraps the level and the service name into their colors, if the colors are enabled
+func (lp *LogPrompt) colorizeLocked(logLevel string, svcName string) (string, string) {
+	if !lp.colors || lp.screen != nil {
+		return logLevel, svcName
+	}
+	if color, ok := levelColors[logLevel]; ok {
+		logLevel = color + logLevel + colorReset
+	}
+	h := fnv.New32a()
+	h.Write([]byte(svcName))
+	svcName = fmt.Sprintf("%s%s%s", serviceColors[h.Sum32()%uint32(len(serviceColors))], svcName, colorReset)
+	return logLevel, svcName
+}
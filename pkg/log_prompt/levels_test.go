@@ -0,0 +1,45 @@
+package log_prompt
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	newPrompt := func(interactive bool) (*LogPrompt, *fakeTerminal) {
+		term, _ := newFakeTerminal(interactive)
+		return NewTerminalLogPrompt(context.Background(), "> ", term), term
+	}
+
+	t.Run("service level overrides the default one", func(t *testing.T) {
+		lp, term := newPrompt(false)
+		lp.SetColors(false)
+		lp.SetLevel(slog.LevelWarn)
+		node, chat := lp.NewLogger("node"), lp.NewLogger("chat")
+		lp.SetServiceLevel("node", slog.LevelDebug)
+		node.Debug("node debug")
+		chat.Info("chat info")
+		chat.Warn("chat warn")
+		chat.Log("chat output")
+
+		lines, _ := term.screen()
+		if len(lines) != 3 ||
+			!strings.Contains(lines[0], "DEBUG [node]: node debug") ||
+			!strings.Contains(lines[1], "WARN [chat]: chat warn") ||
+			strings.TrimSpace(lines[2]) != "chat output" {
+			t.Errorf("Expected the node debug, the chat warning and output, got %q", lines)
+		}
+	})
+
+	t.Run("levels and services are colored in a terminal", func(t *testing.T) {
+		lp, term := newPrompt(true)
+		lp.SetColors(true)
+		lp.NewLogger("node").Error("failed")
+		lines, _ := term.screen()
+		if len(lines) != 1 || !strings.Contains(lines[0], colorRed+"ERROR"+colorReset+" [\x1b[") {
+			t.Errorf("Expected the colored level and service, got %q", lines)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package log_prompt
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// lineEditor is the input line with the cursor. The line is kept as runes,
+// so the editing never splits a multibyte UTF-8 character.
+type lineEditor struct {
+	buf []rune
+	pos int // cursor position in runes, 0..len(buf)
+}
+
+func (e *lineEditor) String() string {
+	return string(e.buf)
+}
+
+func (e *lineEditor) set(s string) {
+	e.buf = []rune(s)
+	e.pos = len(e.buf)
+}
+
+// clear empties the line, overwriting the runes, so no copy of a secret stays in the memory
+func (e *lineEditor) clear() {
+	clear(e.buf)
+	e.set("")
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+// insertText inserts the pasted text, keeping the line breaks and dropping the other control characters
+func (e *lineEditor) insertText(text string) {
+	for _, r := range text {
+		switch {
+		case r == '\t':
+			e.replace(e.pos, "    ")
+		case r == '\n' || unicode.IsPrint(r):
+			e.insert(r)
+		}
+	}
+}
+
+// replace puts s in place of the runes between from and the cursor
+func (e *lineEditor) replace(from int, s string) {
+	tail := append([]rune{}, e.buf[e.pos:]...)
+	e.buf = append(append(e.buf[:from], []rune(s)...), tail...)
+	e.pos = from + utf8.RuneCountInString(s)
+}
+
+// deleteRange removes the runes in [from, to) and moves the cursor to from
+func (e *lineEditor) deleteRange(from, to int) {
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.pos = from
+}
+
+func (e *lineEditor) backspace() {
+	if e.pos > 0 {
+		e.deleteRange(e.pos-1, e.pos)
+	}
+}
+
+func (e *lineEditor) delete() {
+	if e.pos < len(e.buf) {
+		e.deleteRange(e.pos, e.pos+1)
+	}
+}
+
+func (e *lineEditor) left() {
+	e.pos = max(e.pos-1, 0)
+}
+
+func (e *lineEditor) right() {
+	e.pos = min(e.pos+1, len(e.buf))
+}
+
+func (e *lineEditor) home() {
+	e.pos = 0
+}
+
+func (e *lineEditor) end() {
+	e.pos = len(e.buf)
+}
+
+func (e *lineEditor) wordLeft() {
+	e.pos = e.wordStart(isWordRune)
+}
+
+func (e *lineEditor) wordRight() {
+	pos := e.pos
+	for pos < len(e.buf) && !isWordRune(e.buf[pos]) {
+		pos++
+	}
+	for pos < len(e.buf) && isWordRune(e.buf[pos]) {
+		pos++
+	}
+	e.pos = pos
+}
+
+// deleteWordBack removes the word before the cursor, Alt+Backspace
+func (e *lineEditor) deleteWordBack() {
+	e.deleteRange(e.wordStart(isWordRune), e.pos)
+}
+
+// deleteFieldBack removes everything back to the whitespace, Ctrl+W
+func (e *lineEditor) deleteFieldBack() {
+	e.deleteRange(e.wordStart(func(r rune) bool { return !unicode.IsSpace(r) }), e.pos)
+}
+
+// killToStart removes the text before the cursor, Ctrl+U
+func (e *lineEditor) killToStart() {
+	e.deleteRange(0, e.pos)
+}
+
+// killToEnd removes the text after the cursor, Ctrl+K
+func (e *lineEditor) killToEnd() {
+	e.buf = e.buf[:e.pos]
+}
+
+// wordStart skips the non-word runes before the cursor, and then the word ones
+func (e *lineEditor) wordStart(isWord func(rune) bool) int {
+	pos := e.pos
+	for pos > 0 && !isWord(e.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWord(e.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// handleKey applies the editing key, it returns false for the keys it doesn't handle
+func (e *lineEditor) handleKey(k key) bool {
+	switch k.code {
+	case keyBackspace:
+		e.backspace()
+	case keyDelete:
+		e.delete()
+	case keyLeft:
+		e.left()
+	case keyRight:
+		e.right()
+	case keyHome:
+		e.home()
+	case keyEnd:
+		e.end()
+	case keyWordLeft:
+		e.wordLeft()
+	case keyWordRight:
+		e.wordRight()
+	case keyDeleteWordBack:
+		e.deleteWordBack()
+	case keyNewline:
+		e.insert('\n')
+	case keyPaste:
+		e.insertText(k.text)
+	case keyRune:
+		switch k.r {
+		case keyCtrlA:
+			e.home()
+		case keyCtrlE:
+			e.end()
+		case keyCtrlB:
+			e.left()
+		case keyCtrlF:
+			e.right()
+		case keyCtrlW:
+			e.deleteFieldBack()
+		case keyCtrlU:
+			e.killToStart()
+		case keyCtrlK:
+			e.killToEnd()
+		default:
+			if !unicode.IsPrint(k.r) {
+				return false
+			}
+			e.insert(k.r)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// stringWidth is the number of terminal cells taken by s: combining marks take none,
+// East Asian wide characters and emoji take two cells
+func stringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), r == 0x200b:
+		return 0
+	case r >= 0x1100 && r <= 0x115f, // Hangul Jamo
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,              // CJK
+		r >= 0xac00 && r <= 0xd7a3,                             // Hangul syllables
+		r >= 0xf900 && r <= 0xfaff,                             // CJK compatibility ideographs
+		r >= 0xfe30 && r <= 0xfe4f,                             // CJK compatibility forms
+		r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6, // fullwidth forms
+		r >= 0x1f300 && r <= 0x1f64f, r >= 0x1f900 && r <= 0x1f9ff, // emoji
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,61 @@
+package log_prompt
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// typeKeys feeds the raw terminal input to the editor
+func typeKeys(e *lineEditor, input string) {
+	r := bufio.NewReader(strings.NewReader(input))
+	for {
+		k, err := readKey(r)
+		if err != nil {
+			return
+		}
+		e.handleKey(k)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		pos      int
+	}{
+		{"backspace removes a whole multibyte character", "привет\x7f", "приве", 5},
+		{"characters are inserted at the cursor", "hllo\x1b[D\x1b[D\x1b[De", "hello", 2},
+		{"home and end move to the line edges", "ello\x1b[Hh\x1b[F!", "hello!", 6},
+		{"ctrl+a and ctrl+e move to the line edges", "ello\x01h\x05!", "hello!", 6},
+		{"delete removes the character under the cursor", "hello\x1b[D\x1b[D\x1b[3~", "helo", 3},
+		{"ctrl+w removes the previous field", "connect localhost:5000\x17", "connect ", 8},
+		{"alt+backspace removes the previous word", "connect localhost:5000\x1b\x7f", "connect localhost:", 18},
+		{"ctrl+u removes the text before the cursor", "say hi\x1b[D\x1b[D\x15", "hi", 0},
+		{"ctrl+k removes the text after the cursor", "say hi\x1b[D\x1b[D\x0b", "say ", 4},
+		{"ctrl+arrows jump over words", "say hello world\x1b[1;5D\x1b[1;5D!\x1b[1;5C?", "say !hello? world", 11},
+		{"alt+b and alt+f jump over words", "один два\x1bb\x1bb\x1bf_", "один_ два", 5},
+		{"unknown escape sequences are ignored", "a\x1b[15~\x1b[1;2Pb", "ab", 2},
+		{"alt+enter and shift+enter insert line breaks", "a\x1b\rb\x1b[13;2uc\x1b[27;2;13~d", "a\nb\nc\nd", 7},
+		{"bracketed paste is inserted as text", "> \x1b[200~one\r\ntwo\tx\x03\x1b[201~!", "> one\ntwo    x!", 15},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &lineEditor{}
+			typeKeys(e, test.input)
+			if e.String() != test.expected || e.pos != test.pos {
+				t.Errorf("Expected %q with the cursor at %d, got %q at %d", test.expected, test.pos, e.String(), e.pos)
+			}
+		})
+	}
+
+	t.Run("wide characters take two cells", func(t *testing.T) {
+		e := &lineEditor{}
+		e.set("a世界")
+		e.left()
+		if _, col := cursorAt(string(e.buf[:e.pos]), 80); col != 3 {
+			t.Errorf("Expected the cursor at column 3, got %d", col)
+		}
+	})
+}
@@ -1,109 +1,365 @@
 package log_prompt
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
-	"unicode/utf8"
+	"unicode"
 
-	"golang.org/x/term"
+	"github.com/ulshv/nexuslink/pkg/logs"
 )
 
 const (
-	CLEAR_LINE = "\r\x1b[K" // Clear current terminal line
+	CLEAR_LINE  = "\r\x1b[K" // Clear current terminal line
+	CLEAR_BELOW = "\r\x1b[J" // Clear current terminal line and the lines below it
 )
 
+// LogPrompt is the input line at the bottom of the terminal with the log lines
+// printed above it. Loggers are used from many goroutines, so the state of the line
+// and all the terminal writes are guarded by mu, and every redraw is a single write.
 type LogPrompt struct {
+	mu           sync.Mutex
+	terminal     Terminal
 	prompt       string
-	currInput    string
+	line         lineEditor
+	history      *history
+	search       *historySearch // Ctrl+R search in progress
+	completer    Completer
+	completion   *completion // Tab completion in progress
+	screen       *Screen     // full-screen mode, see EnableScreen
+	secret       *secretInput
+	secretReqs   chan *secretInput // ReadSecret of the non-terminal input
+	level        slog.Level
+	levels       map[string]slog.Level // service name -> level, see SetServiceLevel
+	colors       bool
 	isLastPrompt bool
+	cursorRow    int  // rows of the multi-line prompt above the cursor
+	interactive  bool // the input is a terminal, otherwise it's read line by line
 	promptsCh    chan string
 	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
+// promptAction is the result of a key stroke handled by the prompt
+type promptAction int
+
+const (
+	actionNone   promptAction = iota
+	actionSubmit              // the input line is entered
+	actionQuit                // Ctrl+D on the empty line
+)
+
 type logPromptLogger struct {
 	*LogPrompt
-	svcName      string
-	debugEnabled bool
+	svcName string
 }
 
+// NewLogPrompt returns the LogPrompt of os.Stdin and os.Stdout
 func NewLogPrompt(ctx context.Context, prompt string) *LogPrompt {
+	return NewTerminalLogPrompt(ctx, prompt, StdTerminal())
+}
+
+// NewTerminalLogPrompt returns the LogPrompt reading the input from the terminal and writing the logs to it
+func NewTerminalLogPrompt(ctx context.Context, prompt string, terminal Terminal) *LogPrompt {
+	ctx, cancel := context.WithCancel(ctx)
+	interactive := terminal.IsTerminal()
 	return &LogPrompt{
+		terminal:     terminal,
 		prompt:       prompt,
-		currInput:    "",
+		history:      newHistory(),
+		level:        logs.EnvLevel(),
+		levels:       map[string]slog.Level{},
+		colors:       defaultColors(terminal),
 		isLastPrompt: false,
+		interactive:  interactive,
 		promptsCh:    make(chan string),
+		secretReqs:   make(chan *secretInput),
 		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
 func (lp *LogPrompt) NewLogger(svcName string) *logPromptLogger {
 	return &logPromptLogger{
-		LogPrompt:    lp,
-		svcName:      svcName,
-		debugEnabled: os.Getenv("LOG_LEVEL") == "DEBUG",
+		LogPrompt: lp,
+		svcName:   svcName,
 	}
 }
 
+// Prompts returns the channel with the entered lines, it's closed when Start returns
 func (lp *LogPrompt) Prompts() <-chan string {
 	return lp.promptsCh
 }
 
-func (lp *LogPrompt) Start() {
-	// Make stdin raw mode
-	oldTermState, err := makeTerminalRaw()
+// SetHistoryFile loads the history of the entered lines from the file
+// and saves it there after every entered line. Zero maxSize means DefaultHistorySize.
+func (lp *LogPrompt) SetHistoryFile(path string, maxSize int) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.history.load(path, maxSize)
+}
+
+// Start reads the input until Stop is called, ctx is cancelled or the input ends
+// (Ctrl+D on the empty line). In a terminal the input is edited in the raw mode,
+// otherwise (stdin is a pipe or a file) it's read line by line, so the apps can be scripted.
+// The terminal state is restored and the Prompts channel is closed when Start returns.
+func (lp *LogPrompt) Start() error {
+	defer close(lp.promptsCh)
+	// ReadSecret returns ErrStopped after the end of the input
+	defer lp.cancel()
+	if !lp.interactive {
+		return lp.readLines(lp.terminal)
+	}
+	restore, err := lp.terminal.MakeRaw()
 	if err != nil {
-		fmt.Println("Failed to set raw mode:", err)
-		return
+		return fmt.Errorf("failed to set raw mode: %w", err)
 	}
-	logger := lp.NewLogger("log_prompt")
-	// Make initial prompt line
-	lp.printPromptLine()
 	// Ensure we restore terminal state on exit
-	defer restoreTerminalState(oldTermState)
-	// Buffer for UTF-8/32 bit characters
-	buf := make([]byte, 4)
+	defer restore()
+	return lp.readKeyStrokes(lp.terminal)
+}
+
+// readKeyStrokes edits the input line with the key strokes read from r
+func (lp *LogPrompt) readKeyStrokes(r io.Reader) error {
+	defer lp.closePromptLine()
+	// Make initial prompt line
+	lp.mu.Lock()
+	lp.write(enableBracketedPaste)
+	var resize <-chan time.Time
+	if lp.screen != nil {
+		lp.openScreenLocked()
+		ticker := time.NewTicker(resizeInterval)
+		defer ticker.Stop()
+		resize = ticker.C
+	}
+	lp.printPromptLineLocked()
+	lp.mu.Unlock()
+	// Reads whole UTF-8 characters and escape sequences of the special keys
+	keys := make(chan keyEvent)
+	go lp.readKeys(bufio.NewReader(r), keys)
+	// the entered lines wait here until the app takes them, so the keys
+	// are still handled while the app is busy, i.e. waiting for ReadSecret
+	pending := []string{}
 	for {
-		// Read key strokes on terminal
-		n, err := os.Stdin.Read(buf)
-		char, _ := utf8.DecodeRune(buf[:n])
+		var ev keyEvent
+		var promptsCh chan<- string
+		var next string
+		if len(pending) > 0 {
+			promptsCh, next = lp.promptsCh, pending[0]
+		}
+		select {
+		case <-lp.ctx.Done():
+			return nil
+		case promptsCh <- next:
+			pending = pending[1:]
+			continue
+		case <-resize:
+			lp.mu.Lock()
+			if lp.screen.resizeLocked() {
+				lp.redrawScreenLocked()
+			}
+			lp.mu.Unlock()
+			continue
+		case ev = <-keys:
+		}
+		if errors.Is(ev.err, io.EOF) {
+			lp.sendPrompts(pending)
+			return nil
+		}
+		if ev.err != nil {
+			return fmt.Errorf("failed to read input: %w", ev.err)
+		}
+		lp.mu.Lock()
+		input, action := lp.handleKeyLocked(ev.key)
+		lp.mu.Unlock()
+		switch action {
+		case actionQuit:
+			lp.sendPrompts(pending)
+			return nil
+		case actionSubmit:
+			pending = append(pending, input)
+		}
+	}
+}
+
+// sendPrompts sends the lines entered before the end of the input
+func (lp *LogPrompt) sendPrompts(lines []string) {
+	for _, line := range lines {
+		select {
+		case lp.promptsCh <- line:
+		case <-lp.ctx.Done():
+			return
+		}
+	}
+}
+
+type keyEvent struct {
+	key key
+	err error
+}
+
+// readKeys reads the key strokes until an error. Start doesn't wait for it,
+// since a blocked read of stdin can't be interrupted.
+func (lp *LogPrompt) readKeys(reader *bufio.Reader, keys chan<- keyEvent) {
+	for {
+		k, err := readKey(reader)
+		select {
+		case keys <- keyEvent{k, err}:
+		case <-lp.ctx.Done():
+			return
+		}
 		if err != nil {
-			fmt.Println("error:", err)
 			return
 		}
-		// Handle key strokes
-		switch char {
-		case 3: // Ctrl+C
-			logger.logRaw(false, "", "", "Ctrl+C received, press Ctrl+D to exit.")
-			lp.currInput = ""
-			lp.printPromptLine()
-		case 4: // Ctrl+D
-			logger.logRaw(false, "", "", "Exiting the program.")
-			restoreTerminalState(oldTermState) // Restore terminal state before exiting
-			os.Exit(0)
-		case '\n', 13: // Enter
-			logger.logRaw(false, "", "", lp.prompt+lp.currInput)
-			// send currInput to the channel
-			lp.promptsCh <- lp.currInput
-			lp.currInput = ""
-			lp.printPromptLine()
-		case '\b', 127: // Backspace
-			if len(lp.currInput) > 0 {
-				lp.currInput = lp.currInput[:len(lp.currInput)-1]
-				lp.printPromptLine()
+	}
+}
+
+// readLines sends the input lines to the Prompts channel, without echo and editing
+func (lp *LogPrompt) readLines(r io.Reader) error {
+	lines := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-lp.ctx.Done():
+				return
 			}
-		default:
-			lp.currInput += string(char)
-			lp.printPromptLine()
 		}
+		errCh <- scanner.Err()
+	}()
+	for {
+		select {
+		case <-lp.ctx.Done():
+			return nil
+		case err := <-errCh:
+			return err
+		case line := <-lines:
+			select {
+			case lp.promptsCh <- line:
+			case s := <-lp.secretReqs:
+				s.result <- secretResult{value: line}
+			case <-lp.ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// handleKeyLocked applies the key stroke to the input line, must be called with lp.mu locked
+func (lp *LogPrompt) handleKeyLocked(k key) (string, promptAction) {
+	if lp.secret != nil {
+		lp.handleSecretKeyLocked(k)
+		return "", actionNone
+	}
+	if !k.isCtrl(keyTab) && k.code != keyBackTab {
+		lp.completion = nil
+	}
+	if lp.search != nil && lp.handleSearchKey(k) {
+		lp.printPromptLineLocked()
+		return "", actionNone
+	}
+	if lp.screen != nil && lp.screen.handleKeyLocked(k) {
+		lp.redrawScreenLocked()
+		return "", actionNone
+	}
+	// Handle key strokes
+	switch {
+	case k.isCtrl(keyCtrlC):
+		lp.printAboveLocked("Ctrl+C received, press Ctrl+D to exit.")
+		lp.line.set("")
+		lp.history.reset()
+		lp.printPromptLineLocked()
+	case k.isCtrl(keyCtrlD) && len(lp.line.buf) > 0:
+		lp.line.delete()
+		lp.printPromptLineLocked()
+	case k.isCtrl(keyCtrlD):
+		lp.printAboveLocked("Exiting the program.")
+		return "", actionQuit
+	case k.isCtrl(keyTab), k.code == keyBackTab:
+		lp.handleTabLocked(k.code == keyBackTab)
+		lp.printPromptLineLocked()
+	case k.isCtrl(keyCtrlR):
+		lp.search = &historySearch{match: -1, original: lp.line.String()}
+		lp.printPromptLineLocked()
+	case k.code == keyUp || k.isCtrl(keyCtrlP):
+		if entry, ok := lp.history.prev(lp.line.String()); ok {
+			lp.line.set(entry)
+			lp.printPromptLineLocked()
+		}
+	case k.code == keyDown || k.isCtrl(keyCtrlN):
+		if entry, ok := lp.history.next(); ok {
+			lp.line.set(entry)
+			lp.printPromptLineLocked()
+		}
+	case k.code == keyEnter:
+		input := lp.line.String()
+		lp.line.set("")
+		lp.history.add(input)
+		if lp.screen == nil || lp.screen.selected == 0 {
+			indent := strings.Repeat(" ", stringWidth(lp.prompt))
+			lp.printAboveLocked(lp.prompt + strings.ReplaceAll(input, "\n", "\n"+indent))
+		} else {
+			// the messages entered in a chat come back from the app
+			lp.printPromptLineLocked()
+		}
+		if err := lp.history.save(); err != nil {
+			lp.printAboveLocked(formatLog(true, "ERROR", "log_prompt", "Failed to save the history", "error", err))
+		}
+		return input, actionSubmit
+	case lp.line.handleKey(k):
+		lp.printPromptLineLocked()
 	}
+	return "", actionNone
 }
 
+// handleSearchKey handles the key in the Ctrl+R search mode. Keys which end the search
+// (except the cancelling ones) put the matched entry into the line and return false,
+// so the key is handled as usual, i.e. Enter submits the matched entry.
+func (lp *LogPrompt) handleSearchKey(k key) bool {
+	s := lp.search
+	from := len(lp.history.entries) - 1
+	switch {
+	case k.isCtrl(keyCtrlR):
+		if s.match >= 0 {
+			from = s.match - 1
+		}
+	case k.isCtrl(keyCtrlG), k.isCtrl(keyCtrlC), k.code == keyEscape:
+		lp.line.set(s.original)
+		lp.search = nil
+		return true
+	case k.code == keyBackspace:
+		s.query.backspace()
+	case k.code == keyRune && unicode.IsPrint(k.r):
+		s.query.insert(k.r)
+		if s.match >= 0 {
+			from = s.match
+		}
+	default:
+		if s.match >= 0 {
+			lp.line.set(lp.history.entries[s.match])
+		}
+		lp.search = nil
+		return false
+	}
+	if match, ok := lp.history.search(s.query.String(), from); ok {
+		s.match = match
+	} else if s.query.String() == "" {
+		s.match = -1
+	}
+	return true
+}
+
+// Stop makes Start return, it's the same as cancelling the LogPrompt's ctx
 func (lp *LogPrompt) Stop() {
-	lp.ctx.Done()
-	// TODO: actually stop the loop started by Start()
+	lp.cancel()
 }
 
 func (l *logPromptLogger) logRaw(
@@ -113,9 +369,13 @@ func (l *logPromptLogger) logRaw(
 	message string,
 	args ...any,
 ) {
-	if l.isLastPrompt {
-		fmt.Print(CLEAR_LINE)
-	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	logLevel, svcName = l.colorizeLocked(logLevel, svcName)
+	l.printAboveLocked(formatLog(printMetadata, logLevel, svcName, message, args...))
+}
+
+func formatLog(printMetadata bool, logLevel string, svcName string, message string, args ...any) string {
 	// get every even arg as a string to seamlesly support slog.Attr
 	var params []any
 	var vals []any
@@ -136,25 +396,152 @@ func (l *logPromptLogger) logRaw(
 	if printMetadata {
 		metadata = fmt.Sprintf("%s %s [%s]: ", timestamp, logLevel, svcName)
 	}
-	logMsg := fmt.Sprintf("%s%s %s\n", metadata, message, strings.Join(parmsValsStringParts, ", "))
-	fmt.Printf(logMsg)
-	l.printPromptLine()
+	return fmt.Sprintf("%s%s %s", metadata, message, strings.Join(parmsValsStringParts, ", "))
 }
 
-func (lpl *LogPrompt) printPromptLine() {
-	fmt.Print(CLEAR_LINE)
-	fmt.Print(lpl.prompt + lpl.currInput)
-	lpl.isLastPrompt = true
+// printAboveLocked prints the text in place of the prompt line and redraws the prompt below it,
+// in the full-screen mode the text is added to the LogChat
+func (lp *LogPrompt) printAboveLocked(text string) {
+	if lp.screen != nil {
+		lp.screen.addLocked(LogChat, text)
+		lp.redrawScreenLocked()
+		return
+	}
+	buf := strings.Builder{}
+	lp.clearPromptLocked(&buf)
+	// the raw mode terminal doesn't return the carriage on "\n"
+	buf.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\n")
+	lp.renderPromptLocked(&buf)
+	lp.write(buf.String())
 }
 
-// Helplers to make os.Stdin.Read() return every key stroke in the termanal:
+// printPromptLineLocked redraws the prompt and puts the cursor at its place in the input
+func (lp *LogPrompt) printPromptLineLocked() {
+	buf := strings.Builder{}
+	if lp.screen != nil {
+		if !lp.screen.active {
+			return
+		}
+		fmt.Fprintf(&buf, "\x1b[%d;1H", lp.screen.height)
+	}
+	lp.renderPromptLocked(&buf)
+	lp.write(buf.String())
+}
 
-func makeTerminalRaw() (*term.State, error) {
-	return term.MakeRaw(int(os.Stdin.Fd()))
+func (lp *LogPrompt) write(s string) {
+	io.WriteString(lp.terminal, s)
 }
 
-func restoreTerminalState(state *term.State) error {
-	return term.Restore(int(os.Stdin.Fd()), state)
+// renderPromptLocked draws the prompt with the input in place of the previous one. The lines
+// of the multi-line input are drawn on their own rows, aligned with the first one,
+// and the rows wrapped by the terminal are counted, so the whole input is redrawn.
+func (lp *LogPrompt) renderPromptLocked(buf *strings.Builder) {
+	if !lp.interactive {
+		return
+	}
+	if lp.isLastPrompt {
+		lp.clearPromptLocked(buf)
+	} else {
+		buf.WriteString(CLEAR_LINE)
+	}
+	lp.isLastPrompt = true
+	before, after := lp.inputLocked()
+	if lp.screen != nil {
+		// the full-screen mode has a single row for the input
+		before, after = strings.ReplaceAll(before, "\n", "↵"), strings.ReplaceAll(after, "\n", "↵")
+		buf.WriteString(before + after)
+		if back := stringWidth(after); back > 0 {
+			fmt.Fprintf(buf, "\x1b[%dD", back)
+		}
+		return
+	}
+	indent := "\n" + strings.Repeat(" ", stringWidth(lp.prompt))
+	before, after = strings.ReplaceAll(before, "\n", indent), strings.ReplaceAll(after, "\n", indent)
+	buf.WriteString(strings.ReplaceAll(before+after, "\n", "\r\n"))
+	width, _, err := lp.terminal.Size()
+	if err != nil {
+		width = 0
+	}
+	endRow, _ := cursorAt(before+after, width)
+	row, col := cursorAt(before, width)
+	// the terminal keeps the cursor in the last column until the next character
+	if width > 0 && col >= width {
+		if row < endRow {
+			row, col = row+1, 0
+		} else {
+			col = width - 1
+		}
+	}
+	if up := endRow - row; up > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA", up)
+	}
+	buf.WriteString("\r")
+	if col > 0 {
+		fmt.Fprintf(buf, "\x1b[%dC", col)
+	}
+	lp.cursorRow = row
+}
+
+// inputLocked returns the prompt with the input before the cursor and the input after it
+func (lp *LogPrompt) inputLocked() (string, string) {
+	if s := lp.secret; s != nil {
+		return s.prompt + strings.Repeat("*", s.line.pos), strings.Repeat("*", len(s.line.buf)-s.line.pos)
+	}
+	if s := lp.search; s != nil {
+		match := ""
+		if s.match >= 0 {
+			match = lp.history.entries[s.match]
+		}
+		return fmt.Sprintf(searchPrompt+"%s", s.query.String(), match), ""
+	}
+	return lp.prompt + string(lp.line.buf[:lp.line.pos]), string(lp.line.buf[lp.line.pos:])
+}
+
+// clearPromptLocked moves the cursor to the first row of the prompt and clears all its rows
+func (lp *LogPrompt) clearPromptLocked(buf *strings.Builder) {
+	if !lp.isLastPrompt {
+		return
+	}
+	if lp.cursorRow > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA", lp.cursorRow)
+	}
+	buf.WriteString(CLEAR_BELOW)
+	lp.isLastPrompt = false
+	lp.cursorRow = 0
+}
+
+// cursorAt returns the row and the column after writing s from the start of a row, the terminal
+// wraps the rows at the width, zero width is no wrapping. The column is the width after a full row.
+func cursorAt(s string, width int) (int, int) {
+	row, col := 0, 0
+	for _, r := range s {
+		if r == '\n' {
+			row, col = row+1, 0
+			continue
+		}
+		w := runeWidth(r)
+		if width > 0 && col+w > width {
+			row, col = row+1, 0
+		}
+		col += w
+	}
+	return row, col
+}
+
+// closePromptLine removes the prompt, so the output after Start continues on a clean line,
+// and turns the bracketed paste off
+func (lp *LogPrompt) closePromptLine() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.write(disableBracketedPaste)
+	if lp.screen != nil && lp.screen.active {
+		lp.write(leaveAltScreen)
+		lp.screen.active = false
+		lp.isLastPrompt = false
+	}
+	buf := strings.Builder{}
+	lp.clearPromptLocked(&buf)
+	lp.write(buf.String())
 }
 
 // implements logger.Logger interface
@@ -164,19 +551,25 @@ func (l *logPromptLogger) Log(message string, args ...any) {
 }
 
 func (l *logPromptLogger) Info(message string, args ...any) {
-	l.logRaw(true, "INFO", l.svcName, message, args...)
+	if l.enabled(slog.LevelInfo) {
+		l.logRaw(true, "INFO", l.svcName, message, args...)
+	}
 }
 
 func (l *logPromptLogger) Error(message string, args ...any) {
-	l.logRaw(true, "ERROR", l.svcName, message, args...)
+	if l.enabled(slog.LevelError) {
+		l.logRaw(true, "ERROR", l.svcName, message, args...)
+	}
 }
 
 func (l *logPromptLogger) Warn(message string, args ...any) {
-	l.logRaw(true, "WARN", l.svcName, message, args...)
+	if l.enabled(slog.LevelWarn) {
+		l.logRaw(true, "WARN", l.svcName, message, args...)
+	}
 }
 
 func (l *logPromptLogger) Debug(message string, args ...any) {
-	if l.debugEnabled {
+	if l.enabled(slog.LevelDebug) {
 		l.logRaw(true, "DEBUG", l.svcName, message, args...)
 	}
 }
@@ -0,0 +1,55 @@
+package log_prompt
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogPrompt(t *testing.T) {
+	t.Run("piped input is read line by line", func(t *testing.T) {
+		lp := NewLogPrompt(context.Background(), "> ")
+		done := make(chan error)
+		go func() { done <- lp.readLines(strings.NewReader("listen 5000\nconnect localhost:6000\n")) }()
+		lines := []string{<-lp.Prompts(), <-lp.Prompts()}
+		if expected := []string{"listen 5000", "connect localhost:6000"}; !slices.Equal(lines, expected) {
+			t.Errorf("Expected %v, got %v", expected, lines)
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("stop interrupts the reading", func(t *testing.T) {
+		lp := NewLogPrompt(context.Background(), "> ")
+		r, w := io.Pipe()
+		defer w.Close()
+		done := make(chan error)
+		go func() { done <- lp.readLines(r) }()
+		lp.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the reading to stop")
+		}
+	})
+
+	t.Run("ctrl+d deletes the character or quits on the empty line", func(t *testing.T) {
+		lp := NewLogPrompt(context.Background(), "> ")
+		lp.line.set("ab")
+		lp.line.home()
+		if _, action := lp.handleKeyLocked(key{code: keyRune, r: keyCtrlD}); action != actionNone || lp.line.String() != "b" {
+			t.Errorf("Expected the deleted character, got %q", lp.line.String())
+		}
+		lp.line.set("")
+		if _, action := lp.handleKeyLocked(key{code: keyRune, r: keyCtrlD}); action != actionQuit {
+			t.Error("Expected Ctrl+D to quit on the empty line")
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package log_prompt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// LogChat is the chat of the Screen with the log lines
+	LogChat = "log"
+	// maxChatLines is the number of the lines kept for scrolling in every chat
+	maxChatLines = 1000
+	// resizeInterval is how often the terminal size is checked, Terminal has no resize events
+	resizeInterval = 250 * time.Millisecond
+
+	enterAltScreen = "\x1b[?1049h\x1b[2J"
+	leaveAltScreen = "\x1b[?1049l"
+	reverseVideo   = "\x1b[7m"
+	resetVideo     = "\x1b[0m"
+)
+
+// Screen is the full-screen mode of the LogPrompt: the sidebar with the chats and
+// their unread counts, the messages of the selected chat, the status bar and the input
+// line at the bottom. The log lines go to the LogChat. Alt+Up/Down select the chat,
+// the sidebar scrolls to keep it visible, PageUp/PageDown scroll its messages.
+// Screen's state is guarded by the LogPrompt's mu.
+type Screen struct {
+	lp         *LogPrompt
+	chats      []*chat
+	selected   int
+	sidebarTop int // index of the first chat shown in the sidebar
+	status     string
+	width      int
+	height     int
+	active     bool // the alternate screen is shown, between Start and its return
+}
+
+type chat struct {
+	name   string
+	lines  []string
+	unread int
+	scroll int // rows scrolled up from the bottom
+}
+
+// EnableScreen switches the LogPrompt to the full-screen mode, it must be called before Start
+func (lp *LogPrompt) EnableScreen() (*Screen, error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if !lp.interactive {
+		return nil, errors.New("full-screen mode needs a terminal")
+	}
+	if lp.screen == nil {
+		lp.screen = &Screen{lp: lp, chats: []*chat{{name: LogChat}}, width: 80, height: 24}
+	}
+	return lp.screen, nil
+}
+
+// SetChats sets the chats in the sidebar after the LogChat, keeping the messages of the existing ones.
+// The chats not in the names stay after them if they have messages, i.e. the rooms left.
+func (s *Screen) SetChats(names []string) {
+	s.lp.mu.Lock()
+	defer s.lp.mu.Unlock()
+	selected := s.chats[s.selected].name
+	chats := []*chat{s.chats[0]}
+	for _, name := range names {
+		if name == LogChat || slices.ContainsFunc(chats, func(c *chat) bool { return c.name == name }) {
+			continue
+		}
+		if c := s.findLocked(name); c != nil {
+			chats = append(chats, c)
+		} else {
+			chats = append(chats, &chat{name: name})
+		}
+	}
+	for _, c := range s.chats[1:] {
+		if (len(c.lines) > 0 || c.unread > 0) && !slices.Contains(chats, c) {
+			chats = append(chats, c)
+		}
+	}
+	s.chats = chats
+	s.selected = max(s.indexLocked(selected), 0)
+	s.lp.redrawScreenLocked()
+}
+
+// AddMessage adds the line to the chat, the chat is added to the sidebar if it's not there
+func (s *Screen) AddMessage(chatName string, text string) {
+	s.lp.mu.Lock()
+	defer s.lp.mu.Unlock()
+	s.addLocked(chatName, text)
+	s.lp.redrawScreenLocked()
+}
+
+// SetStatus sets the text of the status bar, i.e. the connection state
+func (s *Screen) SetStatus(status string) {
+	s.lp.mu.Lock()
+	defer s.lp.mu.Unlock()
+	s.status = status
+	s.lp.redrawScreenLocked()
+}
+
+// Selected returns the name of the chat shown in the message pane
+func (s *Screen) Selected() string {
+	s.lp.mu.Lock()
+	defer s.lp.mu.Unlock()
+	return s.chats[s.selected].name
+}
+
+func (s *Screen) addLocked(chatName string, text string) {
+	c := s.findLocked(chatName)
+	if c == nil {
+		c = &chat{name: chatName}
+		s.chats = append(s.chats, c)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		c.lines = append(c.lines, line)
+		// keep the scrolled view in place
+		if c.scroll > 0 {
+			c.scroll += len(wrapLine(line, s.messageWidth()))
+		}
+	}
+	if len(c.lines) > maxChatLines {
+		c.lines = slices.Delete(c.lines, 0, len(c.lines)-maxChatLines)
+	}
+	if c != s.chats[s.selected] {
+		c.unread++
+	}
+}
+
+func (s *Screen) findLocked(name string) *chat {
+	if i := s.indexLocked(name); i >= 0 {
+		return s.chats[i]
+	}
+	return nil
+}
+
+func (s *Screen) indexLocked(name string) int {
+	return slices.IndexFunc(s.chats, func(c *chat) bool { return c.name == name })
+}
+
+// handleKeyLocked handles the keys of the full-screen mode, it returns false for the other keys
+func (s *Screen) handleKeyLocked(k key) bool {
+	c := s.chats[s.selected]
+	switch k.code {
+	case keyModUp:
+		s.selectLocked((s.selected - 1 + len(s.chats)) % len(s.chats))
+	case keyModDown:
+		s.selectLocked((s.selected + 1) % len(s.chats))
+	case keyPageUp:
+		c.scroll += s.bodyHeight() - 1
+	case keyPageDown:
+		c.scroll = max(c.scroll-(s.bodyHeight()-1), 0)
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Screen) selectLocked(i int) {
+	s.selected = i
+	s.chats[i].unread = 0
+}
+
+// resizeLocked updates the size, it returns false if the size didn't change
+func (s *Screen) resizeLocked() bool {
+	width, height, err := s.lp.terminal.Size()
+	if err != nil || (width == s.width && height == s.height) {
+		return false
+	}
+	s.width, s.height = width, height
+	return true
+}
+
+func (s *Screen) bodyHeight() int {
+	// the status bar and the input line are below the body
+	return max(s.height-2, 1)
+}
+
+func (s *Screen) sidebarWidth() int {
+	return min(max(s.width/4, 10), 24)
+}
+
+func (s *Screen) messageWidth() int {
+	// the sidebar is separated from the messages with a vertical line
+	return max(s.width-s.sidebarWidth()-1, 1)
+}
+
+// rowsLocked returns the rows above the input line: the sidebar with the messages and the status bar
+func (s *Screen) rowsLocked() []string {
+	height, sidebarWidth := s.bodyHeight(), s.sidebarWidth()
+	messages := s.messageRowsLocked(height)
+	// scroll the sidebar to the selected chat
+	s.sidebarTop = min(s.sidebarTop, s.selected, max(len(s.chats)-height, 0))
+	s.sidebarTop = max(s.sidebarTop, s.selected-height+1)
+	rows := make([]string, 0, height+1)
+	for row := 0; row < height; row++ {
+		entry := ""
+		if i := s.sidebarTop + row; i < len(s.chats) {
+			c := s.chats[i]
+			marker := "  "
+			if i == s.selected {
+				marker = "> "
+			}
+			unread := ""
+			if c.unread > 0 {
+				unread = fmt.Sprintf(" (%d)", c.unread)
+			}
+			entry = marker + truncate(c.name, sidebarWidth-len(marker)-len(unread)) + unread
+		}
+		message := ""
+		if row < len(messages) {
+			message = messages[row]
+		}
+		rows = append(rows, pad(entry, sidebarWidth)+"│"+message)
+	}
+	status := s.status
+	if c := s.chats[s.selected]; c.scroll > 0 {
+		status += fmt.Sprintf(" | %s scrolled up %d", c.name, c.scroll)
+	}
+	return append(rows, pad(truncate(status, s.width), s.width))
+}
+
+// messageRowsLocked wraps the last lines of the selected chat into the rows of the message pane
+func (s *Screen) messageRowsLocked(height int) []string {
+	c, width := s.chats[s.selected], s.messageWidth()
+	rows := []string{}
+	for i := len(c.lines) - 1; i >= 0 && len(rows) < height+c.scroll; i-- {
+		rows = append(wrapLine(c.lines[i], width), rows...)
+	}
+	c.scroll = min(c.scroll, max(len(rows)-height, 0))
+	rows = rows[:len(rows)-c.scroll]
+	return rows[max(len(rows)-height, 0):]
+}
+
+// redrawScreenLocked draws the whole screen with the prompt, it's a no-op until Start shows the screen
+func (lp *LogPrompt) redrawScreenLocked() {
+	s := lp.screen
+	if !s.active {
+		return
+	}
+	buf := strings.Builder{}
+	for i, row := range s.rowsLocked() {
+		fmt.Fprintf(&buf, "\x1b[%d;1H\x1b[K", i+1)
+		if i == s.bodyHeight() {
+			row = reverseVideo + row + resetVideo
+		}
+		buf.WriteString(row)
+	}
+	fmt.Fprintf(&buf, "\x1b[%d;1H", s.height)
+	lp.renderPromptLocked(&buf)
+	lp.write(buf.String())
+}
+
+// openScreenLocked switches the terminal to the alternate screen, so the screen
+// before Start is restored by closePromptLine
+func (lp *LogPrompt) openScreenLocked() {
+	s := lp.screen
+	s.active = true
+	s.resizeLocked()
+	lp.write(enterAltScreen)
+	lp.redrawScreenLocked()
+}
+
+// wrapLine splits the line into the rows of the width terminal cells
+func wrapLine(line string, width int) []string {
+	rows := []string{}
+	row, rowWidth := strings.Builder{}, 0
+	for _, r := range line {
+		if w := runeWidth(r); rowWidth > 0 && rowWidth+w > width {
+			rows = append(rows, row.String())
+			row.Reset()
+			rowWidth = 0
+		}
+		row.WriteRune(r)
+		rowWidth += runeWidth(r)
+	}
+	return append(rows, row.String())
+}
+
+// truncate cuts s to the width terminal cells
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	return wrapLine(s, width)[0]
+}
+
+// pad fills s with spaces up to the width terminal cells
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", max(width-stringWidth(s), 0))
+}
@@ -0,0 +1,123 @@
+package log_prompt
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScreen(t *testing.T) {
+	newScreen := func(t *testing.T, width, height int) *Screen {
+		term, _ := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		s, err := lp.EnableScreen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.width, s.height = width, height
+		return s
+	}
+	sidebar := func(rows []string) []string {
+		entries := []string{}
+		for _, row := range rows[:len(rows)-1] {
+			if entry := strings.TrimSpace(strings.Split(row, "│")[0]); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	t.Run("unread counts are shown until the chat is selected", func(t *testing.T) {
+		s := newScreen(t, 80, 10)
+		s.SetChats([]string{"general", "#news"})
+		s.AddMessage("general", "alice: hi")
+		s.AddMessage("general", "bob: hello")
+		s.AddMessage("#news", "carol: news")
+		if expected := []string{"> log", "general (2)", "#news (1)"}; !slices.Equal(sidebar(s.rowsLocked()), expected) {
+			t.Fatalf("Expected %q, got %q", expected, sidebar(s.rowsLocked()))
+		}
+
+		s.handleKeyLocked(key{code: keyModDown})
+		rows := s.rowsLocked()
+		if expected := []string{"log", "> general", "#news (1)"}; !slices.Equal(sidebar(rows), expected) {
+			t.Fatalf("Expected %q, got %q", expected, sidebar(rows))
+		}
+		if !strings.HasSuffix(rows[0], "│alice: hi") || !strings.HasSuffix(rows[1], "│bob: hello") {
+			t.Errorf("Expected the messages of the selected chat, got %q", rows[:2])
+		}
+		if s.Selected() != "general" {
+			t.Errorf("Expected the selected chat, got %q", s.Selected())
+		}
+	})
+
+	t.Run("chats keep their messages when the list changes", func(t *testing.T) {
+		s := newScreen(t, 80, 10)
+		s.SetChats([]string{"one", "two"})
+		s.AddMessage("two", "hello")
+		s.handleKeyLocked(key{code: keyModUp})
+		s.SetChats([]string{"two"})
+		if s.Selected() != "two" || len(s.chats) != 2 || s.chats[1].lines[0] != "hello" {
+			t.Errorf("Expected chat %q with its messages selected, got %q", "two", s.Selected())
+		}
+	})
+
+	t.Run("chats with messages are kept when they're removed from the list", func(t *testing.T) {
+		s := newScreen(t, 80, 10)
+		s.SetChats([]string{"one", "two", "three"})
+		s.AddMessage("two", "hello")
+		s.AddMessage("@alice", "hi")
+		s.SetChats([]string{"three"})
+		if expected := []string{"> log", "three", "two (1)", "@alice (1)"}; !slices.Equal(sidebar(s.rowsLocked()), expected) {
+			t.Errorf("Expected %q, got %q", expected, sidebar(s.rowsLocked()))
+		}
+	})
+
+	t.Run("sidebar scrolls to the selected chat", func(t *testing.T) {
+		// 3 rows of the sidebar
+		s := newScreen(t, 80, 5)
+		s.SetChats([]string{"one", "two", "three", "four"})
+		for range 4 {
+			s.handleKeyLocked(key{code: keyModDown})
+		}
+		if expected := []string{"two", "three", "> four"}; !slices.Equal(sidebar(s.rowsLocked()), expected) {
+			t.Fatalf("Expected %q, got %q", expected, sidebar(s.rowsLocked()))
+		}
+		s.handleKeyLocked(key{code: keyModDown})
+		if expected := []string{"> log", "one", "two"}; !slices.Equal(sidebar(s.rowsLocked()), expected) {
+			t.Errorf("Expected the sidebar scrolled back to the top, got %q", sidebar(s.rowsLocked()))
+		}
+	})
+
+	t.Run("long lines are wrapped and scrolled with the page keys", func(t *testing.T) {
+		// 5 rows of messages, 29 cells wide
+		s := newScreen(t, 40, 7)
+		for _, line := range []string{"one", "two", "three", strings.Repeat("x", 40), "four", "five"} {
+			s.AddMessage(LogChat, line)
+		}
+		messages := func() []string {
+			msgs := []string{}
+			for _, row := range s.rowsLocked()[:s.bodyHeight()] {
+				msgs = append(msgs, strings.Split(row, "│")[1])
+			}
+			return msgs
+		}
+		if expected := []string{"three", strings.Repeat("x", 29), strings.Repeat("x", 11), "four", "five"}; !slices.Equal(messages(), expected) {
+			t.Fatalf("Expected %q, got %q", expected, messages())
+		}
+
+		s.handleKeyLocked(key{code: keyPageUp})
+		if expected := []string{"one", "two", "three", strings.Repeat("x", 29), strings.Repeat("x", 11)}; !slices.Equal(messages(), expected) {
+			t.Fatalf("Expected the scrolled up messages %q, got %q", expected, messages())
+		}
+		s.AddMessage(LogChat, "six")
+		if messages()[0] != "one" {
+			t.Errorf("Expected the scrolled view kept in place, got %q", messages())
+		}
+		s.handleKeyLocked(key{code: keyPageDown})
+		s.handleKeyLocked(key{code: keyPageDown})
+		if msgs := messages(); msgs[len(msgs)-1] != "six" {
+			t.Errorf("Expected the newest messages, got %q", msgs)
+		}
+	})
+}
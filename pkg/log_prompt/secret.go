@@ -0,0 +1,96 @@
+package log_prompt
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrSecretCancelled is returned by ReadSecret if the input is cancelled with Ctrl+C, Ctrl+D or Esc
+	ErrSecretCancelled = errors.New("secret input cancelled")
+	// ErrStopped is returned by ReadSecret if the LogPrompt is stopped or its input ended
+	ErrStopped = errors.New("log prompt stopped")
+)
+
+// secretInput is the ReadSecret in progress, it replaces the input line
+// until the secret is entered
+type secretInput struct {
+	prompt string
+	line   lineEditor
+	result chan secretResult
+}
+
+type secretResult struct {
+	value string
+	err   error
+}
+
+// ReadSecret reads a password or a passphrase: the input is masked, and the entered
+// value is returned to the caller only, it never gets into the Prompts channel, the history
+// or the logs. The input line typed before the call is restored after it. If the input
+// isn't a terminal, the next line of the input is the secret.
+func (lp *LogPrompt) ReadSecret(ctx context.Context, prompt string) (string, error) {
+	s := &secretInput{prompt: prompt, result: make(chan secretResult, 1)}
+	if lp.interactive {
+		lp.mu.Lock()
+		if lp.secret != nil {
+			lp.mu.Unlock()
+			return "", errors.New("another secret is being read")
+		}
+		lp.secret = s
+		lp.printPromptLineLocked()
+		lp.mu.Unlock()
+		defer lp.endSecret(s)
+	} else {
+		select {
+		case lp.secretReqs <- s:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-lp.ctx.Done():
+			return "", ErrStopped
+		}
+	}
+	select {
+	case result := <-s.result:
+		return result.value, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-lp.ctx.Done():
+		return "", ErrStopped
+	}
+}
+
+// endSecret restores the input line, unless the secret is already entered
+func (lp *LogPrompt) endSecret(s *secretInput) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.secret == s {
+		lp.secret = nil
+		lp.printPromptLineLocked()
+	}
+	s.line.clear()
+}
+
+// handleSecretKeyLocked edits the secret, the keys other than editing ones are ignored
+func (lp *LogPrompt) handleSecretKeyLocked(k key) {
+	s := lp.secret
+	var result *secretResult
+	switch {
+	case k.code == keyEnter:
+		result = &secretResult{value: s.line.String()}
+	case k.isCtrl(keyCtrlC), k.isCtrl(keyCtrlD) && len(s.line.buf) == 0, k.code == keyEscape:
+		result = &secretResult{err: ErrSecretCancelled}
+	case k.isCtrl(keyCtrlD):
+		s.line.delete()
+	default:
+		s.line.handleKey(k)
+	}
+	if result != nil {
+		lp.secret = nil
+		s.result <- *result
+		// the prompt stays above without the secret
+		lp.printAboveLocked(s.prompt)
+		return
+	}
+	lp.printPromptLineLocked()
+}
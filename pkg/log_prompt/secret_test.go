@@ -0,0 +1,97 @@
+package log_prompt
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSecret(t *testing.T) {
+	waitScreen := func(t *testing.T, term *fakeTerminal, current string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, line := term.screen(); line != current; _, line = term.screen() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q on the screen, got %q", current, line)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	type secretResult struct {
+		value string
+		err   error
+	}
+	readSecret := func(lp *LogPrompt) <-chan secretResult {
+		result := make(chan secretResult, 1)
+		go func() {
+			value, err := lp.ReadSecret(context.Background(), "Password: ")
+			result <- secretResult{value, err}
+		}()
+		return result
+	}
+
+	t.Run("secret is masked and kept out of the prompts and the history", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		go lp.Start()
+		defer lp.Stop()
+
+		keysWriter.Write([]byte("peers"))
+		waitScreen(t, term, "> peers")
+		result := readSecret(lp)
+		waitScreen(t, term, "Password: ")
+		keysWriter.Write([]byte("s3cret\x7fT\r"))
+		if r := <-result; r.err != nil || r.value != "s3creT" {
+			t.Fatalf("Expected the secret, got %q %v", r.value, r.err)
+		}
+		waitScreen(t, term, "> peers")
+
+		lines, _ := term.screen()
+		if slices.ContainsFunc(lines, func(line string) bool { return strings.Contains(line, "s3cre") }) {
+			t.Errorf("Expected the masked secret, got %q", lines)
+		}
+		if !slices.Contains(lines, "Password: ") {
+			t.Errorf("Expected the secret's prompt above the input, got %q", lines)
+		}
+		if len(lp.history.entries) != 0 {
+			t.Errorf("Expected no history, got %q", lp.history.entries)
+		}
+	})
+
+	t.Run("ctrl+c cancels the secret input", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		go lp.Start()
+		defer lp.Stop()
+
+		result := readSecret(lp)
+		waitScreen(t, term, "Password: ")
+		keysWriter.Write([]byte("abc\x03"))
+		if r := <-result; !errors.Is(r.err, ErrSecretCancelled) {
+			t.Errorf("Expected the cancelled input, got %q %v", r.value, r.err)
+		}
+	})
+
+	t.Run("secret is the next line of the non-terminal input", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(false)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		go lp.Start()
+		go keysWriter.Write([]byte("unlock\npassword\npeers\n"))
+
+		if prompt := <-lp.Prompts(); prompt != "unlock" {
+			t.Fatalf("Expected the command, got %q", prompt)
+		}
+		if r := <-readSecret(lp); r.err != nil || r.value != "password" {
+			t.Fatalf("Expected the secret, got %q %v", r.value, r.err)
+		}
+		if prompt := <-lp.Prompts(); prompt != "peers" {
+			t.Errorf("Expected the next command, got %q", prompt)
+		}
+		keysWriter.Close()
+		if r := <-readSecret(lp); !errors.Is(r.err, ErrStopped) {
+			t.Errorf("Expected the stopped error after the end of the input, got %q %v", r.value, r.err)
+		}
+	})
+}
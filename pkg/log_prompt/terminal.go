@@ -0,0 +1,70 @@
+package log_prompt
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Terminal is the I/O of the LogPrompt: the key strokes are read from it and
+// the log lines with the prompt are written to it. It may be the process' stdin
+// and stdout, a pty, an SSH session's channel or scripted key strokes in the tests.
+type Terminal interface {
+	io.Reader
+	io.Writer
+	// IsTerminal reports whether the input can be edited in the raw mode,
+	// otherwise the LogPrompt reads it line by line
+	IsTerminal() bool
+	// MakeRaw makes every key stroke readable without echo, restore returns the previous mode
+	MakeRaw() (restore func() error, err error)
+	// Size returns the visible width and height in characters
+	Size() (width, height int, err error)
+}
+
+// fileTerminal is the Terminal of the files, i.e. os.Stdin and os.Stdout, or a pty
+type fileTerminal struct {
+	in  *os.File
+	out *os.File
+}
+
+// NewFileTerminal returns the Terminal reading from in and writing to out,
+// the raw mode and the size are of in, if it's a terminal
+func NewFileTerminal(in *os.File, out *os.File) Terminal {
+	return &fileTerminal{in: in, out: out}
+}
+
+// StdTerminal returns the Terminal of os.Stdin and os.Stdout
+func StdTerminal() Terminal {
+	return NewFileTerminal(os.Stdin, os.Stdout)
+}
+
+func (t *fileTerminal) Read(p []byte) (int, error) {
+	return t.in.Read(p)
+}
+
+func (t *fileTerminal) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+func (t *fileTerminal) IsTerminal() bool {
+	return term.IsTerminal(int(t.in.Fd()))
+}
+
+func (t *fileTerminal) MakeRaw() (func() error, error) {
+	fd := int(t.in.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make the terminal raw: %w", err)
+	}
+	return func() error { return term.Restore(fd, state) }, nil
+}
+
+func (t *fileTerminal) Size() (int, int, error) {
+	width, height, err := term.GetSize(int(t.in.Fd()))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get the terminal size: %w", err)
+	}
+	return width, height, nil
+}
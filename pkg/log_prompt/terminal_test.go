@@ -0,0 +1,303 @@
+package log_prompt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTerminal reads the scripted key strokes and keeps the rows written by LogPrompt.
+// It understands the control sequences LogPrompt uses, the rows are never wrapped.
+type fakeTerminal struct {
+	keys        *io.PipeReader
+	interactive bool
+	mu          sync.Mutex
+	raw         bool
+	rows        [][]rune
+	row         int
+	col         int
+}
+
+// newFakeTerminal returns the terminal and the writer of its key strokes
+func newFakeTerminal(interactive bool) (*fakeTerminal, *io.PipeWriter) {
+	keys, keysWriter := io.Pipe()
+	return &fakeTerminal{keys: keys, interactive: interactive, rows: [][]rune{{}}}, keysWriter
+}
+
+func (t *fakeTerminal) Read(p []byte) (int, error) {
+	return t.keys.Read(p)
+}
+
+func (t *fakeTerminal) IsTerminal() bool {
+	return t.interactive
+}
+
+func (t *fakeTerminal) MakeRaw() (func() error, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.raw = true
+	return func() error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.raw = false
+		return nil
+	}, nil
+}
+
+func (t *fakeTerminal) Size() (int, int, error) {
+	return 80, 24, nil
+}
+
+func (t *fakeTerminal) isRaw() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.raw
+}
+
+func (t *fakeTerminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := string(p)
+	for len(s) > 0 {
+		switch {
+		case s[0] == '\r':
+			t.col = 0
+			s = s[1:]
+		case s[0] == '\n':
+			// the raw mode terminal moves to the next line without returning the carriage
+			t.row++
+			if t.row == len(t.rows) {
+				t.rows = append(t.rows, []rune{})
+			}
+			s = s[1:]
+		case strings.HasPrefix(s, "\x1b["):
+			end := strings.IndexFunc(s[2:], func(r rune) bool { return r >= 0x40 && r <= 0x7e }) + 2
+			n, _ := strconv.Atoi(s[2:end])
+			switch s[end] {
+			case 'K':
+				t.rows[t.row] = t.rows[t.row][:min(t.col, len(t.rows[t.row]))]
+			case 'J':
+				t.rows[t.row] = t.rows[t.row][:min(t.col, len(t.rows[t.row]))]
+				t.rows = t.rows[:t.row+1]
+			case 'A':
+				t.row = max(t.row-n, 0)
+			case 'D':
+				t.col = max(t.col-n, 0)
+			case 'C':
+				t.col += n
+			case 'm':
+				// keep the colors in the text
+				t.put([]rune(s[:end+1])...)
+			}
+			s = s[end+1:]
+		default:
+			r := []rune(s)[0]
+			t.put(r)
+			s = s[len(string(r)):]
+		}
+	}
+	return len(p), nil
+}
+
+func (t *fakeTerminal) put(runes ...rune) {
+	for _, r := range runes {
+		for len(t.rows[t.row]) < t.col {
+			t.rows[t.row] = append(t.rows[t.row], ' ')
+		}
+		if t.col < len(t.rows[t.row]) {
+			t.rows[t.row][t.col] = r
+		} else {
+			t.rows[t.row] = append(t.rows[t.row], r)
+		}
+		t.col++
+	}
+}
+
+// screen returns the rows above the cursor and the cursor's row
+func (t *fakeTerminal) screen() ([]string, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := []string{}
+	for _, row := range t.rows[:t.row] {
+		lines = append(lines, string(row))
+	}
+	return lines, string(t.rows[t.row])
+}
+
+// cursor returns all the rows with the cursor position
+func (t *fakeTerminal) cursor() ([]string, int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows := []string{}
+	for _, row := range t.rows {
+		rows = append(rows, string(row))
+	}
+	return rows, t.row, t.col
+}
+
+func TestTerminal(t *testing.T) {
+	t.Run("scripted key strokes are edited in the raw mode", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		done := make(chan error)
+		go func() { done <- lp.Start() }()
+
+		// "helo", Left, "l", Enter
+		go keysWriter.Write([]byte("helo\x1b[Dl\r"))
+		if input := <-lp.Prompts(); input != "hello" {
+			t.Errorf("Expected the edited input, got %q", input)
+		}
+		if !term.isRaw() {
+			t.Error("Expected the raw mode while the prompt is started")
+		}
+		// "peers", Ctrl+U, Ctrl+D
+		go keysWriter.Write([]byte("peers\x15\x04"))
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if term.isRaw() {
+			t.Error("Expected the terminal mode restored")
+		}
+		if lines, _ := term.screen(); !slices.Contains(lines, "> hello") {
+			t.Errorf("Expected the entered line on the screen, got %q", lines)
+		}
+	})
+
+	t.Run("input of a non-terminal is read line by line", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(false)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		done := make(chan error)
+		go func() { done <- lp.Start() }()
+
+		go func() {
+			keysWriter.Write([]byte("peers\x1b[D\n"))
+			keysWriter.Close()
+		}()
+		if input := <-lp.Prompts(); input != "peers\x1b[D" {
+			t.Errorf("Expected the raw line, got %q", input)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if term.isRaw() {
+			t.Error("Expected no raw mode")
+		}
+	})
+}
+
+func TestMultiLineInput(t *testing.T) {
+	t.Run("multi-line input is redrawn on its own rows and entered as one prompt", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		go lp.Start()
+		defer lp.Stop()
+		waitRows := func(expected []string, col int) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				rows, row, c := term.cursor()
+				if len(rows) >= len(expected) && slices.Equal(rows[len(rows)-len(expected):], expected) &&
+					row == len(rows)-1 && c == col {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected %q with the cursor at %d, got %q at %d:%d", expected, col, rows, row, c)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// "one", Alt+Enter, "two", Left, Left
+		keysWriter.Write([]byte("one\x1b\rtwo\x1b[D\x1b[D"))
+		waitRows([]string{"> one", "  two"}, 3)
+		// End, the pasted line break isn't Enter
+		keysWriter.Write([]byte("\x1b[F\x1b[200~\nthree\x1b[201~"))
+		waitRows([]string{"> one", "  two", "  three"}, 7)
+
+		go keysWriter.Write([]byte("\r"))
+		if prompt := <-lp.Prompts(); prompt != "one\ntwo\nthree" {
+			t.Fatalf("Expected the whole input in one prompt, got %q", prompt)
+		}
+		waitRows([]string{"> one", "  two", "  three", "> "}, 2)
+
+		// Ctrl+U removes the rows of the multi-line input
+		keysWriter.Write([]byte("x\x1b\ry"))
+		waitRows([]string{"  three", "> x", "  y"}, 3)
+		keysWriter.Write([]byte("\x15"))
+		waitRows([]string{"  three", "> "}, 2)
+	})
+
+	t.Run("rows wrapped by the terminal are counted", func(t *testing.T) {
+		tests := []struct {
+			s        string
+			row, col int
+		}{
+			{"> hello", 0, 7},
+			{"> " + strings.Repeat("x", 78), 0, 80},
+			{"> " + strings.Repeat("x", 79), 1, 1},
+			{"> one\n  " + strings.Repeat("世", 40), 2, 2},
+		}
+		for _, test := range tests {
+			if row, col := cursorAt(test.s, 80); row != test.row || col != test.col {
+				t.Errorf("Expected %d:%d after %q, got %d:%d", test.row, test.col, test.s, row, col)
+			}
+		}
+	})
+}
+
+func TestConcurrentOutput(t *testing.T) {
+	t.Run("log lines from many goroutines never mix with the prompt", func(t *testing.T) {
+		term, keysWriter := newFakeTerminal(true)
+		lp := NewTerminalLogPrompt(context.Background(), "> ", term)
+		done := make(chan error)
+		go func() { done <- lp.Start() }()
+
+		const workers, linesPerWorker = 8, 50
+		wg := sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				logger := lp.NewLogger(fmt.Sprintf("worker%d", w))
+				for i := 0; i < linesPerWorker; i++ {
+					logger.Log(fmt.Sprintf("worker %d line %d", w, i))
+				}
+			}()
+		}
+		for _, c := range "hello" {
+			keysWriter.Write([]byte(string(c)))
+		}
+		wg.Wait()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for _, current := term.screen(); current != "> hello"; _, current = term.screen() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the prompt with the typed input, got %q", current)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		lines, _ := term.screen()
+		seen := map[string]bool{}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			var w, i int
+			if _, err := fmt.Sscanf(line, "worker %d line %d", &w, &i); err != nil || line != fmt.Sprintf("worker %d line %d", w, i) {
+				t.Fatalf("Unexpected line on the screen: %q", line)
+			}
+			seen[line] = true
+		}
+		if len(seen) != workers*linesPerWorker {
+			t.Errorf("Expected %d log lines, got %d", workers*linesPerWorker, len(seen))
+		}
+
+		lp.Stop()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -98,16 +98,28 @@ func (l logger) Log(msg string, args ...any) {
 	l.Logger.Info(msg, args...)
 }
 
-func NewSlogLogger(serviceName string) logger {
-	debugMode := os.Getenv("LOG_LEVEL") == "debug"
-	useJSON := os.Getenv("LOG_TYPE") == "json"
-	logLevel := slog.LevelInfo
+// ParseLevel parses the level name case-insensitively: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid log level %q: %w", name, err)
+	}
+	return level, nil
+}
 
-	if debugMode {
-		logLevel = slog.LevelDebug
+// EnvLevel is the level from the LOG_LEVEL env var, info if it's not set or invalid
+func EnvLevel() slog.Level {
+	level, err := ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return slog.LevelInfo
 	}
+	return level
+}
+
+func NewSlogLogger(serviceName string) logger {
+	useJSON := os.Getenv("LOG_TYPE") == "json"
 	opts := &slog.HandlerOptions{
-		Level:     logLevel,
+		Level:     EnvLevel(),
 		AddSource: false,
 	}
 
@@ -0,0 +1,216 @@
+// names is the decentralized DNS for the public keys: human-readable names
+// are mapped to the node's public key (and so to its node id) and addresses.
+//
+// A name record is signed by the node's identity and stored in the DHT
+// under dht.KeyFor("name:" + name). Any node can verify the record by its signature,
+// so the nodes storing the record can't forge it. The name belongs to the key
+// of the earliest registered record (ties are broken by the smaller public key):
+// until the record expires it can be replaced only by a record signed by the same key,
+// the one expiring later. Every node picks the same record regardless of the order
+// it has received them in.
+//
+// Simplifications (KISS): the names are first come, first served, the registration
+// time is claimed by the owner in the signed record and kept by the refreshes,
+// and a name is free again once its owner stops refreshing the record.
+package names
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/dht"
+	"github.com/ulshv/nexuslink/pkg/identity"
+)
+
+const (
+	DefaultTTL = 24 * time.Hour
+	// MaxTTL limits the expiry of the records, so a name can't be held without refreshing
+	MaxTTL       = 7 * 24 * time.Hour
+	maxClockSkew = 5 * time.Minute
+	maxAddrs     = 8
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+type Record struct {
+	Name      string   `json:"name"`
+	PublicKey []byte   `json:"public_key"`
+	Addrs     []string `json:"addrs,omitempty"`
+	Expires   int64    `json:"expires"` // unix seconds
+	// Registered is the time of the first registration of the name by the key, unix seconds
+	Registered int64  `json:"registered"`
+	Seq        uint64 `json:"seq"`
+	Signature  []byte `json:"signature,omitempty"`
+}
+
+// NewRecord creates the record signed by the identity. Seq must grow
+// with every new version of the record, i.e. the current unix time in ms.
+func NewRecord(ident *identity.Identity, name string, addrs []string, ttl time.Duration, seq uint64) (*Record, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	if len(addrs) > maxAddrs {
+		return nil, fmt.Errorf("too many addresses, max is %d", maxAddrs)
+	}
+	if ttl > MaxTTL {
+		return nil, fmt.Errorf("ttl %s is longer than the max %s", ttl, MaxTTL)
+	}
+	now := time.Now()
+	record := &Record{
+		Name:       name,
+		PublicKey:  ident.PublicKey,
+		Addrs:      addrs,
+		Expires:    now.Add(ttl).Unix(),
+		Registered: now.Unix(),
+		Seq:        seq,
+	}
+	record.Signature = ident.Sign(record.signedData())
+	return record, nil
+}
+
+// RenewRecord creates the next version of the identity's record prev,
+// keeping its registration time, so the name stays owned by the key
+func RenewRecord(ident *identity.Identity, prev *Record, addrs []string, ttl time.Duration, seq uint64) (*Record, error) {
+	if !bytes.Equal(prev.PublicKey, ident.PublicKey) {
+		return nil, fmt.Errorf("record %q is signed by another key", prev.Name)
+	}
+	record, err := NewRecord(ident, prev.Name, addrs, ttl, seq)
+	if err != nil {
+		return nil, err
+	}
+	record.Registered = min(prev.Registered, record.Registered)
+	record.Signature = ident.Sign(record.signedData())
+	return record, nil
+}
+
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid name %q, expected lowercase letters, digits, '.', '_' or '-'", name)
+	}
+	return nil
+}
+
+// Key returns the DHT key of the name's record
+func Key(name string) dht.ID {
+	return dht.KeyFor([]byte("name:" + name))
+}
+
+// NodeID returns the node id of the name's owner
+func (r *Record) NodeID() string {
+	return identity.NodeIDFromPublicKey(r.PublicKey)
+}
+
+func (r *Record) ExpiresAt() time.Time {
+	return time.Unix(r.Expires, 0)
+}
+
+// Verify checks the name, the signature and the expiry of the record,
+// the expiry must be within MaxTTL (allowing for the clock skew)
+func (r *Record) Verify(now time.Time) error {
+	if err := ValidateName(r.Name); err != nil {
+		return err
+	}
+	if len(r.Addrs) > maxAddrs {
+		return fmt.Errorf("too many addresses, max is %d", maxAddrs)
+	}
+	if !identity.Verify(ed25519.PublicKey(r.PublicKey), r.signedData(), r.Signature) {
+		return fmt.Errorf("invalid signature of the record %q", r.Name)
+	}
+	if now.After(r.ExpiresAt()) {
+		return fmt.Errorf("record %q has expired", r.Name)
+	}
+	if r.ExpiresAt().After(now.Add(MaxTTL + maxClockSkew)) {
+		return fmt.Errorf("record %q expires later than in %s", r.Name, MaxTTL)
+	}
+	if r.Registered <= 0 || time.Unix(r.Registered, 0).After(now.Add(maxClockSkew)) || r.Registered > r.Expires {
+		return fmt.Errorf("invalid registration time of the record %q", r.Name)
+	}
+	return nil
+}
+
+func (r *Record) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func Unmarshal(data []byte) (*Record, error) {
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid name record: %w", err)
+	}
+	return record, nil
+}
+
+// signedData is the JSON of the record without the signature,
+// the order of the fields is fixed by the struct
+func (r *Record) signedData() []byte {
+	unsigned := *r
+	unsigned.Signature = nil
+	data, _ := json.Marshal(unsigned)
+	return data
+}
+
+// Validator is the dht.Validator for the name records
+type Validator struct {
+	nowFunc func() time.Time
+}
+
+func NewValidator() *Validator {
+	return &Validator{nowFunc: time.Now}
+}
+
+// Validate checks that the value is a valid record stored under its name's key
+func (v *Validator) Validate(key dht.ID, value []byte) error {
+	record, err := Unmarshal(value)
+	if err != nil {
+		return err
+	}
+	if Key(record.Name) != key {
+		return fmt.Errorf("record %q is stored under a wrong key", record.Name)
+	}
+	return record.Verify(v.nowFunc())
+}
+
+// Select returns the latest record of the name's owner. The owner is the key of the
+// earliest registered valid record, ties are broken by the smaller public key, so the records
+// signed by other keys can't replace it until it expires. Of the owner's records the one
+// expiring later wins, then the one with the higher sequence number, then the one with
+// the greater signature, so every node picks the same record regardless of the order.
+func (v *Validator) Select(key dht.ID, values [][]byte) int {
+	best := -1
+	var bestRecord *Record
+	for i, value := range values {
+		record, err := Unmarshal(value)
+		if err != nil || Key(record.Name) != key || record.Verify(v.nowFunc()) != nil {
+			continue
+		}
+		if bestRecord == nil || better(record, bestRecord) {
+			best, bestRecord = i, record
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return best
+}
+
+// better reports whether the record a is selected over b, the records are ordered
+// by the registration time, the public key, then the latest version of the key's record
+func better(a, b *Record) bool {
+	if a.Registered != b.Registered {
+		return a.Registered < b.Registered
+	}
+	if c := bytes.Compare(a.PublicKey, b.PublicKey); c != 0 {
+		return c < 0
+	}
+	if a.Expires != b.Expires {
+		return a.Expires > b.Expires
+	}
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return bytes.Compare(a.Signature, b.Signature) > 0
+}
@@ -0,0 +1,160 @@
+package names
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+)
+
+func mustRecord(t *testing.T, ident *identity.Identity, name string, seq uint64) []byte {
+	record, err := NewRecord(ident, name, []string{"10.0.0.1:5000"}, time.Hour, seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := record.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestValidator(t *testing.T) {
+	alice, _ := identity.Generate()
+	mallory, _ := identity.Generate()
+	v := NewValidator()
+
+	t.Run("signed records are valid only under their name's key", func(t *testing.T) {
+		data := mustRecord(t, alice, "alice", 1)
+		if err := v.Validate(Key("alice"), data); err != nil {
+			t.Errorf("Expected the record to be valid, got %s", err)
+		}
+		if err := v.Validate(Key("bob"), data); err == nil {
+			t.Error("Expected the wrong key error")
+		}
+		record, _ := Unmarshal(data)
+		if record.NodeID() != alice.NodeID() {
+			t.Errorf("Expected the record to resolve to %s", alice.NodeID())
+		}
+	})
+
+	t.Run("forged and expired records are rejected", func(t *testing.T) {
+		record, _ := Unmarshal(mustRecord(t, alice, "alice", 1))
+		record.Addrs = []string{"6.6.6.6:5000"}
+		forged, _ := record.Marshal()
+		if err := v.Validate(Key("alice"), forged); err == nil {
+			t.Error("Expected the invalid signature error")
+		}
+		record.PublicKey = mallory.PublicKey
+		forged, _ = record.Marshal()
+		if err := v.Validate(Key("alice"), forged); err == nil {
+			t.Error("Expected the invalid signature error for the replaced key")
+		}
+
+		if _, err := NewRecord(alice, "alice", nil, MaxTTL+time.Hour, 1); err == nil {
+			t.Error("Expected the ttl longer than MaxTTL to be rejected")
+		}
+		record, _ = NewRecord(alice, "alice", nil, MaxTTL, 1)
+		record.Expires = time.Now().Add(10 * 365 * 24 * time.Hour).Unix()
+		record.Signature = alice.Sign(record.signedData())
+		squatted, _ := record.Marshal()
+		if err := v.Validate(Key("alice"), squatted); err == nil {
+			t.Error("Expected the record expiring after MaxTTL to be rejected")
+		}
+
+		record, _ = NewRecord(alice, "alice", nil, time.Hour, 1)
+		record.Registered = time.Now().Add(time.Hour).Unix()
+		record.Signature = alice.Sign(record.signedData())
+		future, _ := record.Marshal()
+		if err := v.Validate(Key("alice"), future); err == nil {
+			t.Error("Expected the record registered in the future to be rejected")
+		}
+
+		expired := mustRecord(t, alice, "alice", 1)
+		v.nowFunc = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		defer func() { v.nowFunc = time.Now }()
+		if err := v.Validate(Key("alice"), expired); err == nil {
+			t.Error("Expected the expired record error")
+		}
+	})
+
+	t.Run("record with the highest sequence wins", func(t *testing.T) {
+		values := [][]byte{
+			mustRecord(t, alice, "alice", 2),
+			mustRecord(t, alice, "alice", 5),
+			mustRecord(t, alice, "alice", 3),
+		}
+		if best := v.Select(Key("alice"), values); best != 1 {
+			t.Errorf("Expected record 1 to be selected, got %d", best)
+		}
+		other, _ := NewRecord(alice, "alice", []string{"10.0.0.2:5000"}, time.Hour, 7)
+		otherData, _ := other.Marshal()
+		tie := [][]byte{mustRecord(t, alice, "alice", 7), otherData}
+		reversed := [][]byte{tie[1], tie[0]}
+		if string(tie[v.Select(Key("alice"), tie)]) != string(reversed[v.Select(Key("alice"), reversed)]) {
+			t.Error("Expected the same record to be selected regardless of the order")
+		}
+	})
+
+	t.Run("earliest registered record can't be replaced by another key until it expires", func(t *testing.T) {
+		first, _ := NewRecord(alice, "alice", nil, 2*time.Hour, 1)
+		first.Registered -= 60
+		first.Signature = alice.Sign(first.signedData())
+		stored, _ := first.Marshal()
+		hijack := mustRecord(t, mallory, "alice", 100)
+		for _, values := range [][][]byte{{stored, hijack}, {hijack, stored}} {
+			if best := v.Select(Key("alice"), values); string(values[best]) != string(stored) {
+				t.Error("Expected the earliest registered record to be kept")
+			}
+		}
+		renewed, err := RenewRecord(alice, first, []string{"10.0.0.2:5000"}, 3*time.Hour, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renewed.Registered != first.Registered {
+			t.Error("Expected the renewed record to keep the registration time")
+		}
+		update, _ := renewed.Marshal()
+		if best := v.Select(Key("alice"), [][]byte{hijack, update, stored}); best != 1 {
+			t.Errorf("Expected the owner's update to be selected, got %d", best)
+		}
+		if _, err := RenewRecord(mallory, first, nil, time.Hour, 101); err == nil {
+			t.Error("Expected the record of another key not to be renewed")
+		}
+
+		v.nowFunc = func() time.Time { return time.Now().Add(2*time.Hour + time.Minute) }
+		defer func() { v.nowFunc = time.Now }()
+		record, _ := NewRecord(mallory, "alice", nil, 3*time.Hour, 1)
+		takeover, _ := record.Marshal()
+		if best := v.Select(Key("alice"), [][]byte{stored, takeover}); best != 1 {
+			t.Error("Expected the name to be free after the stored record expired")
+		}
+	})
+
+	t.Run("records registered at the same time are selected by the public key", func(t *testing.T) {
+		a, _ := NewRecord(alice, "alice", nil, time.Hour, 1)
+		m, _ := NewRecord(mallory, "alice", nil, time.Hour, 1)
+		m.Registered = a.Registered
+		m.Signature = mallory.Sign(m.signedData())
+		aData, _ := a.Marshal()
+		mData, _ := m.Marshal()
+		winner := aData
+		if bytes.Compare(mallory.PublicKey, alice.PublicKey) < 0 {
+			winner = mData
+		}
+		for _, values := range [][][]byte{{aData, mData}, {mData, aData}} {
+			if best := v.Select(Key("alice"), values); string(values[best]) != string(winner) {
+				t.Error("Expected the record with the smaller public key regardless of the order")
+			}
+		}
+	})
+
+	t.Run("invalid names are rejected", func(t *testing.T) {
+		for _, name := range []string{"", "Alice", "../etc", "a b"} {
+			if _, err := NewRecord(alice, name, nil, time.Hour, 1); err == nil {
+				t.Errorf("Expected name %q to be rejected", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"github.com/ulshv/nexuslink/pkg/transport"
+)
+
+type ConnState string
+
+const (
+	StateHandshake ConnState = "handshake" // waiting for the remote node's hello and its proof
+	StateConnected ConnState = "connected"
+	StateClosing   ConnState = "closing" // duplicate or rejected connection being closed
+	StateClosed    ConnState = "closed"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	pingInterval     = 15 * time.Second
+)
+
+// Limits of the node's connections, zero means unlimited
+type Limits struct {
+	MaxInbound  int
+	MaxOutbound int
+	MaxPerIP    int // inbound and outbound connections with the same remote IP
+}
+
+var DefaultLimits = Limits{MaxInbound: 128, MaxOutbound: 64, MaxPerIP: 8}
+
+// ConnInfo is the snapshot of the connection's state
+type ConnInfo struct {
+	PeerID    string
+	NodeID    string
+	Direction Direction
+	Addr      string
+	State     ConnState
+	RTT       time.Duration // zero until the first pong
+	Since     time.Time
+	Queue     tcp_conn.QueueStats
+	// Compression.Algorithm is the compression negotiated in the handshake
+	Compression tcp_conn.CompressionStats
+}
+
+func (p *Peer) State() ConnState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// RTT returns the last measured round-trip time of the connection
+func (p *Peer) RTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rtt
+}
+
+func (p *Peer) markReady() {
+	p.readyOnce.Do(func() { close(p.ready) })
+}
+
+// SetLimits changes the limits of the new connections, existing ones are kept
+func (n *Node) SetLimits(limits Limits) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.limits = limits
+}
+
+// SetQueueOptions changes the send queue of the new and the existing connections
+func (n *Node) SetQueueOptions(opts tcp_conn.QueueOptions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.queueOpts = opts
+	for _, peer := range n.peers {
+		peer.Conn.SetQueueOptions(opts)
+	}
+}
+
+// SetPriority sets the send priority of the message type, e.g. PriorityBulk for file chunks
+func (n *Node) SetPriority(msgType string, prio tcp_conn.Priority) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.priorities[msgType] = prio
+}
+
+func (n *Node) priorityOf(msgType string) tcp_conn.Priority {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if prio, ok := n.priorities[msgType]; ok {
+		return prio
+	}
+	return tcp_conn.PriorityInteractive
+}
+
+// SetCompression enables or disables the compression of the new connections.
+// The compression is used when both nodes have it enabled.
+func (n *Node) SetCompression(enabled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.compression = enabled
+}
+
+// Conns returns all the node's connections, including the ones in the handshake
+func (n *Node) Conns() []ConnInfo {
+	n.mu.Lock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, peer := range n.peers {
+		peers = append(peers, peer)
+	}
+	n.mu.Unlock()
+	conns := []ConnInfo{}
+	for _, peer := range peers {
+		peer.mu.Lock()
+		conns = append(conns, ConnInfo{
+			PeerID:      peer.ID,
+			NodeID:      peer.nodeID,
+			Direction:   peer.Direction,
+			Addr:        peer.Conn.RemoteAddr(),
+			State:       peer.state,
+			RTT:         peer.rtt,
+			Since:       peer.Since,
+			Queue:       peer.Conn.QueueStats(),
+			Compression: peer.Conn.CompressionStats(),
+		})
+		peer.mu.Unlock()
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].PeerID < conns[j].PeerID
+	})
+	return conns
+}
+
+func (n *Node) checkLimits(direction Direction, addr string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.checkLimitsLocked(direction, addr)
+}
+
+// checkLimitsLocked must be called with n.mu locked
+func (n *Node) checkLimitsLocked(direction Direction, addr string) error {
+	count, sameIP := 0, 0
+	ip := hostOf(addr)
+	for _, peer := range n.peers {
+		if peer.Direction == direction {
+			count++
+		}
+		if hostOf(peer.ID) == ip {
+			sameIP++
+		}
+	}
+	maxCount := n.limits.MaxInbound
+	if direction == DirectionOutbound {
+		maxCount = n.limits.MaxOutbound
+	}
+	if maxCount > 0 && count >= maxCount {
+		return fmt.Errorf("too many %s connections (max %d)", direction, maxCount)
+	}
+	if n.limits.MaxPerIP > 0 && sameIP >= n.limits.MaxPerIP {
+		return fmt.Errorf("too many connections with %s (max %d)", ip, n.limits.MaxPerIP)
+	}
+	return nil
+}
+
+// handleHello checks the remote node id against its public key and sends the proof
+// of this node's id. Connections to itself are closed.
+func (n *Node) handleHello(peer *Peer, payload *pb.TCPMessagePayload) {
+	msg := helloMsg{}
+	err := json.Unmarshal(payload.Data, &msg)
+	if err == nil && identity.NodeIDFromPublicKey(msg.PublicKey) != msg.NodeID {
+		err = errors.New("node id doesn't match the public key")
+	}
+	if err == nil && len(msg.Nonce) != helloNonceSize {
+		err = errors.New("invalid nonce")
+	}
+	if err != nil {
+		n.logger.Warn("Invalid hello message", "peer", peer.ID, "error", err)
+		peer.Conn.Close()
+		return
+	}
+	if msg.NodeID == n.ID {
+		n.logger.Warn("Connected to itself, closing", "peer", peer.ID)
+		peer.Conn.Close()
+		return
+	}
+	peer.mu.Lock()
+	if peer.hello != nil {
+		peer.mu.Unlock()
+		n.logger.Warn("Repeated hello message", "peer", peer.ID)
+		peer.Conn.Close()
+		return
+	}
+	peer.hello = &msg
+	peer.mu.Unlock()
+
+	if algorithm := n.negotiateCompression(msg.Compression); algorithm != "" {
+		peer.Conn.SetCompression(algorithm)
+	}
+	auth, _ := json.Marshal(helloAuthMsg{Signature: n.Identity.Sign(helloAuthData(msg.Nonce))})
+	peer.Send(&pb.TCPMessagePayload{Type: MsgTypeHelloAuth, Data: auth})
+}
+
+// helloAuthData is signed to prove the node id, the nonce is the remote node's one,
+// so the signature can't be replayed on another connection
+func helloAuthData(nonce []byte) []byte {
+	return append([]byte("nexuslink-hello:"), nonce...)
+}
+
+// handleHelloAuth finishes the handshake once the remote node proved its id.
+// When the remote node is already connected only one of the connections is kept.
+func (n *Node) handleHelloAuth(peer *Peer, payload *pb.TCPMessagePayload) {
+	auth := helloAuthMsg{}
+	peer.mu.Lock()
+	hello, nonce := peer.hello, peer.nonce
+	peer.mu.Unlock()
+	if hello == nil || peer.State() != StateHandshake {
+		n.logger.Warn("Unexpected hello_auth message", "peer", peer.ID)
+		peer.Conn.Close()
+		return
+	}
+	if err := json.Unmarshal(payload.Data, &auth); err != nil ||
+		!identity.Verify(hello.PublicKey, helloAuthData(nonce), auth.Signature) {
+		n.logger.Warn("Peer failed to prove its node id, closing", "peer", peer.ID, "node_id", hello.NodeID)
+		peer.Conn.Close()
+		return
+	}
+	msg := *hello
+
+	n.mu.Lock()
+	var existing *Peer
+	for _, other := range n.peers {
+		if other != peer && other.NodeID() == msg.NodeID && other.State() == StateConnected {
+			existing = other
+		}
+	}
+	dropped := (*Peer)(nil)
+	peer.mu.Lock()
+	peer.nodeID = msg.NodeID
+	if existing != nil && n.keepExisting(existing, peer, msg.NodeID) {
+		peer.state = StateClosing
+		dropped = peer
+	} else {
+		peer.state = StateConnected
+		peer.announced = true
+		if existing != nil {
+			existing.mu.Lock()
+			existing.state = StateClosing
+			existing.mu.Unlock()
+			dropped = existing
+		}
+	}
+	peer.mu.Unlock()
+	onConnect := append([]func(*Peer){}, n.onConnect...)
+	n.mu.Unlock()
+
+	if dropped != nil {
+		n.logger.Debug("Closing duplicate connection", "peer", dropped.ID, "node_id", msg.NodeID)
+		dropped.Conn.Close()
+	}
+	if dropped == peer {
+		peer.markReady()
+		return
+	}
+	n.logger.Info("Peer connected", "peer", peer.ID, "direction", peer.Direction, "node_id", msg.NodeID)
+	for _, hook := range onConnect {
+		hook(peer)
+	}
+	peer.markReady()
+	go n.pingLoop(peer)
+}
+
+// negotiateCompression picks the node's most preferred compression supported by the remote node
+func (n *Node) negotiateCompression(remote []string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.compression {
+		return ""
+	}
+	for _, algorithm := range tcp_conn.Compressions {
+		if slices.Contains(remote, algorithm) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// keepExisting decides which of the two connections to the same node survives.
+// Both nodes must make the same decision whatever order they see the connections in:
+// the connection dialed by the node with the smaller id wins, and of the two
+// connections dialed the same way the one with the smaller dialer's address.
+func (n *Node) keepExisting(existing *Peer, newPeer *Peer, remoteNodeID string) bool {
+	if existing.Direction == newPeer.Direction {
+		return dialerAddr(existing) < dialerAddr(newPeer)
+	}
+	preferred := DirectionInbound
+	if n.ID < remoteNodeID {
+		preferred = DirectionOutbound
+	}
+	return existing.Direction == preferred
+}
+
+// pingLoop measures the RTT of the connection until it's closed
+func (n *Node) pingLoop(peer *Peer) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		data := strconv.FormatInt(time.Now().UnixNano(), 10)
+		peer.Send(&pb.TCPMessagePayload{Type: "ping", Data: []byte(data)})
+		select {
+		case <-peer.Conn.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialerAddr is the address of the dialing side, both sides of the connection know it
+func dialerAddr(peer *Peer) string {
+	if peer.Direction == DirectionOutbound {
+		return peer.Conn.LocalAddr()
+	}
+	return peer.Conn.RemoteAddr()
+}
+
+// hostOf returns the host of the peer's address for the MaxPerIP limit. The scheme of
+// the non-TCP transports is stripped, the local transports (unix, mem) have no hosts,
+// all their connections are counted as the ones of the same host, the scheme.
+func hostOf(addr string) string {
+	schemes := []string{transport.SchemeWebSocket, transport.SchemeUDP, transport.SchemeUnix, transport.SchemeMem}
+	scheme, rest := transport.SplitScheme(addr, schemes)
+	if scheme == transport.SchemeUnix || scheme == transport.SchemeMem {
+		return scheme
+	}
+	host, _, err := net.SplitHostPort(rest)
+	if err != nil {
+		return rest
+	}
+	return host
+}
@@ -0,0 +1,448 @@
+// Node is the p2p runtime of the NexusLink app: a single node listens for inbound
+// connections and dials outbound ones at the same time, and both kinds of
+// connections are treated the same way once established. There are no
+// "server" and "client" nodes, every node can host rooms and join rooms of the other nodes.
+//
+// Apps plug into the Node by registering message handlers (by TCPMessagePayload.type)
+// and peer connect/disconnect hooks. Connections are made by the transports
+// (TCP, Unix sockets, WebSocket and reliable UDP by default, see AddTransport). The node keeps the table of its connections
+// (see conn_manager.go): it enforces the connection limits, measures RTT
+// and keeps a single connection per remote node.
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"github.com/ulshv/nexuslink/pkg/transport"
+)
+
+type Direction string
+
+const (
+	DirectionInbound  Direction = "inbound"
+	DirectionOutbound Direction = "outbound"
+)
+
+// The handshake: both sides send the hello right after the connection is established,
+// and answer the remote hello with the proof of their node id, the signature of the remote nonce.
+const (
+	MsgTypeHello     = "node_hello"
+	MsgTypeHelloAuth = "node_hello_auth"
+)
+
+// helloNonceSize is the size of the random nonce of every connection's hello
+const helloNonceSize = 32
+
+// the backoff of the failed Accept calls
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+type helloMsg struct {
+	NodeID      string            `json:"node_id"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`            // sha256 of the key is the node id
+	Nonce       []byte            `json:"nonce"`                 // signed by the remote node in its hello_auth
+	Compression []string          `json:"compression,omitempty"` // supported by the node, see tcp_conn.Compressions
+}
+
+type helloAuthMsg struct {
+	Signature []byte `json:"signature"` // of helloAuthData with the remote nonce
+}
+
+// Peer is an established connection to the remote node.
+// Peer's ID is the remote address of the connection,
+// NodeID is known after the remote node's hello is received.
+type Peer struct {
+	ID        string
+	Direction Direction
+	Conn      *tcp_conn.TCPConn
+	Since     time.Time
+	mu        sync.Mutex
+	nodeID    string
+	state     ConnState
+	rtt       time.Duration
+	ready     chan struct{} // closed when the handshake is finished or failed
+	nonce     []byte        // of the hello sent to the remote node
+	hello     *helloMsg     // of the remote node, its node id isn't proven until the hello_auth
+	readyOnce sync.Once
+	announced bool // connect hooks were called, so the disconnect ones must be called too
+}
+
+func (p *Peer) NodeID() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nodeID
+}
+
+func (p *Peer) Send(payload *pb.TCPMessagePayload) error {
+	return p.Conn.Send(payload)
+}
+
+type HandlerFunc func(peer *Peer, payload *pb.TCPMessagePayload)
+
+type Node struct {
+	ID             string // sha256 of the identity's public key, hex-encoded
+	Identity       *identity.Identity
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         logs.Logger
+	mu             sync.Mutex
+	limits         Limits
+	queueOpts      tcp_conn.QueueOptions
+	priorities     map[string]tcp_conn.Priority // message type -> priority, interactive by default
+	compression    bool
+	transports     map[string]transport.Transport // scheme -> transport
+	listeners      []transport.Listener
+	peers          map[string]*Peer
+	handlers       map[string]HandlerFunc
+	defaultHandler HandlerFunc
+	onConnect      []func(peer *Peer)
+	onDisconnect   []func(peer *Peer)
+}
+
+func NewNode(ctx context.Context, logger logs.Logger, ident *identity.Identity) *Node {
+	ctx, cancel := context.WithCancel(ctx)
+	n := &Node{
+		ID:          ident.NodeID(),
+		Identity:    ident,
+		ctx:         ctx,
+		cancel:      cancel,
+		logger:      logger,
+		limits:      DefaultLimits,
+		queueOpts:   tcp_conn.DefaultQueueOptions,
+		compression: true,
+		priorities: map[string]tcp_conn.Priority{
+			MsgTypeHello:     tcp_conn.PriorityControl,
+			MsgTypeHelloAuth: tcp_conn.PriorityControl,
+			"ping":           tcp_conn.PriorityControl,
+			"pong":           tcp_conn.PriorityControl,
+		},
+		transports: map[string]transport.Transport{
+			transport.SchemeTCP:       transport.NewTCP(logger),
+			transport.SchemeUnix:      transport.NewUnix(logger),
+			transport.SchemeWebSocket: transport.NewWebSocket(logger),
+			transport.SchemeUDP:       transport.NewUDP(logger),
+		},
+		peers:    map[string]*Peer{},
+		handlers: map[string]HandlerFunc{},
+	}
+	n.defaultHandler = func(peer *Peer, payload *pb.TCPMessagePayload) {
+		n.logger.Info("Received message", "peer", peer.ID, "type", payload.Type, "data", string(payload.Data))
+	}
+	n.Handle("ping", func(peer *Peer, payload *pb.TCPMessagePayload) {
+		peer.Send(&pb.TCPMessagePayload{Type: "pong", Data: payload.Data})
+	})
+	n.Handle("pong", func(peer *Peer, payload *pb.TCPMessagePayload) {
+		sentAt, err := strconv.ParseInt(string(payload.Data), 10, 64)
+		if err != nil {
+			return
+		}
+		peer.mu.Lock()
+		peer.rtt = time.Since(time.Unix(0, sentAt))
+		peer.mu.Unlock()
+	})
+	n.Handle(MsgTypeHello, n.handleHello)
+	n.Handle(MsgTypeHelloAuth, n.handleHelloAuth)
+	return n
+}
+
+// Handle registers the handler for the payload type, handlers must be registered before
+// the node starts listening or dialing. Messages of the same peer are handled one by one.
+func (n *Node) Handle(msgType string, handler HandlerFunc) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[msgType] = handler
+}
+
+// OnPeer registers hooks called when a peer connects and disconnects
+func (n *Node) OnPeer(connected func(peer *Peer), disconnected func(peer *Peer)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if connected != nil {
+		n.onConnect = append(n.onConnect, connected)
+	}
+	if disconnected != nil {
+		n.onDisconnect = append(n.onDisconnect, disconnected)
+	}
+}
+
+// AddTransport adds (or replaces) the transport for the addresses with the scheme,
+// i.e. transport.SchemeMem for the in-memory connections in tests
+func (n *Node) AddTransport(scheme string, t transport.Transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transports[scheme] = t
+}
+
+// transportFor returns the transport for the address and the address without the scheme
+func (n *Node) transportFor(addr string) (transport.Transport, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	schemes := make([]string, 0, len(n.transports))
+	for scheme := range n.transports {
+		schemes = append(schemes, scheme)
+	}
+	scheme, rest := transport.SplitScheme(addr, schemes)
+	t, ok := n.transports[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("no transport for %s", addr)
+	}
+	return t, rest, nil
+}
+
+// Listen accepts inbound connections on the addr (i.e. ":5000" or "unix:/tmp/node.sock")
+// until the node is closed
+func (n *Node) Listen(addr string) (net.Addr, error) {
+	t, rest, err := n.transportFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := t.Listen(n.ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.listeners = append(n.listeners, listener)
+	n.mu.Unlock()
+
+	go func() {
+		<-n.ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		// the persistent errors (i.e. too many open files) are retried with a backoff,
+		// like net/http's Server does
+		var delay time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if n.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+				n.logger.Error("Failed to accept connection", "error", err, "retry_in", delay)
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				continue
+			}
+			delay = 0
+			if _, err := n.addPeer(conn, DirectionInbound); err != nil {
+				n.logger.Warn("Rejected inbound connection", "addr", conn.RemoteAddr(), "error", err)
+			}
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// Dial connects to the remote node and waits for the handshake. If the node
+// is already connected, the existing connection is returned instead of the new one.
+func (n *Node) Dial(addr string) (*Peer, error) {
+	if err := n.checkLimits(DirectionOutbound, addr); err != nil {
+		return nil, err
+	}
+	t, rest, err := n.transportFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial(n.ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := n.addPeer(conn, DirectionOutbound)
+	if err != nil {
+		return nil, err
+	}
+	<-peer.ready
+	if peer.State() == StateConnected {
+		return peer, nil
+	}
+	// the connection could be closed as a duplicate of another one
+	if existing, ok := n.PeerByNodeID(peer.NodeID()); ok && peer.NodeID() != "" {
+		return existing, nil
+	}
+	return nil, fmt.Errorf("handshake with %s failed", addr)
+}
+
+// DialContext is Dial which returns when ctx is done. The dial goes on in the background
+// then, and the connection is kept if it's established.
+func (n *Node) DialContext(ctx context.Context, addr string) (*Peer, error) {
+	type dialResult struct {
+		peer *Peer
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		peer, err := n.Dial(addr)
+		result <- dialResult{peer, err}
+	}()
+	select {
+	case r := <-result:
+		return r.peer, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("dial %s: %w", addr, ctx.Err())
+	}
+}
+
+func (n *Node) Peer(peerID string) (*Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer, ok := n.peers[peerID]
+	return peer, ok
+}
+
+// PeerByNodeID returns the connected peer with the node id (known after its hello)
+func (n *Node) PeerByNodeID(nodeID string) (*Peer, bool) {
+	for _, peer := range n.Peers() {
+		if peer.NodeID() == nodeID {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// Peers returns the peers which have finished the handshake
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, peer := range n.peers {
+		if peer.State() == StateConnected {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+// ListenAddrs returns the addresses of all the node's listeners
+func (n *Node) ListenAddrs() []net.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addrs := []net.Addr{}
+	for _, listener := range n.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// Disconnect closes the connection to the peer
+func (n *Node) Disconnect(peerID string) error {
+	peer, ok := n.Peer(peerID)
+	if !ok {
+		return fmt.Errorf("peer %s is not connected", peerID)
+	}
+	return peer.Conn.Close()
+}
+
+// Close stops all the listeners and closes all the connections
+func (n *Node) Close() {
+	n.cancel()
+}
+
+// addPeer starts the handshake, the connect hooks are called
+// when the remote node's hello is received (see handleHello)
+func (n *Node) addPeer(conn *tcp_conn.TCPConn, direction Direction) (*Peer, error) {
+	addr := conn.RemoteAddr()
+	n.mu.Lock()
+	if existing, ok := n.peers[addr]; ok {
+		// the same listening address is dialed twice, keep the first connection
+		n.mu.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	if err := n.checkLimitsLocked(direction, addr); err != nil {
+		n.mu.Unlock()
+		conn.Close()
+		return nil, err
+	}
+	conn.SetQueueOptions(n.queueOpts)
+	conn.SetPriorityFunc(n.priorityOf)
+	nonce := make([]byte, helloNonceSize)
+	rand.Read(nonce)
+	hello := helloMsg{NodeID: n.ID, PublicKey: n.Identity.PublicKey, Nonce: nonce}
+	if n.compression {
+		hello.Compression = tcp_conn.Compressions
+	}
+	peer := &Peer{
+		ID:        addr,
+		Direction: direction,
+		Conn:      conn,
+		Since:     time.Now(),
+		state:     StateHandshake,
+		ready:     make(chan struct{}),
+		nonce:     nonce,
+	}
+	n.peers[peer.ID] = peer
+	n.mu.Unlock()
+
+	n.logger.Debug("Connection established", "peer", peer.ID, "direction", direction)
+	helloData, _ := json.Marshal(hello)
+	peer.Send(&pb.TCPMessagePayload{Type: MsgTypeHello, Data: helloData})
+	go n.servePeer(peer)
+	go func() {
+		select {
+		case <-peer.ready:
+		case <-time.After(handshakeTimeout):
+			n.logger.Warn("Handshake timed out", "peer", peer.ID)
+			peer.Conn.Close()
+		}
+	}()
+	return peer, nil
+}
+
+// servePeer dispatches the received messages until the connection is closed
+func (n *Node) servePeer(peer *Peer) {
+	for payload := range peer.Conn.Messages() {
+		state := peer.State()
+		isHandshake := payload.Type == MsgTypeHello || payload.Type == MsgTypeHelloAuth
+		if state == StateClosing || (state == StateHandshake && !isHandshake) {
+			continue
+		}
+		n.mu.Lock()
+		handler, ok := n.handlers[payload.Type]
+		if !ok {
+			handler = n.defaultHandler
+		}
+		n.mu.Unlock()
+		handler(peer, payload)
+	}
+
+	peer.mu.Lock()
+	wasConnected := peer.announced
+	peer.state = StateClosed
+	peer.mu.Unlock()
+	peer.markReady()
+
+	n.mu.Lock()
+	delete(n.peers, peer.ID)
+	onDisconnect := append([]func(*Peer){}, n.onDisconnect...)
+	n.mu.Unlock()
+
+	if !wasConnected {
+		return
+	}
+	n.logger.Info("Peer disconnected", "peer", peer.ID)
+	for _, hook := range onDisconnect {
+		hook(peer)
+	}
+}
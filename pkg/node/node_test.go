@@ -0,0 +1,431 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/identity"
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/rooms"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"github.com/ulshv/nexuslink/pkg/transport"
+)
+
+type chatNode struct {
+	node  *Node
+	rooms *rooms.Service
+	mu    sync.Mutex
+	inbox []rooms.Message
+}
+
+func newChatNode(t *testing.T, name string) *chatNode {
+	logger := logs.NewSlogLogger("node_test/" + name)
+	ident, err := identity.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &chatNode{node: NewNode(context.Background(), logger, ident)}
+	n.rooms = rooms.NewService(logger, func(msg rooms.Message) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inbox = append(n.inbox, msg)
+	})
+	for _, msgType := range []string{rooms.MsgTypeJoin, rooms.MsgTypeJoined, rooms.MsgTypeLeave, rooms.MsgTypeMessage, rooms.MsgTypeError} {
+		n.node.Handle(msgType, func(peer *Peer, payload *pb.TCPMessagePayload) {
+			n.rooms.HandleMessage(peer.ID, payload)
+		})
+	}
+	n.node.OnPeer(
+		func(peer *Peer) { n.rooms.AddPeer(peer.ID, peer) },
+		func(peer *Peer) { n.rooms.RemovePeer(peer.ID) },
+	)
+	if _, err := n.node.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.node.Close)
+	return n
+}
+
+func (n *chatNode) messages() []rooms.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]rooms.Message{}, n.inbox...)
+}
+
+// failingTransport's listeners fail every Accept until they're closed
+type failingTransport struct {
+	accepts atomic.Int32
+	closed  chan struct{}
+}
+
+func (f *failingTransport) Listen(ctx context.Context, addr string) (transport.Listener, error) {
+	return failingListener{f}, nil
+}
+
+func (f *failingTransport) Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error) {
+	return nil, errors.New("not supported")
+}
+
+type failingListener struct {
+	transport *failingTransport
+}
+
+func (l failingListener) Accept() (*tcp_conn.TCPConn, error) {
+	l.transport.accepts.Add(1)
+	select {
+	case <-l.transport.closed:
+		return nil, net.ErrClosed
+	default:
+		return nil, errors.New("too many open files")
+	}
+}
+
+func (l failingListener) Addr() net.Addr { return transport.Addr{Scheme: "fail", Path: "x"} }
+
+func (l failingListener) Close() error { return nil }
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func TestNode(t *testing.T) {
+	t.Run("inbound and outbound connections are symmetric", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		c := newChatNode(t, "c")
+
+		// b dials a (a sees the inbound peer), a dials c (a sees the outbound peer)
+		hostOfB, err := b.node.Dial(a.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.node.Dial(c.node.ListenAddrs()[0].String()); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(a.node.Peers()) == 2 && len(c.node.Peers()) == 1 })
+		directions := map[Direction]int{}
+		for _, peer := range a.node.Peers() {
+			directions[peer.Direction]++
+		}
+		if directions[DirectionInbound] != 1 || directions[DirectionOutbound] != 1 {
+			t.Errorf("Expected one inbound and one outbound peer, got %v", directions)
+		}
+		hostOfC := c.node.Peers()[0]
+
+		// a hosts the room, b (which dialed a) and c (which was dialed by a) join it
+		if err := a.rooms.Create("general"); err != nil {
+			t.Fatal(err)
+		}
+		b.rooms.Join(hostOfB.ID, "general")
+		c.rooms.Join(hostOfC.ID, "general")
+		waitFor(t, func() bool { return len(b.rooms.Rooms()) == 1 && len(c.rooms.Rooms()) == 1 })
+
+		if err := b.rooms.Say("general", "hi from b"); err != nil {
+			t.Fatal(err)
+		}
+		a.rooms.Say("general", "hi from a")
+		for _, n := range []*chatNode{a, b, c} {
+			waitFor(t, func() bool { return len(n.messages()) == 2 })
+		}
+		for _, msg := range c.messages() {
+			if msg.Text == "hi from a" && msg.From != rooms.HostName {
+				t.Errorf("Expected the host's message to be from %q, got %q", rooms.HostName, msg.From)
+			}
+		}
+	})
+
+	t.Run("nodes connect over the in-memory and unix transports", func(t *testing.T) {
+		memory := transport.NewMemory(logs.NewSlogLogger("node_test/mem"))
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		for _, n := range []*chatNode{a, b} {
+			n.node.AddTransport(transport.SchemeMem, memory)
+		}
+		if _, err := a.node.Listen("mem:a"); err != nil {
+			t.Fatal(err)
+		}
+		socket := "unix:" + filepath.Join(t.TempDir(), "b.sock")
+		if _, err := b.node.Listen(socket); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.node.Dial("mem:a"); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(a.node.Peers()) == 1 })
+		if err := a.rooms.Create("general"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.rooms.Join("mem:a", "general"); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(b.rooms.Rooms()) == 1 })
+
+		c := newChatNode(t, "c")
+		if _, err := c.node.Dial(socket); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(b.node.Peers()) == 2 })
+	})
+
+	t.Run("same room has members connected over tcp and websocket", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		c := newChatNode(t, "c")
+		wsAddr, err := a.node.Listen("ws:127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostOfB, err := b.node.Dial(a.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostOfC, err := c.node.Dial(wsAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.rooms.Create("mixed")
+		b.rooms.Join(hostOfB.ID, "mixed")
+		c.rooms.Join(hostOfC.ID, "mixed")
+		waitFor(t, func() bool { return len(b.rooms.Rooms()) == 1 && len(c.rooms.Rooms()) == 1 })
+		c.rooms.Say("mixed", "hi from the browser")
+		waitFor(t, func() bool { return len(b.messages()) == 1 })
+	})
+
+	t.Run("peer is removed on disconnect", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		peer, err := b.node.Dial(a.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(a.node.Peers()) == 1 })
+		b.node.Disconnect(peer.ID)
+		waitFor(t, func() bool { return len(a.node.Peers()) == 0 && len(b.node.Peers()) == 0 })
+	})
+}
+
+func TestConnManager(t *testing.T) {
+	t.Run("simultaneous connections to the same node are deduplicated", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		wg := sync.WaitGroup{}
+		for _, pair := range [][2]*chatNode{{a, b}, {b, a}, {a, b}} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := pair[0].node.Dial(pair[1].node.ListenAddrs()[0].String()); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		waitFor(t, func() bool { return len(a.node.Conns()) == 1 && len(b.node.Conns()) == 1 })
+		connA, connB := a.node.Conns()[0], b.node.Conns()[0]
+		if connA.NodeID != b.node.ID || connB.NodeID != a.node.ID {
+			t.Errorf("Expected the peers to know each other's node ids, got %+v and %+v", connA, connB)
+		}
+		if connA.Direction == connB.Direction {
+			t.Errorf("Expected both nodes to keep the same connection, got %s and %s", connA.Direction, connB.Direction)
+		}
+
+		// dialing the connected node returns the existing peer
+		peer, err := a.node.Dial(b.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer.ID != connA.PeerID {
+			t.Errorf("Expected the existing peer %s, got %s", connA.PeerID, peer.ID)
+		}
+	})
+
+	t.Run("connections over the limits are rejected", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		a.node.SetLimits(Limits{MaxInbound: 1})
+		b := newChatNode(t, "b")
+		c := newChatNode(t, "c")
+		if _, err := b.node.Dial(a.node.ListenAddrs()[0].String()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.node.Dial(a.node.ListenAddrs()[0].String()); err == nil {
+			t.Error("Expected the inbound limit to reject the connection")
+		}
+		waitFor(t, func() bool { return len(a.node.Peers()) == 1 })
+
+		c.node.SetLimits(Limits{MaxPerIP: 1})
+		if _, err := c.node.Dial(b.node.ListenAddrs()[0].String()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.node.Dial(a.node.ListenAddrs()[0].String()); err == nil {
+			t.Error("Expected the per-IP limit to reject the connection")
+		}
+	})
+
+	t.Run("per-IP limit applies to every transport", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		c := newChatNode(t, "c")
+		dir := t.TempDir()
+		addrs := map[string]string{}
+		for _, addr := range []string{"ws:127.0.0.1:0", "udp:127.0.0.1:0", "unix:" + filepath.Join(dir, "a.sock")} {
+			listenAddr, err := a.node.Listen(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs[strings.Split(addr, ":")[0]] = listenAddr.String()
+		}
+		bUnix, err := b.node.Listen("unix:" + filepath.Join(dir, "b.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.node.SetLimits(Limits{MaxPerIP: 1})
+		if _, err := c.node.Dial(b.node.ListenAddrs()[0].String()); err != nil {
+			t.Fatal(err)
+		}
+		for _, scheme := range []string{"ws", "udp"} {
+			if _, err := c.node.Dial(addrs[scheme]); err == nil {
+				t.Errorf("Expected the per-IP limit to reject the %s connection", scheme)
+			}
+		}
+		if _, err := c.node.Dial(addrs["unix"]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.node.Dial(bUnix.String()); err == nil {
+			t.Error("Expected the per-IP limit to reject the second unix connection")
+		}
+	})
+
+	t.Run("connection to itself is closed", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		if _, err := a.node.Dial(a.node.ListenAddrs()[0].String()); err == nil {
+			t.Error("Expected the error")
+		}
+		waitFor(t, func() bool { return len(a.node.Conns()) == 0 })
+	})
+
+	t.Run("rtt is measured", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		peer, err := a.node.Dial(b.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return peer.RTT() > 0 })
+	})
+
+	t.Run("compression is negotiated in the handshake", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		c := newChatNode(t, "c")
+		c.node.SetCompression(false)
+		received := make(chan []byte, 1)
+		b.node.Handle("blob", func(peer *Peer, payload *pb.TCPMessagePayload) {
+			received <- payload.Data
+		})
+
+		toB, err := a.node.Dial(b.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob := []byte(strings.Repeat("nexuslink ", 1000))
+		toB.Send(&pb.TCPMessagePayload{Type: "blob", Data: blob})
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, blob) {
+				t.Error("Received data differs from the sent one")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the message")
+		}
+		if stats := toB.Conn.CompressionStats(); stats.Algorithm != tcp_conn.CompressionFlate || stats.Compressed != 1 || stats.Ratio() < 10 {
+			t.Errorf("Expected the message to be compressed, got %+v", stats)
+		}
+
+		toC, err := a.node.Dial(c.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := toC.Conn.CompressionStats(); stats.Algorithm != "" {
+			t.Errorf("Expected no compression with the node which disabled it, got %s", stats.Algorithm)
+		}
+	})
+
+	t.Run("node id must be proven with the private key", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		b := newChatNode(t, "b")
+		toB, err := a.node.Dial(b.node.ListenAddrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(b.node.Peers()) == 1 })
+		impostor, err := identity.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, publicKey := range map[string][]byte{
+			"the victim's key without the signature": a.node.Identity.PublicKey,
+			"its own key":                            impostor.PublicKey,
+		} {
+			conn, err := transport.NewTCP(logs.NewSlogLogger("node_test/impostor")).
+				Dial(context.Background(), b.node.ListenAddrs()[0].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				for range conn.Messages() {
+				}
+			}()
+			hello, _ := json.Marshal(helloMsg{NodeID: a.node.ID, PublicKey: publicKey, Nonce: make([]byte, helloNonceSize)})
+			conn.Send(&pb.TCPMessagePayload{Type: MsgTypeHello, Data: hello})
+			auth, _ := json.Marshal(helloAuthMsg{Signature: impostor.Sign([]byte("anything"))})
+			conn.Send(&pb.TCPMessagePayload{Type: MsgTypeHelloAuth, Data: auth})
+			select {
+			case <-conn.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected the impostor with %s to be disconnected", name)
+			}
+		}
+		if peer, ok := b.node.PeerByNodeID(a.node.ID); !ok || peer.State() != StateConnected || toB.State() != StateConnected {
+			t.Error("Expected the connection of the real node to be kept")
+		}
+	})
+
+	t.Run("accept errors are retried with a backoff", func(t *testing.T) {
+		a := newChatNode(t, "a")
+		failing := &failingTransport{closed: make(chan struct{})}
+		a.node.AddTransport("fail", failing)
+		if _, err := a.node.Listen("fail:x"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		// 5ms, 10ms, 20ms, 40ms, 80ms...
+		if accepts := failing.accepts.Load(); accepts > 10 {
+			t.Errorf("Expected a few retries, got %d", accepts)
+		}
+		close(failing.closed)
+		time.Sleep(maxAcceptDelay)
+		accepts := failing.accepts.Load()
+		time.Sleep(maxAcceptDelay)
+		if failing.accepts.Load() != accepts {
+			t.Error("Expected the accept loop to stop on the closed listener")
+		}
+	})
+}
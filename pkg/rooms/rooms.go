@@ -0,0 +1,311 @@
+// rooms implements chat rooms hosted by any node of the p2p network.
+//
+// A room lives on the node which created it (the host). Other nodes join the room
+// by sending `room_join` to the host, and send their messages to the host with
+// `room_message`. The host forwards every message to all the members of the room,
+// setting the `from` field itself, so the members can't impersonate each other.
+package rooms
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// TCPMessagePayload.type's used by the rooms protocol,
+// TCPMessagePayload.data is a JSON-encoded roomMsg.
+const (
+	MsgTypeJoin    = "room_join"    // member -> host
+	MsgTypeJoined  = "room_joined"  // host -> member, reply to room_join
+	MsgTypeLeave   = "room_leave"   // member -> host
+	MsgTypeMessage = "room_message" // member -> host -> all the members
+	MsgTypeError   = "room_error"   // host -> member
+)
+
+// HostName is the `from` of the messages written by the host's user
+const HostName = "host"
+
+type roomMsg struct {
+	Room    string   `json:"room"`
+	From    string   `json:"from,omitempty"`
+	Text    string   `json:"text,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Peer is a connection to the remote node, i.e. *node.Peer
+type Peer interface {
+	Send(payload *pb.TCPMessagePayload) error
+}
+
+// Message is a chat message delivered to the local user
+type Message struct {
+	Room string
+	Host string // peer id of the host, empty for the rooms hosted by this node
+	From string
+	Text string
+}
+
+type Room struct {
+	Name    string
+	Host    string // peer id of the host, empty for the rooms hosted by this node
+	Members []string
+}
+
+type Service struct {
+	logger    logs.Logger
+	mu        sync.Mutex
+	peers     map[string]Peer
+	hosted    map[string]map[string]bool // room name -> member peer ids
+	joined    map[string]string          // room name -> host peer id
+	joining   map[joinRequest]bool       // room_join sent, waiting for room_joined
+	onMessage func(msg Message)
+}
+
+// joinRequest is the room_join sent to the host, only the asked host may reply with room_joined
+type joinRequest struct {
+	room string
+	host string
+}
+
+// NewService creates the rooms service, onMessage is called for every message
+// delivered to the local user, including the user's own messages
+func NewService(logger logs.Logger, onMessage func(msg Message)) *Service {
+	return &Service{
+		logger:    logger,
+		peers:     map[string]Peer{},
+		hosted:    map[string]map[string]bool{},
+		joined:    map[string]string{},
+		joining:   map[joinRequest]bool{},
+		onMessage: onMessage,
+	}
+}
+
+// MessageTypes are the payload types which should be passed to Service.HandleMessage
+var MessageTypes = []string{MsgTypeJoin, MsgTypeJoined, MsgTypeLeave, MsgTypeMessage, MsgTypeError}
+
+func (s *Service) AddPeer(peerID string, peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[peerID] = peer
+}
+
+// RemovePeer removes the peer from the hosted rooms and leaves the rooms hosted by the peer
+func (s *Service) RemovePeer(peerID string) {
+	s.mu.Lock()
+	delete(s.peers, peerID)
+	for _, members := range s.hosted {
+		delete(members, peerID)
+	}
+	for req := range s.joining {
+		if req.host == peerID {
+			delete(s.joining, req)
+		}
+	}
+	lost := []string{}
+	for name, host := range s.joined {
+		if host == peerID {
+			delete(s.joined, name)
+			lost = append(lost, name)
+		}
+	}
+	s.mu.Unlock()
+	for _, name := range lost {
+		s.logger.Warn("Left the room, host disconnected", "room", name, "host", peerID)
+	}
+}
+
+// Create hosts a new room on this node
+func (s *Service) Create(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hosted[name]; ok {
+		return fmt.Errorf("room %q already exists", name)
+	}
+	if _, ok := s.joined[name]; ok {
+		return fmt.Errorf("already joined room %q of another node", name)
+	}
+	s.hosted[name] = map[string]bool{}
+	return nil
+}
+
+// Join asks the host to add this node to the room
+func (s *Service) Join(hostPeerID string, name string) error {
+	s.mu.Lock()
+	if _, ok := s.hosted[name]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("room %q is hosted by this node", name)
+	}
+	req := joinRequest{room: name, host: hostPeerID}
+	s.joining[req] = true
+	s.mu.Unlock()
+	if err := s.send(hostPeerID, MsgTypeJoin, roomMsg{Room: name}); err != nil {
+		s.mu.Lock()
+		delete(s.joining, req)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Service) Leave(name string) error {
+	s.mu.Lock()
+	if members, ok := s.hosted[name]; ok {
+		delete(s.hosted, name)
+		s.mu.Unlock()
+		// closing the hosted room kicks all the members
+		for peerID := range members {
+			s.send(peerID, MsgTypeError, roomMsg{Room: name, Error: "room is closed by the host"})
+		}
+		return nil
+	}
+	host, ok := s.joined[name]
+	delete(s.joined, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not a member of room %q", name)
+	}
+	return s.send(host, MsgTypeLeave, roomMsg{Room: name})
+}
+
+// Say sends the local user's message to the room
+func (s *Service) Say(name string, text string) error {
+	s.mu.Lock()
+	if _, ok := s.hosted[name]; ok {
+		s.mu.Unlock()
+		s.broadcast(name, HostName, text)
+		return nil
+	}
+	host, ok := s.joined[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not a member of room %q", name)
+	}
+	return s.send(host, MsgTypeMessage, roomMsg{Room: name, Text: text})
+}
+
+// Rooms returns the rooms hosted or joined by this node
+func (s *Service) Rooms() []Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []Room{}
+	for name, members := range s.hosted {
+		room := Room{Name: name, Members: []string{}}
+		for peerID := range members {
+			room.Members = append(room.Members, peerID)
+		}
+		sort.Strings(room.Members)
+		rooms = append(rooms, room)
+	}
+	for name, host := range s.joined {
+		rooms = append(rooms, Room{Name: name, Host: host})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+func (s *Service) HandleMessage(peerID string, payload *pb.TCPMessagePayload) error {
+	msg := roomMsg{}
+	if err := json.Unmarshal(payload.Data, &msg); err != nil {
+		return fmt.Errorf("invalid %s message: %w", payload.Type, err)
+	}
+	switch payload.Type {
+	case MsgTypeJoin:
+		s.mu.Lock()
+		members, ok := s.hosted[msg.Room]
+		if ok {
+			members[peerID] = true
+		}
+		s.mu.Unlock()
+		if !ok {
+			return s.send(peerID, MsgTypeError, roomMsg{Room: msg.Room, Error: "room not found"})
+		}
+		s.logger.Info("Peer joined the room", "room", msg.Room, "peer", peerID)
+		return s.send(peerID, MsgTypeJoined, roomMsg{Room: msg.Room, Members: s.members(msg.Room)})
+	case MsgTypeJoined:
+		req := joinRequest{room: msg.Room, host: peerID}
+		s.mu.Lock()
+		asked := s.joining[req]
+		if asked {
+			delete(s.joining, req)
+			s.joined[msg.Room] = peerID
+		}
+		s.mu.Unlock()
+		if !asked {
+			s.logger.Warn("Ignoring unsolicited room_joined", "room", msg.Room, "peer", peerID)
+			return nil
+		}
+		s.logger.Info("Joined the room", "room", msg.Room, "host", peerID, "members", len(msg.Members))
+	case MsgTypeLeave:
+		s.mu.Lock()
+		if members, ok := s.hosted[msg.Room]; ok {
+			delete(members, peerID)
+		}
+		s.mu.Unlock()
+		s.logger.Info("Peer left the room", "room", msg.Room, "peer", peerID)
+	case MsgTypeMessage:
+		s.mu.Lock()
+		members, isHosted := s.hosted[msg.Room]
+		isMember := isHosted && members[peerID]
+		host, isJoined := s.joined[msg.Room]
+		s.mu.Unlock()
+		switch {
+		case isMember:
+			s.broadcast(msg.Room, peerID, msg.Text)
+		case isHosted:
+			return s.send(peerID, MsgTypeError, roomMsg{Room: msg.Room, Error: "join the room first"})
+		case isJoined && host == peerID:
+			s.onMessage(Message{Room: msg.Room, Host: host, From: msg.From, Text: msg.Text})
+		}
+	case MsgTypeError:
+		s.mu.Lock()
+		if s.joined[msg.Room] == peerID {
+			delete(s.joined, msg.Room)
+		}
+		delete(s.joining, joinRequest{room: msg.Room, host: peerID})
+		s.mu.Unlock()
+		s.logger.Warn("Room error", "room", msg.Room, "host", peerID, "error", msg.Error)
+	}
+	return nil
+}
+
+// broadcast delivers the message to the host's user and forwards it to all the members
+func (s *Service) broadcast(name string, from string, text string) {
+	s.onMessage(Message{Room: name, From: from, Text: text})
+	for _, peerID := range s.members(name) {
+		if err := s.send(peerID, MsgTypeMessage, roomMsg{Room: name, From: from, Text: text}); err != nil {
+			s.logger.Error("Failed to forward room message", "room", name, "peer", peerID, "error", err)
+		}
+	}
+}
+
+func (s *Service) members(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := []string{}
+	for peerID := range s.hosted[name] {
+		members = append(members, peerID)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s *Service) send(peerID string, msgType string, msg roomMsg) error {
+	s.mu.Lock()
+	peer, ok := s.peers[peerID]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s is not connected", peerID)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", msgType, err)
+	}
+	return peer.Send(&pb.TCPMessagePayload{Type: msgType, Data: data})
+}
@@ -0,0 +1,414 @@
+package rudp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	recvWindow     = 256  // max number of segments in flight, and buffered out of order
+	sendBuffer     = 1024 // max number of segments queued by Write before it blocks
+	initialCwnd    = 4
+	initialRTO     = 500 * time.Millisecond
+	minRTO         = 100 * time.Millisecond
+	maxRTO         = 5 * time.Second
+	maxRetries     = 10
+	keepAlive      = 2 * time.Second
+	idleTimeout    = 15 * time.Second
+	closeLinger    = 5 * time.Second // how long Close waits for the unacked data
+	timerInterval  = 10 * time.Millisecond
+	dupAcksResend  = 3
+	finRepetitions = 3
+)
+
+type segment struct {
+	seq     uint32
+	data    []byte
+	sentAt  time.Time
+	retries int
+}
+
+// Conn is a reliable ordered stream over UDP, it implements net.Conn.
+// Deadlines are not supported.
+type Conn struct {
+	ep          *endpoint
+	remote      *net.UDPAddr
+	mu          sync.Mutex
+	cond        *sync.Cond
+	id          uint32
+	established chan struct{}
+	isOpen      bool // handshake is finished
+	isClosing   bool // Close is called, the unacked data is being sent
+	closingAt   time.Time
+	isClosed    bool
+	closeErr    error
+	lastSend    time.Time
+	lastRecv    time.Time
+
+	// sending side
+	nextSeq  uint32
+	queue    [][]byte
+	inflight []*segment
+	lastAck  uint32
+	dupAcks  int
+	cwnd     float64
+	ssthresh float64
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+
+	// receiving side
+	expected   uint32
+	outOfOrder map[uint32][]byte
+	readBuf    []byte
+	finSeq     *uint32
+}
+
+func newConn(ep *endpoint, remote *net.UDPAddr, id uint32) *Conn {
+	c := &Conn{
+		ep:          ep,
+		remote:      remote,
+		id:          id,
+		established: make(chan struct{}),
+		cwnd:        initialCwnd,
+		ssthresh:    recvWindow,
+		rto:         initialRTO,
+		outOfOrder:  map[uint32][]byte{},
+		lastRecv:    time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// establish finishes the handshake with the connection id both sides agreed on
+func (c *Conn) establish(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isOpen || c.isClosed {
+		return
+	}
+	c.id = id
+	c.isOpen = true
+	close(c.established)
+	go c.timerLoop()
+}
+
+func (c *Conn) handlePacket(p packet) {
+	switch p.typ {
+	case packetSyn:
+		c.mu.Lock()
+		isOpen, id := c.isOpen, c.id
+		c.mu.Unlock()
+		if !isOpen {
+			// both sides are dialing each other (the hole punching),
+			// they both pick the smaller of the two ids
+			id = min(id, p.connID)
+			c.establish(id)
+		}
+		// synack is resent for the retransmitted syns too
+		c.sendPacket(packet{typ: packetSynAck, connID: id})
+		return
+	case packetSynAck:
+		c.mu.Lock()
+		isOpen, id := c.isOpen, c.id
+		c.mu.Unlock()
+		if !isOpen && p.connID <= id {
+			c.establish(p.connID)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isOpen || c.isClosed || p.connID != c.id {
+		return
+	}
+	c.lastRecv = time.Now()
+	switch p.typ {
+	case packetData:
+		c.handleAckLocked(p.ack, false)
+		c.handleDataLocked(p.seq, p.data)
+	case packetAck:
+		c.handleAckLocked(p.ack, true)
+	case packetFin:
+		finSeq := p.seq
+		c.finSeq = &finSeq
+		c.sendAckLocked()
+		c.cond.Broadcast()
+	}
+}
+
+func (c *Conn) handleDataLocked(seq uint32, data []byte) {
+	switch {
+	case seq == c.expected:
+		c.readBuf = append(c.readBuf, data...)
+		c.expected++
+		for {
+			next, ok := c.outOfOrder[c.expected]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.expected)
+			c.readBuf = append(c.readBuf, next...)
+			c.expected++
+		}
+		c.cond.Broadcast()
+	case seqBefore(c.expected, seq) && seq-c.expected < recvWindow:
+		c.outOfOrder[seq] = data
+	}
+	// every data packet is acked, duplicates too (the previous ack could be lost)
+	c.sendAckLocked()
+}
+
+// handleAckLocked removes the acked segments, isPureAck is false for the acks
+// piggybacked on the data packets, they aren't counted as the duplicate acks
+func (c *Conn) handleAckLocked(ack uint32, isPureAck bool) {
+	acked := 0
+	now := time.Now()
+	for len(c.inflight) > 0 && seqBefore(c.inflight[0].seq, ack) {
+		seg := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		acked++
+		// Karn's algorithm: RTT is measured only by the segments sent once
+		if seg.retries == 0 {
+			c.updateRTT(now.Sub(seg.sentAt))
+		}
+	}
+	if acked > 0 {
+		if c.srtt > 0 {
+			// the backed off RTO is reset when the data is moving again
+			c.rto = min(max(c.srtt+4*c.rttvar, minRTO), maxRTO)
+		}
+		c.lastAck = ack
+		c.dupAcks = 0
+		if c.cwnd < c.ssthresh {
+			c.cwnd += float64(acked) // slow start
+		} else {
+			c.cwnd += float64(acked) / c.cwnd // congestion avoidance
+		}
+		c.cwnd = min(c.cwnd, recvWindow)
+		c.pumpLocked()
+		c.cond.Broadcast()
+		return
+	}
+	if isPureAck && ack == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == dupAcksResend {
+			// fast retransmit: the receiver keeps getting the segments after the lost one
+			c.onLossLocked(false)
+			c.resendLocked(c.inflight[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, minRTO), maxRTO)
+}
+
+// onLossLocked shrinks the congestion window, to 1 segment on the timeouts
+func (c *Conn) onLossLocked(isTimeout bool) {
+	c.ssthresh = max(c.cwnd/2, 2)
+	if isTimeout {
+		c.cwnd = 1
+	} else {
+		c.cwnd = c.ssthresh
+	}
+}
+
+// pumpLocked sends the queued segments while the window allows
+func (c *Conn) pumpLocked() {
+	for len(c.queue) > 0 && len(c.inflight) < int(c.cwnd) {
+		seg := &segment{seq: c.nextSeq, data: c.queue[0]}
+		c.queue = c.queue[1:]
+		c.nextSeq++
+		c.inflight = append(c.inflight, seg)
+		c.sendSegmentLocked(seg)
+	}
+}
+
+func (c *Conn) sendSegmentLocked(seg *segment) {
+	seg.sentAt = time.Now()
+	c.sendLocked(packet{typ: packetData, seq: seg.seq, ack: c.expected, data: seg.data})
+}
+
+func (c *Conn) resendLocked(seg *segment) {
+	seg.retries++
+	c.sendSegmentLocked(seg)
+}
+
+func (c *Conn) sendAckLocked() {
+	c.sendLocked(packet{typ: packetAck, ack: c.expected})
+}
+
+func (c *Conn) sendLocked(p packet) {
+	p.connID = c.id
+	c.lastSend = time.Now()
+	c.ep.send(c.remote, p)
+}
+
+func (c *Conn) sendControl(typ byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendLocked(packet{typ: typ})
+}
+
+func (c *Conn) sendPacket(p packet) {
+	c.ep.send(c.remote, p)
+}
+
+// timerLoop retransmits the lost segments, sends the keepalives
+// and finishes the connection on Close or when the remote side is gone
+func (c *Conn) timerLoop() {
+	ticker := time.NewTicker(timerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		if c.isClosed {
+			c.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		if now.Sub(c.lastRecv) > idleTimeout {
+			c.finishLocked(errTimeout)
+			c.mu.Unlock()
+			return
+		}
+		if len(c.inflight) > 0 && now.Sub(c.inflight[0].sentAt) > c.rto {
+			if c.inflight[0].retries >= maxRetries {
+				c.finishLocked(errTimeout)
+				c.mu.Unlock()
+				return
+			}
+			// every timed out segment is resent, there can be several holes
+			// in the window, the loss is reacted to once per timeout
+			for _, seg := range c.inflight {
+				if now.Sub(seg.sentAt) > c.rto {
+					c.resendLocked(seg)
+				}
+			}
+			c.onLossLocked(true)
+			c.rto = min(c.rto*2, maxRTO)
+		}
+		if c.isClosing && ((len(c.queue) == 0 && len(c.inflight) == 0) || now.Sub(c.closingAt) > closeLinger) {
+			for i := 0; i < finRepetitions; i++ {
+				c.sendLocked(packet{typ: packetFin, seq: c.nextSeq})
+			}
+			c.finishLocked(net.ErrClosed)
+			c.mu.Unlock()
+			return
+		}
+		if c.finSeq != nil && c.expected == *c.finSeq && len(c.readBuf) == 0 && len(c.inflight) == 0 {
+			c.finishLocked(io.EOF)
+			c.mu.Unlock()
+			return
+		}
+		if now.Sub(c.lastSend) > keepAlive {
+			c.sendAckLocked()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// finishLocked marks the connection closed and removes it from the endpoint
+func (c *Conn) finishLocked(err error) {
+	if c.isClosed {
+		return
+	}
+	c.isClosed = true
+	c.closeErr = err
+	c.cond.Broadcast()
+	go c.ep.removeConn(c)
+}
+
+// abort closes the connection without sending the unacked data
+func (c *Conn) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishLocked(err)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.readBuf) == 0 && !c.isClosed && !c.isClosing && !c.isRemoteFinishedLocked() {
+		c.cond.Wait()
+	}
+	if len(c.readBuf) > 0 {
+		n := copy(p, c.readBuf)
+		c.readBuf = c.readBuf[n:]
+		return n, nil
+	}
+	if c.isRemoteFinishedLocked() {
+		return 0, io.EOF
+	}
+	if c.closeErr != nil && c.closeErr != io.EOF {
+		return 0, c.closeErr
+	}
+	return 0, net.ErrClosed
+}
+
+// isRemoteFinishedLocked reports whether the remote side has closed the connection
+// and all its data is received
+func (c *Conn) isRemoteFinishedLocked() bool {
+	return c.finSeq != nil && c.expected == *c.finSeq
+}
+
+// Write queues the data and blocks while the send buffer is full
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		for len(c.queue)+len(c.inflight) >= sendBuffer && !c.isClosed && !c.isClosing {
+			c.cond.Wait()
+		}
+		if c.isClosed || c.isClosing || c.finSeq != nil {
+			return written, net.ErrClosed
+		}
+		size := min(len(p)-written, maxSegmentSize)
+		c.queue = append(c.queue, append([]byte{}, p[written:written+size]...))
+		written += size
+		c.pumpLocked()
+	}
+	return written, nil
+}
+
+// Close sends the unacked data (for up to closeLinger) and then the fin
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed || c.isClosing {
+		return nil
+	}
+	if !c.isOpen {
+		c.finishLocked(net.ErrClosed)
+		return nil
+	}
+	c.isClosing = true
+	c.closingAt = time.Now()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.ep.conn.LocalAddr() }
+
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error { return nil }
+
+func (c *Conn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
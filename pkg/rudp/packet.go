@@ -0,0 +1,54 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	packetSyn    byte = 1 // dialer -> listener, resent until synack
+	packetSynAck byte = 2
+	packetData   byte = 3
+	packetAck    byte = 4 // also sent as the keepalive
+	packetFin    byte = 5 // seq is the seq of the last data packet + 1
+
+	headerSize = 1 + 4 + 4 + 4
+	// maxSegmentSize keeps the datagrams under the common path MTU (QUIC's 1200 bytes minimum)
+	maxSegmentSize = 1200 - headerSize
+)
+
+// packet is [type:1][conn id:4][seq:4][ack:4][data...], ack is the next expected seq
+type packet struct {
+	typ    byte
+	connID uint32
+	seq    uint32
+	ack    uint32
+	data   []byte
+}
+
+func (p packet) marshal() []byte {
+	buf := make([]byte, headerSize, headerSize+len(p.data))
+	buf[0] = p.typ
+	binary.BigEndian.PutUint32(buf[1:], p.connID)
+	binary.BigEndian.PutUint32(buf[5:], p.seq)
+	binary.BigEndian.PutUint32(buf[9:], p.ack)
+	return append(buf, p.data...)
+}
+
+func unmarshalPacket(buf []byte) (packet, error) {
+	if len(buf) < headerSize || buf[0] < packetSyn || buf[0] > packetFin {
+		return packet{}, errors.New("invalid packet")
+	}
+	return packet{
+		typ:    buf[0],
+		connID: binary.BigEndian.Uint32(buf[1:]),
+		seq:    binary.BigEndian.Uint32(buf[5:]),
+		ack:    binary.BigEndian.Uint32(buf[9:]),
+		data:   append([]byte{}, buf[headerSize:]...),
+	}, nil
+}
+
+// seqBefore compares the sequence numbers with the wrap-around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
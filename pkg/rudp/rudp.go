@@ -0,0 +1,267 @@
+// rudp is a reliable, ordered stream protocol over UDP (a tiny QUIC/TCP-like protocol).
+// UDP hole punching works on far more NATs than the TCP simultaneous open,
+// so the nodes behind NATs can connect to each other over rudp when TCP fails.
+//
+// Every connection is identified by the remote address and a random connection id.
+// Data is split into the segments which fit into a single datagram, the segments
+// are numbered, acknowledged cumulatively by the receiver (which reorders them)
+// and retransmitted by the sender on timeout (RTO from the smoothed RTT,
+// like in RFC 6298) or after 3 duplicate acks. Congestion control is TCP Reno-like:
+// slow start, then AIMD of the congestion window, halved on the losses.
+//
+// A single UDP socket serves the listener and all its connections, and the listener
+// can dial from the same socket (Listener.Dial), so the NAT mapping created by the
+// outgoing packets is the one the remote node sends its packets to. When both nodes
+// dial each other at the same time (the hole punching), the connections are merged.
+//
+// Simplifications (KISS): no encryption (the layers above are responsible for it),
+// no path MTU discovery, no flow control beyond the fixed receive window,
+// and no connection migration (the connection is bound to the remote address).
+package rudp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	synInterval   = 250 * time.Millisecond
+	maxSyns       = 20 // the dial fails after 5s without the answer to the SYNs
+	acceptBacklog = 64
+)
+
+// endpoint is a UDP socket shared by the connections with different remote addresses
+type endpoint struct {
+	conn      *net.UDPConn
+	mu        sync.Mutex
+	conns     map[string]*Conn
+	accept    chan *Conn // nil for the dial-only endpoints
+	isClosing bool       // no new connections, the socket is closed with the last connection
+	closed    chan struct{}
+	closeOnce sync.Once
+	lossRate  atomic.Uint32 // percent of the outgoing packets dropped, for tests
+}
+
+func newEndpoint(conn *net.UDPConn, accept bool) *endpoint {
+	ep := &endpoint{
+		conn:   conn,
+		conns:  map[string]*Conn{},
+		closed: make(chan struct{}),
+	}
+	if accept {
+		ep.accept = make(chan *Conn, acceptBacklog)
+	}
+	go ep.readLoop()
+	return ep
+}
+
+func (ep *endpoint) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := ep.conn.ReadFromUDP(buf)
+		if err != nil {
+			ep.close()
+			return
+		}
+		p, err := unmarshalPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		ep.handlePacket(p, addr)
+	}
+}
+
+func (ep *endpoint) handlePacket(p packet, addr *net.UDPAddr) {
+	ep.mu.Lock()
+	c, ok := ep.conns[addr.String()]
+	if p.typ == packetSyn && !ok {
+		if ep.accept == nil || ep.isClosing {
+			ep.mu.Unlock()
+			return
+		}
+		c = newConn(ep, addr, p.connID)
+		ep.conns[addr.String()] = c
+		select {
+		case ep.accept <- c:
+		default:
+			// backlog is full, the dialer will retry
+			delete(ep.conns, addr.String())
+			ep.mu.Unlock()
+			return
+		}
+		ep.mu.Unlock()
+		c.establish(p.connID)
+		c.sendControl(packetSynAck)
+		return
+	}
+	ep.mu.Unlock()
+	if ok {
+		c.handlePacket(p)
+	}
+}
+
+func (ep *endpoint) send(addr *net.UDPAddr, p packet) {
+	if loss := ep.lossRate.Load(); loss > 0 && mathrand.Uint32N(100) < loss {
+		return
+	}
+	ep.conn.WriteToUDP(p.marshal(), addr)
+}
+
+// dial creates the connection to the addr from this endpoint's socket and waits for the handshake
+func (ep *endpoint) dial(ctx context.Context, addr *net.UDPAddr) (*Conn, error) {
+	ep.mu.Lock()
+	if _, ok := ep.conns[addr.String()]; ok {
+		ep.mu.Unlock()
+		return nil, fmt.Errorf("already connected to %s", addr)
+	}
+	if ep.isClosing {
+		ep.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	c := newConn(ep, addr, randomConnID())
+	ep.conns[addr.String()] = c
+	ep.mu.Unlock()
+
+	ticker := time.NewTicker(synInterval)
+	defer ticker.Stop()
+	for syns := 0; ; syns++ {
+		if syns == maxSyns {
+			c.abort(errTimeout)
+			return nil, fmt.Errorf("failed to connect to udp %s: %w", addr, errTimeout)
+		}
+		c.sendControl(packetSyn)
+		select {
+		case <-c.established:
+			return c, nil
+		case <-ctx.Done():
+			c.abort(ctx.Err())
+			return nil, fmt.Errorf("failed to connect to udp %s: %w", addr, ctx.Err())
+		case <-ep.closed:
+			c.abort(net.ErrClosed)
+			return nil, net.ErrClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeConn is called when the connection is finished,
+// the socket is closed with the last connection if the endpoint is closing
+func (ep *endpoint) removeConn(c *Conn) {
+	ep.mu.Lock()
+	if ep.conns[c.remote.String()] == c {
+		delete(ep.conns, c.remote.String())
+	}
+	isDone := ep.isClosing && len(ep.conns) == 0
+	ep.mu.Unlock()
+	if isDone {
+		ep.close()
+	}
+}
+
+// shutdown stops accepting and dialing, the socket is closed when all the connections are finished
+func (ep *endpoint) shutdown() {
+	ep.mu.Lock()
+	ep.isClosing = true
+	isDone := len(ep.conns) == 0
+	ep.mu.Unlock()
+	if isDone {
+		ep.close()
+	}
+}
+
+func (ep *endpoint) close() {
+	ep.closeOnce.Do(func() {
+		close(ep.closed)
+		ep.conn.Close()
+		ep.mu.Lock()
+		conns := make([]*Conn, 0, len(ep.conns))
+		for _, c := range ep.conns {
+			conns = append(conns, c)
+		}
+		ep.mu.Unlock()
+		for _, c := range conns {
+			c.abort(net.ErrClosed)
+		}
+	})
+}
+
+func randomConnID() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
+
+type Listener struct {
+	ep *endpoint
+}
+
+// Listen accepts the connections on the UDP addr (i.e. ":5000")
+func Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ep: newEndpoint(conn, true)}, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ep.accept:
+		return c, nil
+	case <-l.ep.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting the connections, the established ones are kept
+func (l *Listener) Close() error {
+	l.ep.shutdown()
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ep.conn.LocalAddr()
+}
+
+// Dial connects to the addr from the listener's socket, see the package doc
+func (l *Listener) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.ep.dial(ctx, udpAddr)
+}
+
+// Dial connects to the addr from a new socket, which is closed with the connection
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	ep := newEndpoint(conn, false)
+	c, err := ep.dial(ctx, udpAddr)
+	if err != nil {
+		ep.close()
+		return nil, err
+	}
+	ep.shutdown()
+	return c, nil
+}
+
+var errTimeout = errors.New("rudp: connection timed out")
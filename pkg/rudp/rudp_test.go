@@ -0,0 +1,140 @@
+package rudp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *Listener {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.ep.close() })
+	return l
+}
+
+func connID(conn net.Conn) uint32 {
+	c := conn.(*Conn)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+func TestRUDP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Run("data is delivered intact and in order over lossy links", func(t *testing.T) {
+		l := listen(t)
+		l.ep.lossRate.Store(10)
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+		client, err := Dial(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.(*Conn).ep.lossRate.Store(10)
+		server := <-accepted
+
+		data := make([]byte, 512*1024)
+		rand.Read(data)
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		received, err := io.ReadAll(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatalf("Expected %d bytes, got %d different ones", len(data), len(received))
+		}
+	})
+
+	t.Run("both sides can send at the same time", func(t *testing.T) {
+		l := listen(t)
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := l.Accept()
+			accepted <- conn
+		}()
+		client, err := Dial(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := <-accepted
+		for _, pair := range [][2]net.Conn{{client, server}, {server, client}} {
+			go pair[0].Write(bytes.Repeat([]byte("x"), 100_000))
+		}
+		for _, conn := range []net.Conn{client, server} {
+			buf := make([]byte, 100_000)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("simultaneous dials from the listening sockets are merged", func(t *testing.T) {
+		a := listen(t)
+		b := listen(t)
+		results := make(chan net.Conn, 2)
+		for _, pair := range [][2]*Listener{{a, b}, {b, a}} {
+			go func() {
+				conn, err := pair[0].Dial(ctx, pair[1].Addr().String())
+				if err != nil {
+					// the other side's syn came first, the connection is accepted instead
+					conn, err = pair[0].Accept()
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				results <- conn
+			}()
+		}
+		connA, connB := <-results, <-results
+		if connID(connA) != connID(connB) {
+			t.Fatal("Expected both sides to use the same connection id")
+		}
+		connA.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(connB, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("Unexpected %q, %v", buf, err)
+		}
+	})
+
+	t.Run("dial fails when nobody listens", func(t *testing.T) {
+		l := listen(t)
+		addr := l.Addr().String()
+		l.ep.close()
+		ctx, cancel := context.WithTimeout(ctx, 600*time.Millisecond)
+		defer cancel()
+		if _, err := Dial(ctx, addr); err == nil {
+			t.Error("Expected the dial error")
+		}
+	})
+
+	t.Run("dial gives up after the last SYN", func(t *testing.T) {
+		l := listen(t)
+		addr := l.Addr().String()
+		l.ep.close()
+		start := time.Now()
+		if _, err := Dial(ctx, addr); !errors.Is(err, errTimeout) {
+			t.Errorf("Expected the timeout error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > maxSyns*synInterval+time.Second {
+			t.Errorf("Expected the dial to give up after %s, took %s", maxSyns*synInterval, elapsed)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package tcp_conn
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// CompressionFlate is the only supported compression for now. The connection
+// always accepts compressed messages, SetCompression only enables sending them,
+// so it must be called once the remote side is known to support it (see the node's hello).
+const CompressionFlate = "flate"
+
+// Compressions are the supported compressions in the order of preference
+var Compressions = []string{CompressionFlate}
+
+// MsgTypeCompressed wraps the compressed TCPMessagePayload
+const MsgTypeCompressed = "tcp_conn_flate"
+
+const (
+	minCompressSize = 512 // smaller payloads are not worth compressing
+	// sampleSize of the payload is compressed first to detect the already compressed data
+	sampleSize = 4096
+	// maxCompressedRatio: payloads which don't get smaller than that are sent as is
+	maxCompressedRatio = 0.9
+)
+
+// CompressionStats counts the messages with the payloads of at least minCompressSize bytes
+type CompressionStats struct {
+	Algorithm  string // empty when the compression is off
+	Compressed uint64 // messages sent compressed
+	Skipped    uint64 // messages which didn't compress well and were sent as is
+	BytesIn    uint64 // size of the compressed messages before the compression
+	BytesOut   uint64 // and after it
+}
+
+// Ratio of the compressed messages' size before and after the compression
+func (s CompressionStats) Ratio() float64 {
+	if s.BytesOut == 0 {
+		return 1
+	}
+	return float64(s.BytesIn) / float64(s.BytesOut)
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// SetCompression enables sending compressed messages, empty algorithm disables it
+func (c *TCPConn) SetCompression(algorithm string) error {
+	if algorithm != "" && algorithm != CompressionFlate {
+		return fmt.Errorf("unsupported compression: %s", algorithm)
+	}
+	c.compressMu.Lock()
+	defer c.compressMu.Unlock()
+	c.compression.Algorithm = algorithm
+	return nil
+}
+
+func (c *TCPConn) CompressionStats() CompressionStats {
+	c.compressMu.Lock()
+	defer c.compressMu.Unlock()
+	return c.compression
+}
+
+// compress returns the payload wrapped into MsgTypeCompressed message,
+// or the payload itself if it's small, doesn't compress or the compression is off
+func (c *TCPConn) compress(payload *pb.TCPMessagePayload) (*pb.TCPMessagePayload, error) {
+	c.compressMu.Lock()
+	enabled := c.compression.Algorithm != ""
+	c.compressMu.Unlock()
+	if !enabled || len(payload.Data) < minCompressSize {
+		return payload, nil
+	}
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var compressed []byte
+	if len(data) <= sampleSize || compressesWell(data[:sampleSize]) {
+		compressed = deflate(data)
+	}
+	c.compressMu.Lock()
+	defer c.compressMu.Unlock()
+	if compressed == nil || float64(len(compressed)) > maxCompressedRatio*float64(len(data)) {
+		c.compression.Skipped++
+		return payload, nil
+	}
+	c.compression.Compressed++
+	c.compression.BytesIn += uint64(len(data))
+	c.compression.BytesOut += uint64(len(compressed))
+	return &pb.TCPMessagePayload{Type: MsgTypeCompressed, Data: compressed}, nil
+}
+
+func compressesWell(sample []byte) bool {
+	return float64(len(deflate(sample))) <= maxCompressedRatio*float64(len(sample))
+}
+
+func deflate(data []byte) []byte {
+	buf := bytes.Buffer{}
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// decompress unwraps the MsgTypeCompressed messages, other messages are returned as is
+func decompress(payload *pb.TCPMessagePayload) (*pb.TCPMessagePayload, error) {
+	if payload.Type != MsgTypeCompressed {
+		return payload, nil
+	}
+	r := flate.NewReader(bytes.NewReader(payload.Data))
+	defer r.Close()
+	// limit the size, so a tiny message can't inflate into gigabytes
+	data, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("decompressed message is larger than %d bytes", maxMessageSize)
+	}
+	msg := &pb.TCPMessagePayload{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal decompressed message: %w", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,143 @@
+package tcp_conn
+
+import (
+	"fmt"
+
+	"github.com/ulshv/nexuslink/pkg/tcp_message"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Priority of the outgoing message. Every priority has its own lane in the send queue,
+// the writer picks the frames from the highest priority lane first. Large bulk
+// messages are split into fragments, so a file chunk delays a ping or a chat line
+// by a single fragment at most.
+type Priority int
+
+const (
+	PriorityControl     Priority = iota // handshakes and pings
+	PriorityInteractive                 // chat, requests and any other message by default
+	PriorityBulk                        // file chunks and other large messages
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// PriorityFunc returns the priority of the message by its type
+type PriorityFunc func(msgType string) Priority
+
+const (
+	MsgTypeFragment    = "tcp_conn_fragment"     // a part of the bulk message
+	MsgTypeFragmentEnd = "tcp_conn_fragment_end" // the last part of the bulk message
+)
+
+const (
+	fragmentSize = 16 * 1024
+	// bulkEvery is the number of higher priority frames after which a bulk frame
+	// is written anyway, so a busy chat doesn't stall the file transfers completely
+	bulkEvery = 16
+	// maxMessageSize is the limit of the reassembled message, the same as the TCPMessage's one
+	maxMessageSize = 1024 * 1024
+)
+
+// encode makes the frames of the message, large bulk messages are fragmented
+func (c *TCPConn) encode(payload *pb.TCPMessagePayload, prio Priority) ([][]byte, error) {
+	if prio != PriorityBulk || len(payload.Data) < fragmentSize {
+		msg, err := tcp_message.NewTCPMessage(c.logger, payload)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{msg}, nil
+	}
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	frames := [][]byte{}
+	for len(data) > 0 {
+		n := min(fragmentSize, len(data))
+		msgType := MsgTypeFragment
+		if n == len(data) {
+			msgType = MsgTypeFragmentEnd
+		}
+		frame, err := tcp_message.NewTCPMessage(c.logger, &pb.TCPMessagePayload{Type: msgType, Data: data[:n]})
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+		data = data[n:]
+	}
+	return frames, nil
+}
+
+// nextFrameLocked picks the next frame to write, must be called with c.queueMu locked.
+// last is true when it's the last frame of the message.
+func (c *TCPConn) nextFrameLocked() (frame []byte, last bool, ok bool) {
+	bulkWaiting := len(c.bulk) > 0 || len(c.lanes[PriorityBulk]) > 0
+	for prio := PriorityControl; prio < PriorityBulk; prio++ {
+		if len(c.lanes[prio]) == 0 || (bulkWaiting && c.sinceBulk >= bulkEvery) {
+			continue
+		}
+		frames := c.popLocked(prio)
+		if bulkWaiting {
+			c.sinceBulk++
+		}
+		return frames[0], true, true
+	}
+	if !bulkWaiting {
+		return nil, false, false
+	}
+	c.sinceBulk = 0
+	if len(c.bulk) == 0 {
+		c.bulk = c.popLocked(PriorityBulk)
+	}
+	frame = c.bulk[0]
+	c.bulk = c.bulk[1:]
+	return frame, len(c.bulk) == 0, true
+}
+
+func (c *TCPConn) popLocked(prio Priority) [][]byte {
+	frames := c.lanes[prio][0]
+	c.lanes[prio][0] = nil
+	c.lanes[prio] = c.lanes[prio][1:]
+	return frames
+}
+
+// reassembler collects the fragments of the bulk messages. The sender writes
+// the fragments of one message at a time, so there's a single message to collect.
+type reassembler struct {
+	buf []byte
+}
+
+// add returns the payload as is, or the reassembled message when the last fragment
+// is received, or nil when the message is incomplete
+func (r *reassembler) add(payload *pb.TCPMessagePayload) (*pb.TCPMessagePayload, error) {
+	if payload.Type != MsgTypeFragment && payload.Type != MsgTypeFragmentEnd {
+		return payload, nil
+	}
+	if len(r.buf)+len(payload.Data) > maxMessageSize {
+		r.buf = nil
+		return nil, fmt.Errorf("fragmented message is larger than %d bytes", maxMessageSize)
+	}
+	r.buf = append(r.buf, payload.Data...)
+	if payload.Type == MsgTypeFragment {
+		return nil, nil
+	}
+	msg := &pb.TCPMessagePayload{}
+	err := proto.Unmarshal(r.buf, msg)
+	r.buf = nil
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fragmented message: %w", err)
+	}
+	return msg, nil
+}
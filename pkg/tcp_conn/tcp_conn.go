@@ -1,5 +1,314 @@
+// TCPConn is a framed connection on top of net.Conn.
+// It sends and receives TCPMessagePayload's using the tcp_message package,
+// so the app code doesn't have to deal with raw bytes, headers and partial writes.
+//
+// Outgoing messages go through a bounded queue written by a separate goroutine,
+// so a slow remote side never blocks the other connections of the app.
+// What happens when the queue is full is decided by its QueuePolicy.
+// The queue has a lane per message priority (see priority.go).
+// Messages can be compressed, see compression.go.
 package tcp_conn
 
-func Foo() {
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+var (
+	ErrConnClosed   = errors.New("connection closed")
+	ErrSlowConsumer = errors.New("send queue is full")
+)
+
+type QueuePolicy string
+
+const (
+	PolicyBlock      QueuePolicy = "block"       // Send waits until there's room in the queue
+	PolicyDropOldest QueuePolicy = "drop-oldest" // the oldest queued message is dropped
+	PolicyDisconnect QueuePolicy = "disconnect"  // the slow consumer is disconnected
+)
+
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch policy := QueuePolicy(s); policy {
+	case PolicyBlock, PolicyDropOldest, PolicyDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown queue policy: %s", s)
+}
+
+// QueueOptions of the outgoing messages queue, Size is the limit of every priority lane.
+// Zero Size means DefaultQueueOptions.Size.
+type QueueOptions struct {
+	Size   int
+	Policy QueuePolicy
+}
+
+var DefaultQueueOptions = QueueOptions{Size: 256, Policy: PolicyBlock}
+
+// QueueStats is the snapshot of the connection's send queue
+type QueueStats struct {
+	QueueOptions
+	Depth    int                // messages waiting to be written
+	Lanes    [numPriorities]int // Depth by priority
+	MaxDepth int                // the highest Depth since the connection was opened
+	Sent     uint64             // messages written to the connection
+	Dropped  uint64             // messages dropped by the queue policy
+}
+
+// closeTimeout limits the time Close() spends writing the queued messages
+const closeTimeout = 5 * time.Second
+
+type TCPConn struct {
+	conn    net.Conn
+	logger  logs.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	msgCh   chan *pb.TCPMessagePayload
+	queueMu sync.Mutex
+	cond    *sync.Cond // signalled when the queue or the connection state changes
+	// every queued message is a list of frames, see encode()
+	lanes      [numPriorities][][][]byte
+	bulk       [][]byte // the remaining fragments of the bulk message being written
+	sinceBulk  int      // frames written while the bulk lane was waiting
+	priorityOf PriorityFunc
+	closing    bool // Close() was called, the queue is being flushed
+	stats      QueueStats
+
+	compressMu  sync.Mutex
+	compression CompressionStats
+}
+
+// NewTCPConn starts reading messages from the conn in a separate goroutine.
+// The connection is closed when ctx is cancelled, Close() is called
+// or the remote side closes the connection.
+func NewTCPConn(ctx context.Context, logger logs.Logger, conn net.Conn) *TCPConn {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &TCPConn{
+		conn:   conn,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+		msgCh:  make(chan *pb.TCPMessagePayload),
+		stats:  QueueStats{QueueOptions: DefaultQueueOptions},
+	}
+	c.cond = sync.NewCond(&c.queueMu)
+	rawCh := make(chan *pb.TCPMessagePayload)
+	go tcp_message.ReadTCPMessagesLoop(ctx, logger, rawCh, connReader{conn})
+	go c.readLoop(rawCh)
+	go c.writeLoop()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		// wake up the writer and the blocked senders
+		c.queueMu.Lock()
+		c.cond.Broadcast()
+		c.queueMu.Unlock()
+	}()
+	return c
+}
+
+// SetQueueOptions changes the size and the policy of the send queue.
+// Messages already in the queue are kept even if it's shrunk.
+func (c *TCPConn) SetQueueOptions(opts QueueOptions) {
+	if opts.Size <= 0 {
+		opts.Size = DefaultQueueOptions.Size
+	}
+	if opts.Policy == "" {
+		opts.Policy = DefaultQueueOptions.Policy
+	}
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.stats.QueueOptions = opts
+	c.cond.Broadcast()
+}
+
+// SetPriorityFunc sets the priority of the messages sent with Send,
+// without it all the messages are PriorityInteractive
+func (c *TCPConn) SetPriorityFunc(f PriorityFunc) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.priorityOf = f
+}
+
+func (c *TCPConn) QueueStats() QueueStats {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	stats := c.stats
+	for prio := range c.lanes {
+		stats.Lanes[prio] = len(c.lanes[prio])
+		stats.Depth += len(c.lanes[prio])
+	}
+	return stats
+}
+
+// readLoop passes the received messages to msgCh, reassembling the fragmented ones
+func (c *TCPConn) readLoop(rawCh <-chan *pb.TCPMessagePayload) {
+	r := reassembler{}
+	for payload := range rawCh {
+		payload, err := r.add(payload)
+		if err != nil {
+			c.logger.Error("Failed to reassemble message", "addr", c.RemoteAddr(), "error", err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		if payload, err = decompress(payload); err != nil {
+			c.logger.Error("Failed to decompress message", "addr", c.RemoteAddr(), "error", err)
+			continue
+		}
+		// the messages of the closed connection are dropped if nobody reads them,
+		// the reader stops on ctx.Done and closes rawCh
+		select {
+		case c.msgCh <- payload:
+		case <-c.ctx.Done():
+		}
+	}
+	close(c.msgCh)
+	c.Close()
+}
+
+// Messages returns the channel with received payloads.
+// It's closed when the connection is closed.
+func (c *TCPConn) Messages() <-chan *pb.TCPMessagePayload {
+	return c.msgCh
+}
+
+// Done is closed when the connection is closed.
+func (c *TCPConn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Send queues the message with the priority of its type (see SetPriorityFunc)
+func (c *TCPConn) Send(payload *pb.TCPMessagePayload) error {
+	c.queueMu.Lock()
+	priorityOf := c.priorityOf
+	c.queueMu.Unlock()
+	prio := PriorityInteractive
+	if priorityOf != nil {
+		prio = priorityOf(payload.Type)
+	}
+	return c.SendPriority(payload, prio)
+}
+
+// SendPriority queues the message for writing. When the message's lane is full,
+// the message is handled according to the queue policy: SendPriority blocks,
+// drops the oldest queued message of the lane or closes the connection and returns ErrSlowConsumer.
+func (c *TCPConn) SendPriority(payload *pb.TCPMessagePayload, prio Priority) error {
+	if prio < 0 || prio >= numPriorities {
+		return fmt.Errorf("invalid priority: %s", prio)
+	}
+	payload, err := c.compress(payload)
+	if err != nil {
+		return err
+	}
+	frames, err := c.encode(payload, prio)
+	if err != nil {
+		return err
+	}
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	for {
+		if c.ctx.Err() != nil || c.closing {
+			return ErrConnClosed
+		}
+		if len(c.lanes[prio]) < c.stats.Size {
+			break
+		}
+		switch c.stats.Policy {
+		case PolicyDropOldest:
+			c.popLocked(prio)
+			c.stats.Dropped++
+		case PolicyDisconnect:
+			c.stats.Dropped++
+			c.logger.Warn("Disconnecting slow consumer", "addr", c.RemoteAddr(), "priority", prio, "queued", len(c.lanes[prio]))
+			c.cancel()
+			return fmt.Errorf("failed to send message to %s: %w", c.RemoteAddr(), ErrSlowConsumer)
+		default:
+			c.cond.Wait()
+		}
+	}
+	c.lanes[prio] = append(c.lanes[prio], frames)
+	depth := 0
+	for _, lane := range c.lanes {
+		depth += len(lane)
+	}
+	c.stats.MaxDepth = max(c.stats.MaxDepth, depth)
+	c.cond.Broadcast()
+	return nil
+}
+
+// writeLoop writes the queued frames one by one, so the writes never interleave
+func (c *TCPConn) writeLoop() {
+	for {
+		c.queueMu.Lock()
+		frame, last, ok := c.nextFrameLocked()
+		for !ok && !c.closing && c.ctx.Err() == nil {
+			c.cond.Wait()
+			frame, last, ok = c.nextFrameLocked()
+		}
+		if c.ctx.Err() != nil || !ok {
+			c.queueMu.Unlock()
+			c.cancel()
+			return
+		}
+		c.cond.Broadcast()
+		c.queueMu.Unlock()
+
+		if _, err := c.conn.Write(frame); err != nil {
+			if c.ctx.Err() == nil {
+				c.logger.Debug("Failed to write message", "addr", c.RemoteAddr(), "error", err)
+			}
+			c.cancel()
+			return
+		}
+		if last {
+			c.queueMu.Lock()
+			c.stats.Sent++
+			c.queueMu.Unlock()
+		}
+	}
+}
+
+// Close writes the already queued messages (for up to closeTimeout) and closes the connection
+func (c *TCPConn) Close() error {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if !c.closing {
+		c.closing = true
+		c.cond.Broadcast()
+		time.AfterFunc(closeTimeout, c.cancel)
+	}
+	return nil
+}
+
+func (c *TCPConn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *TCPConn) LocalAddr() string {
+	return c.conn.LocalAddr().String()
+}
+
+// ReadTCPMessagesLoop treats io.EOF as "no data yet" (it's written with
+// non-blocking readers like bytes.Buffer in mind), but for a net.Conn
+// io.EOF means that the remote side has closed the connection.
+type connReader struct {
+	conn net.Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if err == io.EOF {
+		return n, ErrConnClosed
+	}
+	return n, err
 }
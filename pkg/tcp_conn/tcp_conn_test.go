@@ -0,0 +1,235 @@
+package tcp_conn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+// slowPair returns the sending conn and the remote side of the pipe which isn't read
+// until the test starts the receiving conn on it. The first message is already sent,
+// and the writer is blocked on it, so the queue fills up predictably.
+func slowPair(t *testing.T, ctx context.Context, opts QueueOptions) (*TCPConn, net.Conn) {
+	logger := logs.NewSlogLogger("tcp_conn_test")
+	local, remote := net.Pipe()
+	conn := NewTCPConn(ctx, logger, local)
+	conn.SetQueueOptions(opts)
+	if err := conn.Send(message(0)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.QueueStats().Depth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the writer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return conn, remote
+}
+
+func message(i int) *pb.TCPMessagePayload {
+	return &pb.TCPMessagePayload{Type: "msg", Data: []byte(strconv.Itoa(i))}
+}
+
+// expectMessages reads the messages from the remote side of the pipe
+func expectMessages(t *testing.T, ctx context.Context, remote net.Conn, expected ...int) {
+	receiver := NewTCPConn(ctx, logs.NewSlogLogger("tcp_conn_test"), remote)
+	for _, i := range expected {
+		select {
+		case payload := <-receiver.Messages():
+			if payload == nil || string(payload.Data) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d, got %v", i, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	t.Run("block policy makes the sender wait for the slow consumer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn, remote := slowPair(t, ctx, QueueOptions{Size: 2, Policy: PolicyBlock})
+		conn.Send(message(1))
+		conn.Send(message(2))
+
+		sent := make(chan error, 1)
+		go func() { sent <- conn.Send(message(3)) }()
+		select {
+		case <-sent:
+			t.Fatal("Expected Send to block on the full queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if stats := conn.QueueStats(); stats.Depth != 2 || stats.MaxDepth != 2 {
+			t.Errorf("Expected the full queue, got %+v", stats)
+		}
+
+		expectMessages(t, ctx, remote, 0, 1, 2, 3)
+		if err := <-sent; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("drop-oldest policy keeps the newest messages", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn, remote := slowPair(t, ctx, QueueOptions{Size: 2, Policy: PolicyDropOldest})
+		for i := 1; i <= 10; i++ {
+			if err := conn.Send(message(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats := conn.QueueStats(); stats.Dropped != 8 || stats.Depth != 2 {
+			t.Errorf("Expected 8 dropped and 2 queued messages, got %+v", stats)
+		}
+		expectMessages(t, ctx, remote, 0, 9, 10)
+	})
+
+	t.Run("disconnect policy closes the slow consumer's connection", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn, _ := slowPair(t, ctx, QueueOptions{Size: 2, Policy: PolicyDisconnect})
+		conn.Send(message(1))
+		conn.Send(message(2))
+		if err := conn.Send(message(3)); !errors.Is(err, ErrSlowConsumer) {
+			t.Fatalf("Expected ErrSlowConsumer, got %v", err)
+		}
+		select {
+		case <-conn.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the connection to be closed")
+		}
+		if err := conn.Send(message(4)); !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Expected ErrConnClosed, got %v", err)
+		}
+	})
+
+	t.Run("close writes the queued messages first", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn, remote := slowPair(t, ctx, QueueOptions{Size: 8, Policy: PolicyBlock})
+		conn.Send(message(1))
+		conn.Send(message(2))
+		conn.Close()
+		if err := conn.Send(message(3)); !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Expected ErrConnClosed after Close, got %v", err)
+		}
+		expectMessages(t, ctx, remote, 0, 1, 2)
+		select {
+		case <-conn.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the connection to be closed after the flush")
+		}
+	})
+}
+
+func TestPriorityLanes(t *testing.T) {
+	t.Run("control and interactive messages overtake the queued bulk ones", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn, remote := slowPair(t, ctx, QueueOptions{Size: 8, Policy: PolicyBlock})
+		conn.SendPriority(message(1), PriorityBulk)
+		conn.SendPriority(message(2), PriorityInteractive)
+		conn.SendPriority(message(3), PriorityControl)
+		if stats := conn.QueueStats(); stats.Lanes != [numPriorities]int{1, 1, 1} {
+			t.Errorf("Expected a message in every lane, got %v", stats.Lanes)
+		}
+		expectMessages(t, ctx, remote, 0, 3, 2, 1)
+	})
+
+	t.Run("large bulk messages are fragmented and interleaved with the control ones", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logger := logs.NewSlogLogger("tcp_conn_test")
+		local, remote := net.Pipe()
+		conn := NewTCPConn(ctx, logger, local)
+		conn.SetPriorityFunc(func(msgType string) Priority {
+			if msgType == "chunk" {
+				return PriorityBulk
+			}
+			return PriorityControl
+		})
+		chunk := make([]byte, 10*fragmentSize)
+		for i := range chunk {
+			chunk[i] = byte(i)
+		}
+		conn.Send(&pb.TCPMessagePayload{Type: "chunk", Data: chunk})
+		// the writer is blocked on the first fragment now
+		for conn.QueueStats().Depth != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		conn.Send(&pb.TCPMessagePayload{Type: "ping"})
+
+		receiver := NewTCPConn(ctx, logger, remote)
+		for _, expected := range []string{"ping", "chunk"} {
+			select {
+			case payload := <-receiver.Messages():
+				if payload.Type != expected {
+					t.Fatalf("Expected %s, got %s", expected, payload.Type)
+				}
+				if expected == "chunk" && !bytes.Equal(payload.Data, chunk) {
+					t.Error("The reassembled chunk differs from the sent one")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %s", expected)
+			}
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	t.Run("only large compressible payloads are compressed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logger := logs.NewSlogLogger("tcp_conn_test")
+		local, remote := net.Pipe()
+		conn := NewTCPConn(ctx, logger, local)
+		receiver := NewTCPConn(ctx, logger, remote)
+		if err := conn.SetCompression(CompressionFlate); err != nil {
+			t.Fatal(err)
+		}
+
+		random := make([]byte, 64*1024)
+		rand.New(rand.NewSource(1)).Read(random)
+		payloads := [][]byte{
+			bytes.Repeat([]byte("compressible "), 5000),
+			[]byte("small"),
+			random,
+		}
+		for _, data := range payloads {
+			conn.SendPriority(&pb.TCPMessagePayload{Type: "data", Data: data}, PriorityBulk)
+		}
+		for i, data := range payloads {
+			select {
+			case payload := <-receiver.Messages():
+				if payload.Type != "data" || !bytes.Equal(payload.Data, data) {
+					t.Fatalf("Payload %d differs from the sent one", i)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for payload %d", i)
+			}
+		}
+		stats := conn.CompressionStats()
+		if stats.Compressed != 1 || stats.Skipped != 1 || stats.Ratio() < 10 {
+			t.Errorf("Expected one well compressed and one skipped message, got %+v", stats)
+		}
+	})
+
+	t.Run("unknown compression is rejected", func(t *testing.T) {
+		local, _ := net.Pipe()
+		conn := NewTCPConn(context.Background(), logs.NewSlogLogger("tcp_conn_test"), local)
+		defer conn.Close()
+		if err := conn.SetCompression("zstd"); err == nil {
+			t.Error("Expected the error")
+		}
+	})
+}
@@ -78,9 +78,13 @@ func ReadTCPMessagesLoop(
 					time.Sleep(pauseInterval)
 					continue
 				}
-				logger.Error("failed to read message prefix", "error", err)
-				continue
+				// any other error (i.e. closed connection) is permanent
+				logger.Error("failed to read message prefix, exiting ReadTCPMessagesLoop", "error", err)
+				close(ch)
+				return
 			}
+			readBytesEofCounter = 0
+			lastReadBytesPauseInterval = 0
 			logger.Debug("recieved messageHeader", "messageHeader", string(messageHeader))
 			isPrefixValid := bytes.HasPrefix(messageHeader, []byte(messageHeaderPrefix))
 			if !isPrefixValid {
@@ -136,7 +140,7 @@ func ReadTCPMessagesLoop(
 				}
 			}
 			if readPayloadErr != nil {
-				logger.Error("failed to read full message payload", "error", err)
+				logger.Error("failed to read full message payload", "error", readPayloadErr)
 				continue
 			}
 			logger.Debug("extracted TCP message payload")
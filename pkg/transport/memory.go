@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+)
+
+// Memory is the in-memory transport, connections are net.Pipe's.
+// All the nodes using the same Memory can connect to each other
+// by the names they listen on, i.e. "mem:alice".
+type Memory struct {
+	logger    logs.Logger
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	nextID    int
+}
+
+func NewMemory(logger logs.Logger) *Memory {
+	return &Memory{logger: logger, listeners: map[string]*memListener{}}
+}
+
+// Listen listens on the name, a unique name is generated if it's empty
+func (m *Memory) Listen(ctx context.Context, name string) (Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "" {
+		m.nextID++
+		name = fmt.Sprintf("node-%d", m.nextID)
+	}
+	if _, ok := m.listeners[name]; ok {
+		return nil, fmt.Errorf("mem address %s is already in use", name)
+	}
+	l := &memListener{
+		memory: m,
+		ctx:    ctx,
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.listeners[name] = l
+	return l, nil
+}
+
+func (m *Memory) Dial(ctx context.Context, name string) (*tcp_conn.TCPConn, error) {
+	m.mu.Lock()
+	l, ok := m.listeners[name]
+	m.nextID++
+	connAddr := Addr{SchemeMem, fmt.Sprintf("%s#%d", name, m.nextID)}
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to connect to mem %s: no listener", name)
+	}
+	serverSide, clientSide := net.Pipe()
+	listenAddr := Addr{SchemeMem, name}
+	select {
+	case l.conns <- addrConn{Conn: serverSide, local: listenAddr, remote: connAddr}:
+	case <-l.closed:
+		return nil, fmt.Errorf("failed to connect to mem %s: listener is closed", name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return tcp_conn.NewTCPConn(ctx, m.logger, addrConn{Conn: clientSide, local: connAddr, remote: listenAddr}), nil
+}
+
+type memListener struct {
+	memory    *Memory
+	ctx       context.Context
+	name      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (*tcp_conn.TCPConn, error) {
+	select {
+	case conn := <-l.conns:
+		return tcp_conn.NewTCPConn(l.ctx, l.memory.logger, conn), nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Addr() net.Addr {
+	return Addr{SchemeMem, l.name}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.memory.mu.Lock()
+		delete(l.memory.listeners, l.name)
+		l.memory.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,146 @@
+// transport abstracts the underlying networks of the node's connections.
+// A Transport listens and dials addresses of its network and returns
+// the framed connections (tcp_conn.TCPConn), so the node and the apps don't depend
+// on the kind of the network: TCP, Unix-domain sockets or in-memory pipes (for tests
+// and local multi-node setups without real ports), and future ones.
+//
+// Addresses are prefixed with the transport's scheme, i.e. "unix:/tmp/node.sock"
+// or "mem:alice". Addresses without a known scheme (i.e. "127.0.0.1:5000") are TCP.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+)
+
+const (
+	SchemeTCP  = "tcp"
+	SchemeUnix = "unix"
+	SchemeMem  = "mem"
+)
+
+type Transport interface {
+	// Listen accepts connections on the addr (without the scheme),
+	// ctx is the lifetime of the accepted connections
+	Listen(ctx context.Context, addr string) (Listener, error)
+	// Dial connects to the addr (without the scheme),
+	// ctx is the lifetime of the connection
+	Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error)
+}
+
+type Listener interface {
+	Accept() (*tcp_conn.TCPConn, error)
+	// Addr returns the address to dial, with the scheme for the non-TCP transports
+	Addr() net.Addr
+	Close() error
+}
+
+// SplitScheme splits the address into the transport's scheme and the address,
+// the scheme is SchemeTCP if the address has no known scheme
+func SplitScheme(addr string, schemes []string) (string, string) {
+	for _, scheme := range schemes {
+		if rest, ok := strings.CutPrefix(addr, scheme+":"); ok {
+			return scheme, rest
+		}
+	}
+	return SchemeTCP, addr
+}
+
+// Addr is the address of the non-TCP transports, its String() includes the scheme
+type Addr struct {
+	Scheme string
+	Path   string
+}
+
+func (a Addr) Network() string { return a.Scheme }
+
+func (a Addr) String() string { return a.Scheme + ":" + a.Path }
+
+// netTransport is the Transport for the networks supported by the net package
+type netTransport struct {
+	logger  logs.Logger
+	network string
+	nextID  atomic.Int64
+}
+
+// NewTCP creates the TCP transport, addresses are host:port
+func NewTCP(logger logs.Logger) Transport {
+	return &netTransport{logger: logger, network: "tcp"}
+}
+
+// NewUnix creates the Unix-domain socket transport, addresses are socket file paths
+func NewUnix(logger logs.Logger) Transport {
+	return &netTransport{logger: logger, network: "unix"}
+}
+
+func (t *netTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	listener, err := net.Listen(t.network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s %s: %w", t.network, addr, err)
+	}
+	return &netListener{transport: t, ctx: ctx, listener: listener}, nil
+}
+
+func (t *netTransport) Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, t.network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s %s: %w", t.network, addr, err)
+	}
+	if t.network == "unix" {
+		conn = addrConn{Conn: conn, local: t.connAddr(addr), remote: Addr{SchemeUnix, addr}}
+	}
+	return tcp_conn.NewTCPConn(ctx, t.logger, conn), nil
+}
+
+// connAddr is a unique address of a connection to the socket,
+// connections to the Unix sockets have no remote addresses (i.e. no ports)
+func (t *netTransport) connAddr(socketPath string) Addr {
+	return Addr{SchemeUnix, fmt.Sprintf("%s#%d", socketPath, t.nextID.Add(1))}
+}
+
+type netListener struct {
+	transport *netTransport
+	ctx       context.Context
+	listener  net.Listener
+}
+
+func (l *netListener) Accept() (*tcp_conn.TCPConn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.transport.network == "unix" {
+		path := l.listener.Addr().String()
+		conn = addrConn{Conn: conn, local: Addr{SchemeUnix, path}, remote: l.transport.connAddr(path)}
+	}
+	return tcp_conn.NewTCPConn(l.ctx, l.transport.logger, conn), nil
+}
+
+func (l *netListener) Addr() net.Addr {
+	if l.transport.network == "unix" {
+		return Addr{SchemeUnix, l.listener.Addr().String()}
+	}
+	return l.listener.Addr()
+}
+
+func (l *netListener) Close() error {
+	return l.listener.Close()
+}
+
+// addrConn overrides the addresses of the connection
+type addrConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr { return c.local }
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
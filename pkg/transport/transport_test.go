@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/tcp_message"
+	"github.com/ulshv/nexuslink/pkg/tcp_message/pb"
+)
+
+func receive(t *testing.T, conn *tcp_conn.TCPConn) *pb.TCPMessagePayload {
+	select {
+	case payload, ok := <-conn.Messages():
+		if !ok {
+			t.Fatal("connection is closed")
+		}
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	return nil
+}
+
+func TestTransports(t *testing.T) {
+	logger := logs.NewSlogLogger("transport_test")
+	tests := []struct {
+		name      string
+		transport Transport
+		addr      string
+	}{
+		{"tcp", NewTCP(logger), "127.0.0.1:0"},
+		{"unix", NewUnix(logger), filepath.Join(t.TempDir(), "node.sock")},
+		{"mem", NewMemory(logger), "alice"},
+		{"ws", NewWebSocket(logger), "127.0.0.1:0"},
+		{"udp", NewUDP(logger), "127.0.0.1:0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" connections carry the framed messages both ways", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			listener, err := test.transport.Listen(ctx, test.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			_, dialAddr := SplitScheme(listener.Addr().String(), []string{SchemeUnix, SchemeMem, SchemeWebSocket, SchemeUDP})
+
+			accepted := make(chan *tcp_conn.TCPConn, 2)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+			client, err := test.transport.Dial(ctx, dialAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := <-accepted
+			if test.name == "mem" && server.RemoteAddr() != client.LocalAddr() {
+				t.Errorf("Expected the same connection address on both sides, got %s and %s", server.RemoteAddr(), client.LocalAddr())
+			}
+
+			client.Send(&pb.TCPMessagePayload{Type: "ping", Data: []byte("1")})
+			if payload := receive(t, server); payload.Type != "ping" || string(payload.Data) != "1" {
+				t.Errorf("Unexpected payload %v", payload)
+			}
+			server.Send(&pb.TCPMessagePayload{Type: "pong", Data: []byte("1")})
+			if payload := receive(t, client); payload.Type != "pong" {
+				t.Errorf("Unexpected payload %v", payload)
+			}
+
+			// the second connection gets its own remote address on the listening side
+			if _, err := test.transport.Dial(ctx, dialAddr); err != nil {
+				t.Fatal(err)
+			}
+			if second := <-accepted; second.RemoteAddr() == server.RemoteAddr() {
+				t.Errorf("Expected unique remote addresses, got %s twice", second.RemoteAddr())
+			}
+
+			client.Close()
+			select {
+			case _, ok := <-server.Messages():
+				if ok {
+					t.Error("Expected no more messages")
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("Expected the connection to be closed on the other side")
+			}
+		})
+	}
+
+	t.Run("addresses without a known scheme are tcp", func(t *testing.T) {
+		schemes := []string{SchemeUnix, SchemeMem}
+		for addr, expected := range map[string][2]string{
+			"127.0.0.1:5000":   {SchemeTCP, "127.0.0.1:5000"},
+			"unix:/tmp/a.sock": {SchemeUnix, "/tmp/a.sock"},
+			"mem:alice":        {SchemeMem, "alice"},
+			"[200::1]:5000":    {SchemeTCP, "[200::1]:5000"},
+			"example.com:5000": {SchemeTCP, "example.com:5000"},
+		} {
+			scheme, rest := SplitScheme(addr, schemes)
+			if scheme != expected[0] || rest != expected[1] {
+				t.Errorf("%s: expected %v, got %s %s", addr, expected, scheme, rest)
+			}
+		}
+	})
+}
+
+// maskedFrame is a frame sent by a browser, fin is false for the non-last fragments
+func maskedFrame(opcode byte, fin bool, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocket(t *testing.T) {
+	logger := logs.NewSlogLogger("transport_test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("browser-like client gets the frames as binary messages", func(t *testing.T) {
+		listener, err := NewWebSocket(logger).Listen(ctx, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		_, addr := SplitScheme(listener.Addr().String(), []string{SchemeWebSocket})
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// the handshake example from RFC 6455
+		conn.Write([]byte("GET " + WebSocketPath + " HTTP/1.1\r\nHost: " + addr + "\r\n" +
+			"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Fatalf("Unexpected Sec-WebSocket-Accept %q", accept)
+		}
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the message is split into two fragments with a ping in between
+		msg, _ := tcp_message.NewTCPMessage(logger, &pb.TCPMessagePayload{Type: "room_message", Data: []byte("hi")})
+		conn.Write(maskedFrame(wsOpBinary, false, msg[:5]))
+		conn.Write(maskedFrame(wsOpPing, true, []byte("p")))
+		conn.Write(maskedFrame(wsOpContinuation, true, msg[5:]))
+		if payload := receive(t, server); payload.Type != "room_message" || string(payload.Data) != "hi" {
+			t.Errorf("Unexpected payload %v", payload)
+		}
+
+		server.Send(&pb.TCPMessagePayload{Type: "pong", Data: []byte("1")})
+		client := newWSConn(conn, reader, true)
+		frames := map[byte][]byte{}
+		for len(frames) < 2 {
+			opcode, payload, err := client.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames[opcode] = payload
+		}
+		if string(frames[wsOpPong]) != "p" {
+			t.Errorf("Expected the pong with the ping's payload, got %q", frames[wsOpPong])
+		}
+		expected, _ := tcp_message.NewTCPMessage(logger, &pb.TCPMessagePayload{Type: "pong", Data: []byte("1")})
+		if string(frames[wsOpBinary]) != string(expected) {
+			t.Errorf("Expected a single binary message with the TCPMessage, got %q", frames[wsOpBinary])
+		}
+	})
+
+	t.Run("dial fails when the server doesn't answer the upgrade", func(t *testing.T) {
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			_, err := NewWebSocket(logger).Dial(ctx, silent.Addr().String())
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("Expected the handshake error")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the dial to give up at ctx's deadline")
+		}
+	})
+
+	t.Run("plain http requests are rejected", func(t *testing.T) {
+		listener, err := NewWebSocket(logger).Listen(ctx, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		_, addr := SplitScheme(listener.Addr().String(), []string{SchemeWebSocket})
+		resp, err := http.Get("http://" + addr + WebSocketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/rudp"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+)
+
+// SchemeUDP is the reliable UDP transport (see the rudp package), i.e. "udp:1.2.3.4:5000"
+const SchemeUDP = "udp"
+
+// udpTransport dials from the listening socket if there's one, so the remote node
+// sees the same address (and NAT mapping) the node is listening on
+type udpTransport struct {
+	logger    logs.Logger
+	mu        sync.Mutex
+	listeners []*rudp.Listener
+}
+
+func NewUDP(logger logs.Logger) Transport {
+	return &udpTransport{logger: logger}
+}
+
+func (t *udpTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	listener, err := rudp.Listen(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	t.mu.Lock()
+	t.listeners = append(t.listeners, listener)
+	t.mu.Unlock()
+	return &udpListener{transport: t, ctx: ctx, listener: listener}, nil
+}
+
+func (t *udpTransport) Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error) {
+	t.mu.Lock()
+	var listener *rudp.Listener
+	if len(t.listeners) > 0 && !isOwnAddr(t.listeners[0].Addr(), addr) {
+		listener = t.listeners[0]
+	}
+	t.mu.Unlock()
+	var conn net.Conn
+	var err error
+	if listener != nil {
+		conn, err = listener.Dial(ctx, addr)
+	} else {
+		conn, err = rudp.Dial(ctx, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to udp %s: %w", addr, err)
+	}
+	conn = addrConn{Conn: conn, local: conn.LocalAddr(), remote: Addr{SchemeUDP, addr}}
+	return tcp_conn.NewTCPConn(ctx, t.logger, conn), nil
+}
+
+// isOwnAddr reports whether the addr is the listener's one, the connection
+// to itself can't be dialed from the listening socket
+func isOwnAddr(listenAddr net.Addr, addr string) bool {
+	local, ok := listenAddr.(*net.UDPAddr)
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if !ok || err != nil || local.Port != remote.Port {
+		return false
+	}
+	if remote.IP.IsLoopback() || remote.IP.Equal(local.IP) {
+		return true
+	}
+	if !local.IP.IsUnspecified() {
+		return false
+	}
+	// listening on all the interfaces, the addr is own if it's one of the interfaces' IPs
+	ifaceAddrs, _ := net.InterfaceAddrs()
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *udpTransport) removeListener(listener *rudp.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, l := range t.listeners {
+		if l == listener {
+			t.listeners = append(t.listeners[:i], t.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+type udpListener struct {
+	transport *udpTransport
+	ctx       context.Context
+	listener  *rudp.Listener
+}
+
+func (l *udpListener) Accept() (*tcp_conn.TCPConn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn = addrConn{Conn: conn, local: l.Addr(), remote: Addr{SchemeUDP, conn.RemoteAddr().String()}}
+	return tcp_conn.NewTCPConn(l.ctx, l.transport.logger, conn), nil
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return Addr{SchemeUDP, l.listener.Addr().String()}
+}
+
+func (l *udpListener) Close() error {
+	l.transport.removeListener(l.listener)
+	return l.listener.Close()
+}
@@ -0,0 +1,351 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+)
+
+// WebSocket transport lets the browsers connect to the node. Every TCPMessage
+// (the same frames as over TCP) is sent as a single binary WebSocket message,
+// so the browser client has to speak the TCPMessage framing over the WebSocket.
+//
+// It's a minimal RFC 6455 implementation with the stdlib: no extensions
+// (i.e. no compression), no subprotocols, any Origin is accepted.
+// Addresses are "ws:host:port", the endpoint's path is WebSocketPath.
+
+const (
+	SchemeWebSocket = "ws"
+	WebSocketPath   = "/nexuslink"
+
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 2 * 1024 * 1024
+	// wsHandshakeTimeout limits the HTTP upgrade of the dial, unless ctx's deadline is earlier
+	wsHandshakeTimeout = 10 * time.Second
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+type webSocketTransport struct {
+	logger logs.Logger
+}
+
+func NewWebSocket(logger logs.Logger) Transport {
+	return &webSocketTransport{logger: logger}
+}
+
+func (t *webSocketTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on ws %s: %w", addr, err)
+	}
+	l := &wsListener{
+		transport: t,
+		ctx:       ctx,
+		listener:  listener,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(WebSocketPath, l.upgrade)
+	l.server = &http.Server{Handler: mux}
+	go l.server.Serve(listener)
+	return l, nil
+}
+
+func (t *webSocketTransport) Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ws %s: %w", addr, err)
+	}
+	// the server may accept the connection and never answer the upgrade
+	deadline := time.Now().Add(wsHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	ws, err := wsClientHandshake(conn, addr)
+	if !stop() || err != nil {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("websocket handshake with %s: %w", addr, ctx.Err())
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.remote = Addr{SchemeWebSocket, addr}
+	return tcp_conn.NewTCPConn(ctx, t.logger, ws), nil
+}
+
+func wsClientHandshake(conn net.Conn, host string) (*wsConn, error) {
+	rawKey := make([]byte, 16)
+	rand.Read(rawKey)
+	key := base64.StdEncoding.EncodeToString(rawKey)
+	req := "GET " + WebSocketPath + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, fmt.Errorf("failed to send websocket handshake: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read websocket handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+	return newWSConn(conn, reader, true), nil
+}
+
+// wsAcceptKey is the Sec-WebSocket-Accept for the Sec-WebSocket-Key
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type wsListener struct {
+	transport *webSocketTransport
+	ctx       context.Context
+	listener  net.Listener
+	server    *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header.Get("Connection"), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return
+	}
+	ws := newWSConn(conn, rw.Reader, false)
+	ws.local = l.Addr()
+	ws.remote = Addr{SchemeWebSocket, conn.RemoteAddr().String()}
+	select {
+	case l.conns <- ws:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func headerContains(header string, token string) bool {
+	for _, part := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *wsListener) Accept() (*tcp_conn.TCPConn, error) {
+	select {
+	case conn := <-l.conns:
+		return tcp_conn.NewTCPConn(l.ctx, l.transport.logger, conn), nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return Addr{SchemeWebSocket, l.listener.Addr().String()}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.server.Close()
+}
+
+// wsConn is a net.Conn over the WebSocket: every Write is sent as a binary message,
+// Read returns the payloads of the received data messages as a stream
+type wsConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	isClient bool // client's frames must be masked, server's must not
+	local    net.Addr
+	remote   net.Addr
+	writeMu  sync.Mutex
+	pending  []byte // unread part of the current message's payload
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader, isClient bool) *wsConn {
+	return &wsConn{Conn: conn, reader: reader, isClient: isClient}
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsOpBinary, wsOpText, wsOpContinuation:
+			c.pending = payload
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads a single frame, fragments of the messages are returned as they come
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	isMasked := header[1]&0x80 != 0
+	if isMasked == c.isClient {
+		return 0, nil, errors.New("invalid websocket frame masking")
+	}
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if size > wsMaxMessageSize {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", size)
+	}
+	mask := make([]byte, 4)
+	if isMasked {
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if isMasked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode} // FIN, no fragmentation
+	maskBit := byte(0)
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskBit|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	if c.isClient {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,57 @@
+package yggdrasil
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+	"github.com/ulshv/nexuslink/pkg/tcp_conn"
+	"github.com/ulshv/nexuslink/pkg/transport"
+)
+
+const Scheme = "ygg"
+
+// Transport is TCP restricted to the Yggdrasil addresses, so the connections
+// never leave the overlay, i.e. "ygg:[200:1234::1]:5000".
+// Listening on the address without the host (i.e. "ygg::5000") binds to the node's overlay address.
+type Transport struct {
+	tcp  transport.Transport
+	self net.IP
+}
+
+func NewTransport(logger logs.Logger, self net.IP) *Transport {
+	return &Transport{tcp: transport.NewTCP(logger), self: self}
+}
+
+func (t *Transport) Listen(ctx context.Context, addr string) (transport.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if host == "" {
+		addr = net.JoinHostPort(t.self.String(), port)
+	} else if !IsYggdrasilAddr(addr) {
+		return nil, fmt.Errorf("%s is not a yggdrasil address", host)
+	}
+	listener, err := t.tcp.Listen(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return yggListener{listener}, nil
+}
+
+func (t *Transport) Dial(ctx context.Context, addr string) (*tcp_conn.TCPConn, error) {
+	if !IsYggdrasilAddr(addr) {
+		return nil, fmt.Errorf("%s is not a yggdrasil address", addr)
+	}
+	return t.tcp.Dial(ctx, addr)
+}
+
+type yggListener struct {
+	transport.Listener
+}
+
+func (l yggListener) Addr() net.Addr {
+	return transport.Addr{Scheme: Scheme, Path: l.Listener.Addr().String()}
+}
@@ -0,0 +1,125 @@
+// yggdrasil lets the node use the Yggdrasil overlay network (https://yggdrasil-network.github.io)
+// as the underlay: the local Yggdrasil daemon gives the node an IPv6 address from 200::/7
+// (derived from the daemon's public key) which is reachable by the other Yggdrasil nodes
+// via the end-to-end encrypted overlay, from anywhere and without the port forwarding.
+//
+// The node talks to the daemon through its admin socket to learn the overlay address
+// and advertises it to the peers. The traffic itself is plain TCP over the daemon's
+// TUN interface, see Transport. Embedding the daemon into the node is not supported
+// (it would pull yggdrasil-go and its dependencies in), run the daemon alongside.
+package yggdrasil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const DefaultAdminEndpoint = "unix:///var/run/yggdrasil.sock"
+
+// IsYggdrasilIP reports whether the ip is in 200::/7:
+// 200::/8 are the nodes' addresses, 300::/8 are the subnets routed to the nodes
+func IsYggdrasilIP(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() == nil && ip[0]&0xfe == 0x02
+}
+
+// IsYggdrasilAddr reports whether the host:port's host is a Yggdrasil IP
+func IsYggdrasilAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return IsYggdrasilIP(net.ParseIP(host))
+}
+
+// Self is the local Yggdrasil node's info
+type Self struct {
+	Address   net.IP
+	Subnet    string
+	PublicKey string
+	Build     string
+}
+
+type adminRequest struct {
+	Request   string `json:"request"`
+	KeepAlive bool   `json:"keepalive"`
+}
+
+type adminResponse struct {
+	Status   string          `json:"status"`
+	Error    string          `json:"error"`
+	Response json.RawMessage `json:"response"`
+}
+
+type getSelfResponse struct {
+	BuildName    string `json:"build_name"`
+	BuildVersion string `json:"build_version"`
+	PublicKey    string `json:"key"`
+	Address      string `json:"address"`
+	Subnet       string `json:"subnet"`
+}
+
+// Admin is the client of the daemon's admin socket,
+// endpoint is "unix:///path/to/yggdrasil.sock" or "tcp://host:port"
+type Admin struct {
+	endpoint string
+}
+
+func NewAdmin(endpoint string) *Admin {
+	if endpoint == "" {
+		endpoint = DefaultAdminEndpoint
+	}
+	return &Admin{endpoint: endpoint}
+}
+
+// GetSelf asks the daemon for its overlay address
+func (a *Admin) GetSelf(ctx context.Context) (Self, error) {
+	raw, err := a.call(ctx, "getSelf")
+	if err != nil {
+		return Self{}, err
+	}
+	resp := getSelfResponse{}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return Self{}, fmt.Errorf("invalid getSelf response: %w", err)
+	}
+	ip := net.ParseIP(resp.Address)
+	if !IsYggdrasilIP(ip) {
+		return Self{}, fmt.Errorf("invalid yggdrasil address %q", resp.Address)
+	}
+	return Self{
+		Address:   ip,
+		Subnet:    resp.Subnet,
+		PublicKey: resp.PublicKey,
+		Build:     strings.TrimSpace(resp.BuildName + " " + resp.BuildVersion),
+	}, nil
+}
+
+// call sends a single request over a new connection and returns the response's payload
+func (a *Admin) call(ctx context.Context, request string) (json.RawMessage, error) {
+	network, addr, ok := strings.Cut(a.endpoint, "://")
+	if !ok || (network != "unix" && network != "tcp") {
+		return nil, fmt.Errorf("invalid admin endpoint %q, expected unix:///path or tcp://host:port", a.endpoint)
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to yggdrasil admin socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(adminRequest{Request: request}); err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %w", request, err)
+	}
+	resp := adminResponse{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", request, err)
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("%s request failed: %s", request, resp.Error)
+	}
+	return resp.Response, nil
+}
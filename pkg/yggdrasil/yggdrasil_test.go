@@ -0,0 +1,101 @@
+package yggdrasil
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ulshv/nexuslink/pkg/logs"
+)
+
+// fakeAdminSocket answers the admin requests with the canned responses
+func fakeAdminSocket(t *testing.T, responses map[string]string) string {
+	path := filepath.Join(t.TempDir(), "yggdrasil.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			req := adminRequest{}
+			if json.NewDecoder(conn).Decode(&req) == nil {
+				resp, ok := responses[req.Request]
+				if !ok {
+					resp = `{"status":"error","error":"unknown request"}`
+				}
+				conn.Write([]byte(resp + "\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return "unix://" + path
+}
+
+func TestYggdrasil(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("only 200::/7 addresses are yggdrasil ones", func(t *testing.T) {
+		for addr, expected := range map[string]bool{
+			"[200:1234:5678::1]:5000": true,
+			"[301:abcd::1]:5000":      true,
+			"[2001:db8::1]:5000":      false,
+			"[400::1]:5000":           false,
+			"[::1]:5000":              false,
+			"127.0.0.1:5000":          false,
+			"200::1":                  false, // no port
+		} {
+			if IsYggdrasilAddr(addr) != expected {
+				t.Errorf("%s: expected %v", addr, expected)
+			}
+		}
+	})
+
+	t.Run("overlay address is read from the admin socket", func(t *testing.T) {
+		endpoint := fakeAdminSocket(t, map[string]string{
+			"getSelf": `{"status":"success","request":{"request":"getSelf"},"response":{` +
+				`"build_name":"yggdrasil","build_version":"0.5.8","key":"aabbcc",` +
+				`"address":"200:1234:5678:9abc::1","subnet":"300:1234:5678:9abc::/64"}}`,
+		})
+		self, err := NewAdmin(endpoint).GetSelf(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !self.Address.Equal(net.ParseIP("200:1234:5678:9abc::1")) || self.PublicKey != "aabbcc" {
+			t.Errorf("Unexpected self %+v", self)
+		}
+	})
+
+	t.Run("admin errors and non-overlay addresses are reported", func(t *testing.T) {
+		endpoint := fakeAdminSocket(t, map[string]string{
+			"getSelf": `{"status":"success","response":{"address":"10.0.0.1"}}`,
+		})
+		if _, err := NewAdmin(endpoint).GetSelf(ctx); err == nil {
+			t.Error("Expected the invalid address error")
+		}
+		if _, err := NewAdmin(fakeAdminSocket(t, nil)).GetSelf(ctx); err == nil {
+			t.Error("Expected the admin error")
+		}
+		if _, err := NewAdmin("http://localhost:9001").GetSelf(ctx); err == nil {
+			t.Error("Expected the invalid endpoint error")
+		}
+	})
+
+	t.Run("transport refuses addresses outside of the overlay", func(t *testing.T) {
+		tr := NewTransport(logs.NewSlogLogger("yggdrasil_test"), net.ParseIP("200::1"))
+		if _, err := tr.Dial(ctx, "127.0.0.1:5000"); err == nil {
+			t.Error("Expected the dial error")
+		}
+		if _, err := tr.Listen(ctx, "127.0.0.1:0"); err == nil {
+			t.Error("Expected the listen error")
+		}
+	})
+}